@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+)
+
+// adminHandler serves the moderation endpoints, which take the community and mac as form values and require the admin token as a bearer token
+func adminHandler(manager *handlers.CommunitiesManager, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	handle := func(path string, f func(community string, mac string) error) {
+		mux.HandleFunc(path, func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+
+				return
+			}
+
+			provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				http.Error(rw, "Invalid admin token", http.StatusUnauthorized)
+
+				return
+			}
+
+			community, mac := r.FormValue("community"), r.FormValue("mac")
+			if community == "" || mac == "" {
+				http.Error(rw, "Community and mac are required", http.StatusBadRequest)
+
+				return
+			}
+
+			if err := f(community, mac); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+
+				return
+			}
+
+			rw.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	handle("/admin/kick", manager.Kick)
+	handle("/admin/ban", manager.Ban)
+	handle("/admin/unban", func(community string, mac string) error {
+		manager.Unban(community, mac)
+
+		return nil
+	})
+
+	return mux
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/JakWai01/sile-fystem/pkg/filesystem"
 	"github.com/JakWai01/sile-fystem/pkg/posix"
@@ -23,6 +25,7 @@ import (
 	"github.com/alphahorizonio/libentangle/pkg/callbacks"
 	"github.com/alphahorizonio/libentangle/pkg/handlers"
 	"github.com/alphahorizonio/libentangle/pkg/networking"
+	"github.com/pion/webrtc/v3"
 )
 
 const (
@@ -42,7 +45,7 @@ var clientCmd = &cobra.Command{
 		}
 
 		onOpen := make(chan struct{})
-		manager := handlers.NewClientManager(func() {
+		manager := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {
 			onOpen <- struct{}{}
 		})
 
@@ -179,14 +182,26 @@ var clientCmd = &cobra.Command{
 
 		mfs, err := fuse.Mount(viper.GetString(mountpointFlag), serve, cfg)
 		if err != nil {
-			log.Fatalf("Mount: %v", err)
+			return err
 		}
 
-		if err := mfs.Join(context.Background()); err != nil {
-			log.Fatalf("Join %v", err)
-		}
+		// Leave the community and unmount on SIGINT or SIGTERM, so that Join returns. Stopping on return leaves too.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		go func() {
+			<-ctx.Done()
+
+			if err := cm.Close(); err != nil {
+				l.Debug("Could not leave community", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+
+			fuse.Unmount(viper.GetString(mountpointFlag))
+		}()
 
-		return nil
+		return mfs.Join(context.Background())
 
 	},
 }
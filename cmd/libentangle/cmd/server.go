@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -12,6 +15,7 @@ import (
 	"github.com/alphahorizonio/libentangle/pkg/callbacks"
 	"github.com/alphahorizonio/libentangle/pkg/handlers"
 	"github.com/alphahorizonio/libentangle/pkg/networking"
+	"github.com/pion/webrtc/v3"
 )
 
 const (
@@ -24,7 +28,7 @@ var serverCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 
 		onOpen := make(chan struct{})
-		manager := handlers.NewClientManager(func() {
+		manager := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {
 			onOpen <- struct{}{}
 		})
 
@@ -40,7 +44,16 @@ var serverCmd = &cobra.Command{
 
 		<-onOpen
 
-		select {}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		select {
+		case <-ctx.Done():
+			// Let the other members know that we left
+			return cm.Close()
+		case <-cm.Done():
+			return cm.Err()
+		}
 
 	},
 }
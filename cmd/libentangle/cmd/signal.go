@@ -1,22 +1,27 @@
 package cmd
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/alphahorizonio/libentangle/internal/logging"
-	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
 	"github.com/alphahorizonio/libentangle/pkg/handlers"
 	"github.com/alphahorizonio/libentangle/pkg/signaling"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"nhooyr.io/websocket"
 )
 
 const (
-	addressKey = "address"
+	addressKey     = "address"
+	adminTokenKey  = "admin-token"
+	compressionKey = "compression"
+	exitOnCloseKey = "exit-on-close"
 )
 
 var signalCmd = &cobra.Command{
@@ -24,69 +29,75 @@ var signalCmd = &cobra.Command{
 	Short: "Start a signaling server",
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		for {
-			port := os.Getenv("PORT")
-			if port == "" {
-				port = "9090"
-			}
-
-			socket := viper.GetString(addressKey) + ":" + port
-
-			addr, err := net.ResolveTCPAddr("tcp", socket)
-			if err != nil {
-				return err
-			}
-
-			log.Printf("signaling server listening on %v", addr)
-
-			manager := handlers.NewCommunitiesManager()
-
-			l := logging.NewJSONLogger(viper.GetInt(verboseFlag))
-
-			signaler := signaling.NewSignalingServer(
-				func(application api.Application, conn *websocket.Conn) error {
-					return manager.HandleApplication(application, conn)
-				},
-				func(ready api.Ready, conn *websocket.Conn) error {
-					return manager.HandleReady(ready, conn)
-				},
-				func(offer api.Offer) error {
-					return manager.HandleOffer(offer)
-				},
-				func(answer api.Answer) error {
-					return manager.HandleAnswer(answer)
-				},
-				func(candidate api.Candidate) error {
-					return manager.HandleCandidate(candidate)
-				},
-				func(exited api.Exited) error {
-					return manager.HandleExited(exited)
-				},
-				l,
-			)
-
-			handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-				conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{
-					InsecureSkipVerify: true, // CORS
-				})
-				if err != nil {
-					panic(err)
-				}
-
-				log.Println("client connected")
-
-				go func() {
-					signaler.HandleConn(*conn)
-				}()
-			})
-
-			http.ListenAndServe(addr.String(), handler)
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "9090"
 		}
+
+		socket := viper.GetString(addressKey) + ":" + port
+
+		addr, err := net.ResolveTCPAddr("tcp", socket)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("signaling server listening on %v", addr)
+
+		server, err := signaling.NewServer(signaling.ServerOptions{
+			Communities: handlers.CommunitiesManagerConfig{
+				ExitOnClose: viper.GetBool(exitOnCloseKey),
+			},
+			Compression: viper.GetBool(compressionKey),
+			Logger:      logging.NewJSONLogger(viper.GetInt(verboseFlag)),
+		})
+		if err != nil {
+			return err
+		}
+
+		var handler http.Handler = server
+
+		// The moderation endpoints are only served with an admin token
+		if token := viper.GetString(adminTokenKey); token != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/", server)
+			mux.Handle("/admin/", adminHandler(server.Manager, token))
+
+			handler = mux
+		}
+
+		httpServer := &http.Server{Addr: addr.String(), Handler: handler}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- httpServer.ListenAndServe()
+		}()
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		select {
+		case <-ctx.Done():
+		case err := <-errs:
+			return err
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// The signaling server refuses new connections once it is shut down, so the HTTP server only has to stop listening
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+
+		return httpServer.Shutdown(shutdownCtx)
 	},
 }
 
 func init() {
 	signalCmd.PersistentFlags().String(addressKey, "0.0.0.0", "Listen address")
+	signalCmd.PersistentFlags().Bool(compressionKey, false, "Compress the signaling messages of clients which support permessage-deflate")
+	signalCmd.PersistentFlags().Bool(exitOnCloseKey, false, "Remove clients from their communities as soon as their connection closes instead of waiting for them to reconnect")
+	signalCmd.PersistentFlags().String(adminTokenKey, "", "Token required to kick and ban macs through /admin/kick, /admin/ban and /admin/unban (disabled if empty)")
 
 	if err := viper.BindPFlags(signalCmd.PersistentFlags()); err != nil {
 		log.Fatal("could not bind flags:", err)
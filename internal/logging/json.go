@@ -55,6 +55,11 @@ func NewJSONLoggerWriter(verbosity int, event, key string) io.Writer {
 	return writer
 }
 
+// Enabled reports whether messages of a level are emitted with the logger's verbosity
+func (l JSONLogger) Enabled(level int) bool {
+	return l.verbosity >= level
+}
+
 func (l JSONLogger) Trace(event string, keyvals ...interface{}) {
 	if l.verbosity >= 4 {
 		printJSON("TRACE", event, keyvals)
@@ -0,0 +1,64 @@
+package tap
+
+import (
+	"encoding/json"
+	"sync"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+)
+
+// Amount of messages queued for a slow hook before further ones are dropped
+const bufferSize = 256
+
+// Tap calls a hook with copies of signaling messages in order from its own goroutine, so that a slow hook
+// doesn't block reading from or writing to the connection. Messages are dropped while the hook is behind.
+type Tap struct {
+	hook     func(message api.Message)
+	messages chan api.Message
+	once     sync.Once
+}
+
+// New returns nil for a nil hook, on which Send does nothing
+func New(hook func(message api.Message)) *Tap {
+	if hook == nil {
+		return nil
+	}
+
+	return &Tap{
+		hook:     hook,
+		messages: make(chan api.Message, bufferSize),
+	}
+}
+
+func (t *Tap) Send(message api.Message) {
+	if t == nil {
+		return
+	}
+
+	t.once.Do(func() {
+		go func() {
+			for message := range t.messages {
+				t.hook(message)
+			}
+		}()
+	})
+
+	select {
+	case t.messages <- message:
+	default:
+	}
+}
+
+// SendJSON decodes the header of an encoded message and sends it
+func (t *Tap) SendJSON(data []byte) {
+	if t == nil {
+		return
+	}
+
+	var message api.Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return
+	}
+
+	t.Send(message)
+}
@@ -0,0 +1,55 @@
+package testhooks
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Hooks into the handlers which the tests use to provoke failures that can't be caused through the public API.
+// Each setter returns a function which restores the previous hook, e.g. for t.Cleanup.
+var (
+	lock             sync.RWMutex
+	beforeSend       func(mac string)
+	mungeDescription func(mac string, description webrtc.SessionDescription) webrtc.SessionDescription
+)
+
+// BeforeSend returns the hook called while a message to a peer is being sent, holding the peer's send slot
+func BeforeSend() func(mac string) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return beforeSend
+}
+
+func SetBeforeSend(hook func(mac string)) func() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous := beforeSend
+	beforeSend = hook
+
+	return func() {
+		SetBeforeSend(previous)
+	}
+}
+
+// MungeDescription returns the hook which rewrites each offer and answer before it is set as local description
+func MungeDescription() func(mac string, description webrtc.SessionDescription) webrtc.SessionDescription {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return mungeDescription
+}
+
+func SetMungeDescription(hook func(mac string, description webrtc.SessionDescription) webrtc.SessionDescription) func() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous := mungeDescription
+	mungeDescription = hook
+
+	return func() {
+		SetMungeDescription(previous)
+	}
+}
@@ -0,0 +1,35 @@
+package writes
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/alphahorizonio/libentangle/internal/tap"
+	"nhooyr.io/websocket"
+)
+
+// Conn is the part of a websocket connection which signaling messages are written to
+type Conn interface {
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+}
+
+// WithTimeout writes a signaling message and passes a copy of it to the tap. A write which exceeds the timeout fails
+// and closes the connection.
+func WithTimeout(conn Conn, timeout time.Duration, v interface{}, outbound *tap.Tap) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
+		return err
+	}
+
+	outbound.SendJSON(data)
+
+	return nil
+}
@@ -5,6 +5,14 @@ type Message struct {
 }
 
 type WrappedMessage struct {
-	Mac     string `json:"mac"`
+	Mac         string `json:"mac"`
+	Opcode      string `json:"opcode,omitempty"`
+	Session     string `json:"session,omitempty"`
+	Sequence    uint64 `json:"sequence,omitempty"`
+	Order       uint64 `json:"order,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Correlation string `json:"correlation,omitempty"`
+	Reply       bool   `json:"reply,omitempty"`
+	// Empty for empty messages, nil only for control messages such as keepalives
 	Payload []byte `json:"payload"`
 }
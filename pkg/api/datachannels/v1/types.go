@@ -13,3 +13,14 @@ const (
 	OpcodeOpenResponse  = "openresponse"
 	OpcodeCloseResponse = "closeresponse"
 )
+
+const (
+	OpcodeKeepalive = "keepalive"
+	OpcodeSession   = "session"
+	OpcodeResume    = "resume"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
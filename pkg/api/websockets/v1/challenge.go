@@ -0,0 +1,24 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Prove computes the proof of knowing a community's secret without revealing it. The proof is bound to the nonce
+// of a single challenge as well as the community and mac applying, so that it can't be replayed.
+func Prove(secret []byte, nonce []byte, community string, mac string) []byte {
+	h := hmac.New(sha256.New, secret)
+
+	h.Write(nonce)
+	h.Write([]byte(community))
+	h.Write([]byte{0})
+	h.Write([]byte(mac))
+
+	return h.Sum(nil)
+}
+
+// VerifyProof checks a proof in constant time
+func VerifyProof(secret []byte, nonce []byte, community string, mac string, proof []byte) bool {
+	return hmac.Equal(proof, Prove(secret, nonce, community, mac))
+}
@@ -1,5 +1,25 @@
 package api
 
+import "time"
+
 type Message struct {
 	Opcode string `json:"opcode"`
+	// Time the message was sent in unix milliseconds and the milliseconds after which it expires. Messages without a TTL don't expire.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	TTL       int64 `json:"ttl,omitempty"`
+}
+
+// SetTTL stamps the message with the time it is sent at, so that it expires after the TTL
+func (m *Message) SetTTL(now time.Time, ttl time.Duration) {
+	m.Timestamp = now.UnixNano() / int64(time.Millisecond)
+	m.TTL = ttl.Milliseconds()
+}
+
+// Expired reports whether the TTL of the message passed, as seen from the receiver's clock
+func (m Message) Expired(now time.Time) bool {
+	if m.TTL <= 0 {
+		return false
+	}
+
+	return now.After(time.Unix(0, (m.Timestamp+m.TTL)*int64(time.Millisecond)))
 }
@@ -4,24 +4,38 @@ type Application struct {
 	Message
 	Community string `json:"community"`
 	Mac       string `json:"mac"`
+	Proof     []byte `json:"proof,omitempty"`
+	// Idempotency key which is the same for each attempt to send an application, so that the mac isn't registered twice
+	Key string `json:"key,omitempty"`
 }
 
 type Acceptance struct {
 	Message
+	Community string   `json:"community,omitempty"`
+	Members   []string `json:"members,omitempty"`
+	// Opaque token with which the mac can reconnect and resume its memberships without applying again, until it expires
+	Token string `json:"token,omitempty"`
+	// Mac assigned to the applicant by servers which don't trust the one it applied with, to be used instead of it
+	Mac string `json:"mac,omitempty"`
 }
 
 type Rejection struct {
 	Message
+	Reason string `json:"reason,omitempty"`
 }
 
 type Ready struct {
 	Message
-	Mac string `json:"mac"`
+	Mac       string `json:"mac"`
+	Community string `json:"community,omitempty"`
 }
 
 type Introduction struct {
 	Message
-	Mac string `json:"mac"`
+	Mac       string `json:"mac"`
+	Community string `json:"community,omitempty"`
+	// Set if the introduced peer asked for it with Repeer, as its connection to the receiver failed
+	Repeer bool `json:"repeer,omitempty"`
 }
 
 type Offer struct {
@@ -29,6 +43,9 @@ type Offer struct {
 	Payload     []byte `json:"payload"`
 	SenderMac   string `json:"sender"`
 	ReceiverMac string `json:"receiver"`
+	Community   string `json:"community,omitempty"`
+	// Increases with each offer of a sender, so that stale and duplicate offers can be ignored. Zero is never ignored.
+	Epoch uint64 `json:"epoch,omitempty"`
 }
 
 type Answer struct {
@@ -36,6 +53,8 @@ type Answer struct {
 	Payload     []byte `json:"payload"`
 	SenderMac   string `json:"sender"`
 	ReceiverMac string `json:"receiver"`
+	// Epoch of the answered offer
+	Epoch uint64 `json:"epoch,omitempty"`
 }
 
 type Candidate struct {
@@ -43,54 +62,143 @@ type Candidate struct {
 	Payload     []byte `json:"payload"`
 	SenderMac   string `json:"sender"`
 	ReceiverMac string `json:"receiver"`
+	// Further candidates which were gathered together with the one of Payload and are sent in the same message
+	Batch [][]byte `json:"batch,omitempty"`
+}
+
+// Payloads returns the candidate of Payload followed by the ones of its batch
+func (c Candidate) Payloads() [][]byte {
+	return append([][]byte{c.Payload}, c.Batch...)
 }
 
 type Exited struct {
 	Message
-	Mac string `json:"mac"`
+	Mac       string `json:"mac"`
+	Community string `json:"community,omitempty"`
 }
 
 type Resignation struct {
 	Message
-	Mac string `json:"mac"`
+	Mac       string `json:"mac"`
+	Community string `json:"community,omitempty"`
+}
+
+type Draining struct {
+	Message
+}
+
+// Presence publishes a status such as typing or away to the other members of a community
+type Presence struct {
+	Message
+	Mac       string `json:"mac"`
+	Community string `json:"community"`
+	Payload   []byte `json:"payload,omitempty"`
+}
+
+// Relay carries application data from one member to another through the signaling server, e.g. before their data channel is open
+type Relay struct {
+	Message
+	Payload     []byte `json:"payload"`
+	SenderMac   string `json:"sender"`
+	ReceiverMac string `json:"receiver"`
+}
+
+// Reconnect resumes the identity and memberships of a mac on a new connection with the token of its latest acceptance
+type Reconnect struct {
+	Message
+	Mac   string `json:"mac"`
+	Token string `json:"token"`
+}
+
+// Repeer asks the signaling server to introduce the sender to the receiver again, so that the receiver offers a new
+// connection to replace the one which failed
+type Repeer struct {
+	Message
+	SenderMac   string `json:"sender"`
+	ReceiverMac string `json:"receiver"`
+	Community   string `json:"community,omitempty"`
+}
+
+type Challenge struct {
+	Message
+	Community string `json:"community"`
+	Nonce     []byte `json:"nonce"`
 }
 
 func NewApplication(community string, mac string) *Application {
-	return &Application{Message: Message{OpcodeApplication}, Community: community, Mac: mac}
+	return &Application{Message: Message{Opcode: OpcodeApplication}, Community: community, Mac: mac}
 }
 
-func NewAcceptance() *Acceptance {
-	return &Acceptance{Message: Message{OpcodeAcceptance}}
+// NewProvenApplication answers a challenge with the proof of knowing the community's secret
+func NewProvenApplication(community string, mac string, proof []byte) *Application {
+	return &Application{Message: Message{Opcode: OpcodeApplication}, Community: community, Mac: mac, Proof: proof}
+}
+
+func NewAcceptance(community string, members ...string) *Acceptance {
+	return &Acceptance{Message: Message{Opcode: OpcodeAcceptance}, Community: community, Members: members}
 }
 
 func NewRejection() *Rejection {
-	return &Rejection{Message: Message{OpcodeRejection}}
+	return &Rejection{Message: Message{Opcode: OpcodeRejection}}
+}
+
+func NewRejectionWithReason(reason string) *Rejection {
+	return &Rejection{Message: Message{Opcode: OpcodeRejection}, Reason: reason}
 }
 
-func NewReady(mac string) *Ready {
-	return &Ready{Message: Message{OpcodeReady}, Mac: mac}
+func NewReady(mac string, community string) *Ready {
+	return &Ready{Message: Message{Opcode: OpcodeReady}, Mac: mac, Community: community}
 }
 
-func NewIntroduction(mac string) *Introduction {
-	return &Introduction{Message: Message{OpcodeIntroduction}, Mac: mac}
+func NewIntroduction(mac string, community string) *Introduction {
+	return &Introduction{Message: Message{Opcode: OpcodeIntroduction}, Mac: mac, Community: community}
 }
 
 func NewOffer(payload []byte, sender string, receiver string) *Offer {
-	return &Offer{Message: Message{OpcodeOffer}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
+	return &Offer{Message: Message{Opcode: OpcodeOffer}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
 }
 
 func NewAnswer(payload []byte, sender string, receiver string) *Answer {
-	return &Answer{Message: Message{OpcodeAnswer}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
+	return &Answer{Message: Message{Opcode: OpcodeAnswer}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
 }
 
 func NewCandidate(payload []byte, sender string, receiver string) *Candidate {
-	return &Candidate{Message: Message{OpcodeCandidate}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
+	return &Candidate{Message: Message{Opcode: OpcodeCandidate}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
 }
 
 func NewExited(mac string) *Exited {
-	return &Exited{Message: Message{OpcodeExited}, Mac: mac}
+	return &Exited{Message: Message{Opcode: OpcodeExited}, Mac: mac}
+}
+
+// NewScopedExited only leaves the given community and keeps the connection to the signaling server open
+func NewScopedExited(mac string, community string) *Exited {
+	return &Exited{Message: Message{Opcode: OpcodeExited}, Mac: mac, Community: community}
+}
+
+func NewResignation(mac string, community string) *Resignation {
+	return &Resignation{Message: Message{Opcode: OpcodeResignation}, Mac: mac, Community: community}
+}
+
+func NewChallenge(community string, nonce []byte) *Challenge {
+	return &Challenge{Message: Message{Opcode: OpcodeChallenge}, Community: community, Nonce: nonce}
+}
+
+func NewDraining() *Draining {
+	return &Draining{Message: Message{Opcode: OpcodeDraining}}
+}
+
+func NewPresence(mac string, community string, payload []byte) *Presence {
+	return &Presence{Message: Message{Opcode: OpcodePresence}, Mac: mac, Community: community, Payload: payload}
+}
+
+func NewRelay(payload []byte, sender string, receiver string) *Relay {
+	return &Relay{Message: Message{Opcode: OpcodeRelay}, Payload: payload, SenderMac: sender, ReceiverMac: receiver}
+}
+
+func NewReconnect(mac string, token string) *Reconnect {
+	return &Reconnect{Message: Message{Opcode: OpcodeReconnect}, Mac: mac, Token: token}
 }
 
-func NewResignation(mac string) *Resignation {
-	return &Resignation{Message: Message{OpcodeResignation}, Mac: mac}
+func NewRepeer(sender string, receiver string, community string) *Repeer {
+	return &Repeer{Message: Message{Opcode: OpcodeRepeer}, SenderMac: sender, ReceiverMac: receiver, Community: community}
 }
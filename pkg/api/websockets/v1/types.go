@@ -11,4 +11,27 @@ const (
 	OpcodeCandidate    = "candidate"
 	OpcodeExited       = "exited"
 	OpcodeResignation  = "resignation"
+	OpcodeChallenge    = "challenge"
+	OpcodeDraining     = "draining"
+	OpcodePresence     = "presence"
+	OpcodeRelay        = "relay"
+	OpcodeReconnect    = "reconnect"
+	OpcodeRepeer       = "repeer"
+)
+
+// Maximum size in bytes of the payload of a presence message
+const MaxPresenceSize = 256
+
+// Maximum size in bytes of the payload of a relayed message
+const MaxRelaySize = 4096
+
+const (
+	// The signaling server is about to restart and does not accept new applications
+	RejectionDraining = "draining"
+	// The application would create a new community, but the signaling server hosts its maximum amount of communities
+	RejectionCommunityLimit = "community-limit"
+	// The mac is banned from the community
+	RejectionBanned = "banned"
+	// The reconnect token is unknown or expired, so the client has to apply again
+	RejectionInvalidToken = "invalid-token"
 )
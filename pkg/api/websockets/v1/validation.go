@@ -0,0 +1,142 @@
+package api
+
+import "strconv"
+
+type InvalidMessage struct {
+	Opcode string
+	Field  string
+}
+
+func (m *InvalidMessage) Error() string {
+	return "Invalid " + m.Opcode + " message: " + m.Field + " is required"
+}
+
+type PayloadTooLarge struct {
+	Opcode string
+	Size   int
+	Max    int
+}
+
+func (m *PayloadTooLarge) Error() string {
+	return "Invalid " + m.Opcode + " message: payload of " + strconv.Itoa(m.Size) + " bytes exceeds the maximum of " + strconv.Itoa(m.Max) + " bytes"
+}
+
+func (a Application) Validate() error {
+	if a.Community == "" {
+		return &InvalidMessage{OpcodeApplication, "community"}
+	}
+
+	if a.Mac == "" {
+		return &InvalidMessage{OpcodeApplication, "mac"}
+	}
+
+	return nil
+}
+
+func (r Ready) Validate() error {
+	if r.Mac == "" {
+		return &InvalidMessage{OpcodeReady, "mac"}
+	}
+
+	return nil
+}
+
+func (o Offer) Validate() error {
+	return validateForwarded(OpcodeOffer, o.Payload, o.SenderMac, o.ReceiverMac)
+}
+
+func (a Answer) Validate() error {
+	return validateForwarded(OpcodeAnswer, a.Payload, a.SenderMac, a.ReceiverMac)
+}
+
+func (c Candidate) Validate() error {
+	if err := validateForwarded(OpcodeCandidate, c.Payload, c.SenderMac, c.ReceiverMac); err != nil {
+		return err
+	}
+
+	for _, payload := range c.Batch {
+		if len(payload) == 0 {
+			return &InvalidMessage{OpcodeCandidate, "batch"}
+		}
+	}
+
+	return nil
+}
+
+func (e Exited) Validate() error {
+	if e.Mac == "" {
+		return &InvalidMessage{OpcodeExited, "mac"}
+	}
+
+	return nil
+}
+
+func (r Reconnect) Validate() error {
+	if r.Mac == "" {
+		return &InvalidMessage{OpcodeReconnect, "mac"}
+	}
+
+	if r.Token == "" {
+		return &InvalidMessage{OpcodeReconnect, "token"}
+	}
+
+	return nil
+}
+
+func (r Repeer) Validate() error {
+	if r.SenderMac == "" {
+		return &InvalidMessage{OpcodeRepeer, "sender"}
+	}
+
+	if r.ReceiverMac == "" {
+		return &InvalidMessage{OpcodeRepeer, "receiver"}
+	}
+
+	return nil
+}
+
+// An empty payload clears the presence
+func (p Presence) Validate() error {
+	if p.Mac == "" {
+		return &InvalidMessage{OpcodePresence, "mac"}
+	}
+
+	if p.Community == "" {
+		return &InvalidMessage{OpcodePresence, "community"}
+	}
+
+	if len(p.Payload) > MaxPresenceSize {
+		return &PayloadTooLarge{OpcodePresence, len(p.Payload), MaxPresenceSize}
+	}
+
+	return nil
+}
+
+func (r Relay) Validate() error {
+	if err := validateForwarded(OpcodeRelay, r.Payload, r.SenderMac, r.ReceiverMac); err != nil {
+		return err
+	}
+
+	if len(r.Payload) > MaxRelaySize {
+		return &PayloadTooLarge{OpcodeRelay, len(r.Payload), MaxRelaySize}
+	}
+
+	return nil
+}
+
+// Messages which are forwarded from one peer to another need a payload and both macs
+func validateForwarded(opcode string, payload []byte, sender string, receiver string) error {
+	if len(payload) == 0 {
+		return &InvalidMessage{opcode, "payload"}
+	}
+
+	if sender == "" {
+		return &InvalidMessage{opcode, "sender"}
+	}
+
+	if receiver == "" {
+		return &InvalidMessage{opcode, "receiver"}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Clock = &Fake{}
+
+// Fake is a Clock which only advances when told to, firing the timers which are due then
+type Fake struct {
+	lock    sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{}
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now:     now,
+		timers:  []*fakeTimer{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: f,
+		c:     make(chan time.Time, 1),
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.schedule(t, d)
+
+	return t
+}
+
+// Advance moves the clock forward by d and fires all timers whose deadline passed, in the order of their deadlines
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+
+	sort.SliceStable(f.timers, func(i, j int) bool {
+		return f.timers[i].deadline.Before(f.timers[j].deadline)
+	})
+
+	pending := []*fakeTimer{}
+	for _, t := range f.timers {
+		if t.deadline.After(f.now) {
+			pending = append(pending, t)
+
+			continue
+		}
+
+		// As with time.Timer, a value which was not received yet is kept instead
+		select {
+		case t.c <- f.now:
+		default:
+		}
+	}
+	f.timers = pending
+}
+
+// Timers returns the amount of timers which did not fire yet
+func (f *Fake) Timers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.timers)
+}
+
+// WaitForTimers blocks until at least n timers are waiting to fire, e.g. until a goroutine under test started waiting,
+// or until the context is done
+func (f *Fake) WaitForTimers(ctx context.Context, n int) error {
+	for {
+		f.lock.Lock()
+		count := len(f.timers)
+		changed := f.changed
+		f.lock.Unlock()
+
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = f.now.Add(d)
+	f.timers = append(f.timers, t)
+
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// unschedule removes a timer which did not fire yet, returning whether it was found
+func (f *Fake) unschedule(t *fakeTimer) bool {
+	for i, candidate := range f.timers {
+		if candidate == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+
+	return active
+}
@@ -1,7 +1,12 @@
 package config
 
+import "time"
+
 const (
 	NoneKey = ""
+
+	// Time after which a write to a signaling connection is given up on
+	DefaultWriteTimeout = 10 * time.Second
 )
 
 var (
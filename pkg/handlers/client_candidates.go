@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Candidate types in the order in which one of each is kept when the candidates are capped: Host candidates
+// connect peers in the same network directly, server reflexive ones most peers behind NATs and relays all others
+var candidateTypeOrder = []webrtc.ICECandidateType{
+	webrtc.ICECandidateTypeHost,
+	webrtc.ICECandidateTypeSrflx,
+	webrtc.ICECandidateTypeRelay,
+	webrtc.ICECandidateTypePrflx,
+}
+
+// selectCandidates keeps at most max candidates. The best candidate of each type is kept first, so that
+// every way of connecting stays available, the remaining slots are filled in the order of the candidates' priority.
+func selectCandidates(candidates []webrtc.ICECandidate, max int) []webrtc.ICECandidate {
+	if max <= 0 || len(candidates) <= max {
+		return candidates
+	}
+
+	sorted := append([]webrtc.ICECandidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+
+	selected := []webrtc.ICECandidate{}
+	taken := make([]bool, len(sorted))
+	for _, typ := range candidateTypeOrder {
+		if len(selected) >= max {
+			break
+		}
+
+		for i, candidate := range sorted {
+			if candidate.Typ == typ {
+				selected = append(selected, candidate)
+				taken[i] = true
+
+				break
+			}
+		}
+	}
+
+	for i, candidate := range sorted {
+		if len(selected) >= max {
+			break
+		}
+
+		if !taken[i] {
+			selected = append(selected, candidate)
+		}
+	}
+
+	return selected
+}
+
+// candidateBatch collects the candidates gathered within CandidateBatchInterval, so that they are sent in a single message
+type candidateBatch struct {
+	lock       sync.Mutex
+	candidates []webrtc.ICECandidate
+}
+
+// add queues a candidate and reports whether it started a new batch
+func (b *candidateBatch) add(candidate webrtc.ICECandidate) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.candidates = append(b.candidates, candidate)
+
+	return len(b.candidates) == 1
+}
+
+// take returns the queued candidates and starts a new batch
+func (b *candidateBatch) take() []webrtc.ICECandidate {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	candidates := b.candidates
+	b.candidates = nil
+
+	return candidates
+}
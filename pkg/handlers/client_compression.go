@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	apiDataChannels "github.com/alphahorizonio/libentangle/pkg/api/datachannels/v1"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// The zstd encoder and decoder are safe for concurrent use, so they are shared by all ClientManagers
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+// compress compresses the payload of a message with the configured codec, unless it is too small or does not shrink
+func (m *ClientManager) compress(w *apiDataChannels.WrappedMessage) error {
+	if m.config.Compression == "" || len(w.Payload) < m.config.compressionThreshold() {
+		return nil
+	}
+
+	var compressed []byte
+	switch m.config.Compression {
+	case apiDataChannels.CompressionGzip:
+		var buf bytes.Buffer
+
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(w.Payload); err != nil {
+			return err
+		}
+
+		if err := writer.Close(); err != nil {
+			return err
+		}
+
+		compressed = buf.Bytes()
+	case apiDataChannels.CompressionZstd:
+		initZstd()
+
+		compressed = zstdEncoder.EncodeAll(w.Payload, nil)
+	default:
+		return errors.New("Unknown compression codec " + m.config.Compression)
+	}
+
+	if len(compressed) >= len(w.Payload) {
+		return nil
+	}
+
+	w.Payload = compressed
+	w.Compression = m.config.Compression
+
+	return nil
+}
+
+// decompress restores the payload of a message compressed by the remote
+func decompress(w *apiDataChannels.WrappedMessage) error {
+	var payload []byte
+	switch w.Compression {
+	case "":
+		return nil
+	case apiDataChannels.CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(w.Payload))
+		if err != nil {
+			return err
+		}
+
+		payload, err = io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+	case apiDataChannels.CompressionZstd:
+		initZstd()
+
+		var err error
+		payload, err = zstdDecoder.DecodeAll(w.Payload, nil)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("Unknown compression codec " + w.Compression)
+	}
+
+	w.Payload = payload
+	w.Compression = ""
+
+	return nil
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"net"
+	"time"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/clock"
+	"github.com/alphahorizonio/libentangle/pkg/config"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	DefaultICEServers = []webrtc.ICEServer{
+		{
+			URLs: []string{"stun:stun.l.google.com:19302"},
+		},
+	}
+)
+
+type ClientManagerConfig struct {
+	// ICE servers to use for each peer connection. Nil uses DefaultICEServers, an empty list only gathers host candidates.
+	ICEServers []webrtc.ICEServer
+	// Candidate types to use for each peer connection. Defaults to all, ICETransportPolicyRelay only uses TURN relays.
+	ICETransportPolicy webrtc.ICETransportPolicy
+	// Resolves the hostnames of stun and turn URLs before each peer connection is created, e.g. for split DNS. Nil lets pion
+	// resolve them with the system resolver, as do failed lookups. stuns and turns URLs are kept, as their certificates are issued for the hostname.
+	Resolver *net.Resolver
+	// Shares a single UDP port among all peer connections instead of binding one per connection, e.g. one created with
+	// webrtc.NewICEUDPMux. Only host candidates are gathered through it. It is not closed by the ClientManager.
+	ICEUDPMux ice.UDPMux
+	// Creates the peer connections instead of a new API for each one, e.g. to share a single API and its engines among all
+	// ClientManagers of a process. Each peer connection gets a copy of its MediaEngine, so it can be used concurrently.
+	// Its SettingEngine takes the place of ICEUDPMux and the ICE credentials and needs to detach the data channels if
+	// DetachDataChannels is set.
+	API *webrtc.API
+	// ICE username fragment and password of all peer connections instead of random ones, only meant for interoperability
+	// tests against other WebRTC stacks. Anyone who knows them can interfere with the connectivity checks.
+	// The fragment needs at least 4 characters and the password at least 22. Empty ones are generated.
+	ICEUsernameFragment string
+	ICEPassword         string
+
+	// Interval in which keepalives are sent on each data channel. Zero disables keepalives.
+	KeepaliveInterval time.Duration
+	// Time without any message from a peer after which it is considered dead. Defaults to three keepalive intervals.
+	KeepaliveTimeout time.Duration
+
+	// Options of the data channel created for each introduced peer, such as its ordering and retransmits. Nil uses the pion defaults.
+	// Channel priority and DSCP marking are not exposed by pion v3.1, so all channels are sent with normal priority.
+	// A negotiated channel is created by both peers without in-band negotiation, using ID 0 unless another ID is set.
+	// All peers of a community need to use the same options then.
+	DataChannelInit *webrtc.DataChannelInit
+	// Subprotocol of the data channels, e.g. to version the application protocol, which takes the place of the Protocol of
+	// DataChannelInit. Channels announced by peers with another protocol are refused with ProtocolMismatch and the peer is
+	// disconnected. Negotiated channels are not announced, so their protocol can't be checked.
+	DataChannelProtocol string
+
+	// Detach the data channels, so that they are read through Conn instead of callbacks, which is faster for high throughput.
+	// The message handler, keepalives and session resumption are unavailable then.
+	DetachDataChannels bool
+
+	OnDisconnected   func(mac string)
+	OnICEStateChange func(mac string, state webrtc.ICEConnectionState)
+	// Called when ICE selects a candidate pair for the connection to a peer, first after connecting and again if it
+	// migrates to another pair, e.g. from a relayed to a direct one
+	OnSelectedCandidatePairChange func(mac string, pair webrtc.ICECandidatePair)
+	// Called once every known member of the joined communities has an open data channel. Fires again if the mesh breaks and completes again.
+	OnMeshComplete func()
+	// Called with the time from receiving the introduction or offer of a peer until its data channel opened
+	OnHandshakeComplete func(mac string, duration time.Duration)
+	// Called for each received message which is not delivered, e.g. with MessageTooLarge or UnknownSender for messages
+	// of peers which are not connected anymore. Nil logs them.
+	OnMessageDropped func(mac string, err error)
+	// Called with a *PeerError for each error which occurs in the background, e.g. a queued handshake which failed, a
+	// candidate which could not be sent or an error of a data channel. Nil logs them.
+	OnError func(err error)
+
+	// Called with a copy of each message sent to the signaling server, such as offers, answers and candidates, e.g. to debug
+	// handshakes. It is called in order from a separate goroutine, messages are dropped while it is behind.
+	OnOutbound func(message api.Message)
+
+	// Upper bounds of the buckets counting handshake durations, in ascending order. Nil counts all handshakes in a single bucket.
+	HandshakeDurationBuckets []time.Duration
+
+	// Renegotiate the existing connection to a peer when it sends another offer, e.g. after RestartICE, instead of
+	// replacing it. Keeps the gathered candidates, the data channel and its congestion state as long as the connection is not closed.
+	ReuseConnections bool
+
+	// Maximum amount of peer connections, further introductions and offers are refused with TooManyPeers. Zero allows any amount.
+	MaxPeers int
+
+	// Maximum amount of handshakes in flight at the same time, further ones are queued. Defaults to 8.
+	MaxConcurrentHandshakes int
+	// Maximum amount of message handler calls running at the same time across all peers, e.g. to protect a database
+	// the handler writes to. Further messages wait for a call to return, which holds up reading from their channel.
+	// Zero calls the handler for all peers at once.
+	MaxConcurrentHandlers int
+	// Re-establish the connection to a peer which failed or closed after it was established, e.g. after a network change,
+	// with a new handshake through the signaling server, while the connections to the other peers are kept. OnDisconnected
+	// is called for the failed connection. The peer with the lower mac offers, and the other one asks it to through the
+	// signaling server if it noticed the failure first, so both peers need to enable it.
+	RepeerFailed bool
+	// Maximum amount of attempts to re-establish a failed connection in a row, after which RepeerFailed gives up with
+	// RepeerExhausted. The attempts start over once the connection was re-established. Defaults to 3.
+	RepeerAttempts int
+	// Initial delay before re-establishing a failed connection, which doubles with each attempt. Defaults to one second.
+	RepeerBackoff time.Duration
+	// Amount of times creating an offer or answer and setting it as local description is retried if it failed.
+	// Zero fails the handshake right away.
+	HandshakeRetries int
+	// Initial delay before retrying to create an offer or answer, which doubles with each attempt. Defaults to 100ms.
+	HandshakeRetryBackoff time.Duration
+
+	// Called for each gathered candidate, returning false keeps it from being sent, e.g. to skip IPv6 or link-local addresses. Nil sends all candidates.
+	CandidateFilter func(candidate webrtc.ICECandidate) bool
+	// Types of the candidates to gather, e.g. only ICECandidateTypeHost or ICECandidateTypeRelay to reproduce a specific
+	// network path. The ICE servers are skipped without server reflexive and relay candidates, and only relays are gathered
+	// if they are the only type. Candidates of other types which are gathered anyway are not sent. Nil gathers all types.
+	CandidateTypes []webrtc.ICECandidateType
+	// Maximum amount of candidates sent to each peer, keeping one of each type before the ones with the highest priority.
+	// Candidates are held back until gathering is complete then, which delays the handshake. Zero sends all candidates as they are gathered.
+	MaxCandidates int
+	// Time candidates are collected after the first one was gathered, so that they are sent together in a single message,
+	// e.g. on hosts with many interfaces. Zero sends each candidate as it is gathered.
+	CandidateBatchInterval time.Duration
+
+	// Amount of times a candidate which could not be sent is resent. Defaults to 5.
+	CandidateRetries int
+	// Initial delay before resending a candidate, which doubles with each attempt. Defaults to 100ms.
+	CandidateRetryBackoff time.Duration
+
+	// Number messages and resend the ones a peer missed after it reconnects with the same ClientManager
+	SessionResumption bool
+	// Amount of sent messages kept per session for resending. Defaults to 256.
+	ResumeBufferSize int
+
+	// Deliver the messages of each peer in the order they were sent, e.g. with an unordered DataChannelInit. Messages
+	// arriving early are buffered until the missing ones arrive. Needs to be enabled by the sending peers too.
+	// Messages resent by SessionResumption are delivered as they arrive.
+	OrderedDelivery bool
+	// Maximum amount of messages buffered per peer while one is missing, which is skipped once more arrive. Defaults to 64.
+	ReorderWindow int
+	// Time after which a missing message is skipped and the buffered ones are delivered. Defaults to one second.
+	ReorderGapTimeout time.Duration
+
+	// Maximum amount of messages buffered per peer while receiving from it is paused with PauseReceive, further ones are
+	// dropped with ReceivePaused. Defaults to 256.
+	PauseBufferSize int
+	// Drop the messages of paused peers with ReceivePaused instead of buffering them
+	DropWhilePaused bool
+
+	// Amount of buffered bytes of a data channel at which the callback registered with OnChannelWritable is called,
+	// once more data was buffered before. Zero calls it once the buffer is empty.
+	BufferedAmountLowThreshold uint64
+
+	// Maximum amount of bytes per second sent to each peer. Zero disables throttling.
+	MaxSendRate int
+	// Maximum size in bytes of a received message, both as sent and decompressed, larger ones are dropped. Zero allows any size.
+	MaxMessageSize int
+
+	// Codec used to compress the payloads of sent messages, either CompressionGzip or CompressionZstd. Empty disables compression.
+	// Compressed messages are decompressed regardless of this setting.
+	Compression string
+	// Minimum payload size in bytes from which on payloads are compressed. Defaults to 1024.
+	CompressionThreshold int
+
+	// Maximum duration of a single write to the signaling server. Defaults to config.DefaultWriteTimeout.
+	WriteTimeout time.Duration
+	// Time after which sent offers and answers expire, so that the signaling server and the receiving peer drop them
+	// if they are delivered late. Zero never lets them expire. The clocks of all parties need to be roughly in sync.
+	SignalingTTL time.Duration
+
+	// Clock used for keepalives, handshake durations, handshake and candidate retries, re-established peers and throttling.
+	// Nil uses the real time.
+	Clock clock.Clock
+}
+
+func (c ClientManagerConfig) keepaliveTimeout() time.Duration {
+	if c.KeepaliveTimeout > 0 {
+		return c.KeepaliveTimeout
+	}
+
+	return 3 * c.KeepaliveInterval
+}
+
+func (c ClientManagerConfig) maxConcurrentHandshakes() int {
+	if c.MaxConcurrentHandshakes > 0 {
+		return c.MaxConcurrentHandshakes
+	}
+
+	return 8
+}
+
+func (c ClientManagerConfig) iceServers() []webrtc.ICEServer {
+	// Host candidates are gathered without any servers
+	if !c.wantsCandidateType(webrtc.ICECandidateTypeSrflx) && !c.wantsCandidateType(webrtc.ICECandidateTypeRelay) {
+		return []webrtc.ICEServer{}
+	}
+
+	if c.ICEServers == nil {
+		return DefaultICEServers
+	}
+
+	return c.ICEServers
+}
+
+func (c ClientManagerConfig) iceTransportPolicy() webrtc.ICETransportPolicy {
+	if len(c.CandidateTypes) == 0 {
+		return c.ICETransportPolicy
+	}
+
+	for _, typ := range c.CandidateTypes {
+		if typ != webrtc.ICECandidateTypeRelay {
+			return c.ICETransportPolicy
+		}
+	}
+
+	return webrtc.ICETransportPolicyRelay
+}
+
+// wantsCandidateType reports whether candidates of a type are gathered and sent
+func (c ClientManagerConfig) wantsCandidateType(typ webrtc.ICECandidateType) bool {
+	if c.CandidateTypes == nil {
+		return true
+	}
+
+	for _, wanted := range c.CandidateTypes {
+		if wanted == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c ClientManagerConfig) repeerAttempts() int {
+	if c.RepeerAttempts > 0 {
+		return c.RepeerAttempts
+	}
+
+	return 3
+}
+
+func (c ClientManagerConfig) repeerBackoff() time.Duration {
+	if c.RepeerBackoff > 0 {
+		return c.RepeerBackoff
+	}
+
+	return time.Second
+}
+
+func (c ClientManagerConfig) handshakeRetryBackoff() time.Duration {
+	if c.HandshakeRetryBackoff > 0 {
+		return c.HandshakeRetryBackoff
+	}
+
+	return 100 * time.Millisecond
+}
+
+func (c ClientManagerConfig) pauseBufferSize() int {
+	if c.PauseBufferSize > 0 {
+		return c.PauseBufferSize
+	}
+
+	return 256
+}
+
+func (c ClientManagerConfig) candidateRetries() int {
+	if c.CandidateRetries > 0 {
+		return c.CandidateRetries
+	}
+
+	return 5
+}
+
+func (c ClientManagerConfig) candidateRetryBackoff() time.Duration {
+	if c.CandidateRetryBackoff > 0 {
+		return c.CandidateRetryBackoff
+	}
+
+	return 100 * time.Millisecond
+}
+
+func (c ClientManagerConfig) resumeBufferSize() int {
+	if c.ResumeBufferSize > 0 {
+		return c.ResumeBufferSize
+	}
+
+	return 256
+}
+
+func (c ClientManagerConfig) reorderWindow() int {
+	if c.ReorderWindow > 0 {
+		return c.ReorderWindow
+	}
+
+	return 64
+}
+
+func (c ClientManagerConfig) reorderGapTimeout() time.Duration {
+	if c.ReorderGapTimeout > 0 {
+		return c.ReorderGapTimeout
+	}
+
+	return time.Second
+}
+
+func (c ClientManagerConfig) compressionThreshold() int {
+	if c.CompressionThreshold > 0 {
+		return c.CompressionThreshold
+	}
+
+	return 1024
+}
+
+func (c ClientManagerConfig) dataChannelInit() *webrtc.DataChannelInit {
+	if c.DataChannelProtocol == "" && (!c.negotiated() || c.DataChannelInit.ID != nil) {
+		return c.DataChannelInit
+	}
+
+	channelInit := webrtc.DataChannelInit{}
+	if c.DataChannelInit != nil {
+		channelInit = *c.DataChannelInit
+	}
+
+	if c.negotiated() && channelInit.ID == nil {
+		channelInit.ID = refUint16(0)
+	}
+
+	if c.DataChannelProtocol != "" {
+		protocol := c.DataChannelProtocol
+		channelInit.Protocol = &protocol
+	}
+
+	return &channelInit
+}
+
+func (c ClientManagerConfig) negotiated() bool {
+	return c.DataChannelInit != nil && c.DataChannelInit.Negotiated != nil && *c.DataChannelInit.Negotiated
+}
+
+func (c ClientManagerConfig) clock() clock.Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+
+	return clock.Real{}
+}
+
+func (c ClientManagerConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout > 0 {
+		return c.WriteTimeout
+	}
+
+	return config.DefaultWriteTimeout
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Conn returns a stream of the raw messages exchanged with a peer, e.g. for protocols which bring their own framing.
+// With DetachDataChannels, it is pion's detached data channel, which avoids the callback and allocation per message.
+// Otherwise it is emulated with the callbacks and receives all messages of the peer instead of the message handler once it was created.
+// Each Read returns at most a single message. Without DetachDataChannels, the rest of a message which doesn't fit into p
+// is returned by the next Reads, while detached channels fail with io.ErrShortBuffer and drop it. Both peers should use
+// Conn without keepalives, as SendMessage wraps the messages and keepalives would end up in the stream.
+func (m *ClientManager) Conn(mac string) (io.ReadWriteCloser, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok || p.channel == nil {
+		return nil, errors.New("No data channel to this peer has been opened so far")
+	}
+
+	if p.stream == nil {
+		p.stream = newChannelConn(p.channel)
+	}
+
+	return p.stream, nil
+}
+
+// newPeerConnection creates a peer connection through the shared API if there is one. Otherwise its data channels
+// can be detached if DetachDataChannels is set, gathering through the ICEUDPMux if there is one.
+func (m *ClientManager) newPeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	if m.config.API != nil {
+		return m.config.API.NewPeerConnection(configuration)
+	}
+
+	credentials := m.config.ICEUsernameFragment != "" || m.config.ICEPassword != ""
+
+	if !m.config.DetachDataChannels && m.config.ICEUDPMux == nil && !credentials {
+		return webrtc.NewPeerConnection(configuration)
+	}
+
+	settings := webrtc.SettingEngine{}
+	if m.config.DetachDataChannels {
+		settings.DetachDataChannels()
+	}
+
+	if m.config.ICEUDPMux != nil {
+		settings.SetICEUDPMux(m.config.ICEUDPMux)
+	}
+
+	if credentials {
+		settings.SetICECredentials(m.config.ICEUsernameFragment, m.config.ICEPassword)
+	}
+
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings)).NewPeerConnection(configuration)
+}
+
+// channelConn emulates a detached data channel with the callbacks of a regular one
+type channelConn struct {
+	channel *webrtc.DataChannel
+
+	messages chan []byte
+	closed   chan struct{}
+	once     sync.Once
+
+	// Rest of the message which didn't fit into the buffer of the last Read
+	readLock sync.Mutex
+	unread   []byte
+}
+
+func newChannelConn(channel *webrtc.DataChannel) *channelConn {
+	return &channelConn{
+		channel:  channel,
+		messages: make(chan []byte, 128),
+		closed:   make(chan struct{}),
+	}
+}
+
+// deliver blocks until the message is read, so that a slow reader applies backpressure to the remote
+func (c *channelConn) deliver(data []byte) {
+	select {
+	case c.messages <- data:
+	case <-c.closed:
+	}
+}
+
+func (c *channelConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.unread) == 0 {
+		select {
+		case c.unread = <-c.messages:
+		case <-c.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+
+	return n, nil
+}
+
+func (c *channelConn) Write(p []byte) (int, error) {
+	if err := c.channel.Send(p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *channelConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return c.channel.Close()
+}
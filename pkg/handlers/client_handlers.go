@@ -3,29 +3,105 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/alphahorizonio/libentangle/internal/tap"
+	"github.com/alphahorizonio/libentangle/internal/testhooks"
+	"github.com/alphahorizonio/libentangle/internal/writes"
 	apiDataChannels "github.com/alphahorizonio/libentangle/pkg/api/datachannels/v1"
 	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/google/uuid"
 	"github.com/pion/webrtc/v3"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 type ClientManager struct {
-	lock sync.Mutex
+	lock      sync.Mutex
+	writeLock sync.Mutex
+
+	// Set once Close was called. Sends count themselves in sends while they write to a channel, so that Close only
+	// closes the channels once the sends in flight are done, which closes sendsDone.
+	closed    uint32
+	sendsLock sync.Mutex
+	sends     int
+	sendsDone chan struct{}
 
 	peers       map[string]*peer
-	onConnected func()
+	onConnected func(mac string, channel *webrtc.DataChannel)
+
+	mac     string
+	members map[string][]string
+	roster  map[string][]string
+
+	meshComplete bool
+
+	session  string
+	sessions map[string]*session
+
+	config     ClientManagerConfig
+	handshakes chan struct{}
+	outbound   *tap.Tap
+
+	// Slots of the message handler calls in flight with MaxConcurrentHandlers, nil if they are not limited
+	handlers chan struct{}
+
+	handshakeStarts    map[string]time.Time
+	handshakeDurations []uint64
+
+	// Epoch of the last sent offer and the highest epoch received from each peer, so that stale offers can be ignored
+	epoch       uint64
+	offerEpochs map[string]uint64
 
-	mac string
+	// Callbacks registered with OnChannelWritable, which outlive the channels of the peers
+	writable map[string]func()
+
+	// Channels of the requests waiting for a reply by their correlation ID
+	requests map[string]chan []byte
+
+	// Channels closed once the data channel to a peer opens, for WaitForPeerMac
+	openWaiters map[string][]chan struct{}
+
+	// Attempts to re-establish the failed connection to each peer in a row with RepeerFailed
+	repeers map[string]int
+}
+
+// NewClientManager creates a client, calling onConnected with the mac and channel of every peer whose data channel opens
+func NewClientManager(onConnected func(mac string, channel *webrtc.DataChannel)) *ClientManager {
+	return NewClientManagerWithConfig(onConnected, ClientManagerConfig{})
 }
 
-func NewClientManager(onConnected func()) *ClientManager {
+func NewClientManagerWithConfig(onConnected func(mac string, channel *webrtc.DataChannel), config ClientManagerConfig) *ClientManager {
+	var handlers chan struct{}
+	if config.MaxConcurrentHandlers > 0 {
+		handlers = make(chan struct{}, config.MaxConcurrentHandlers)
+	}
+
 	return &ClientManager{
 		peers:       map[string]*peer{},
 		onConnected: onConnected,
+		session:     uuid.NewString(),
+		sessions:    map[string]*session{},
+		members:     map[string][]string{},
+		roster:      map[string][]string{},
+		config:      config,
+		handshakes:  make(chan struct{}, config.maxConcurrentHandshakes()),
+		handlers:    handlers,
+		outbound:    tap.New(config.OnOutbound),
+
+		handshakeStarts:    map[string]time.Time{},
+		handshakeDurations: make([]uint64, len(config.HandshakeDurationBuckets)+1),
+
+		offerEpochs: map[string]uint64{},
+		writable:    map[string]func(){},
+		requests:    map[string]chan []byte{},
+		repeers:     map[string]int{},
+		openWaiters: map[string][]chan struct{}{},
 	}
 }
 
@@ -33,51 +109,155 @@ type peer struct {
 	connection *webrtc.PeerConnection
 	channel    *webrtc.DataChannel
 	candidates []webrtc.ICECandidateInit
+	lastSeen   time.Time
+	session    string
+
+	communities []string
+
+	nextSend time.Time
+
+	handshaking bool
+
+	// Connection to the signaling server the handshake went through, used to send renegotiation offers
+	signaling  Conn
+	restarting bool
+
+	// Raw stream of the data channel returned by Conn, either the detached channel or a channelConn
+	stream io.ReadWriteCloser
+
+	// Epoch of the last offer sent to this peer, answers to older offers are ignored
+	offerEpoch uint64
+
+	// Held while a message to this peer is numbered and sent, created once the first message is sent
+	sendSlot chan struct{}
+
+	// Amount of messages sent to and reordering of the messages received from this peer with OrderedDelivery
+	ordered uint64
+	reorder *reorderBuffer
+
+	// Messages held back while receiving from this peer is paused
+	pause *pauseState
+
+	counters PeerCounters
+
+	// Value the application associated with this peer through SetPeerContext
+	appContext interface{}
 }
 
-func (m *ClientManager) HandleAcceptance(conn *websocket.Conn, uuid string) error {
+func (m *ClientManager) HandleAcceptance(conn Conn, uuid string, acceptance api.Acceptance) error {
+	m.lock.Lock()
 	m.mac = uuid
+	m.members[acceptance.Community] = acceptance.Members
+	m.roster[acceptance.Community] = append([]string{}, acceptance.Members...)
+	m.lock.Unlock()
+
+	// Peers we are already connected to through another community won't be introduced again
+	for _, mac := range acceptance.Members {
+		m.addCommunity(mac, acceptance.Community)
+	}
+
+	// Joining another community might break or complete the mesh
+	m.checkMesh()
 
-	if err := wsjson.Write(context.Background(), conn, api.NewReady(uuid)); err != nil {
+	if err := m.write(conn, api.NewReady(uuid, acceptance.Community)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *ClientManager) HandleIntroduction(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, f func(msg webrtc.DataChannelMessage), introduction api.Introduction) error {
-	wg.Add(1)
+func (m *ClientManager) Mac() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	peerConnection, err := m.createPeer(introduction.Mac, conn, uuid, f)
-	if err != nil {
-		return err
-	}
+	return m.mac
+}
 
-	if err := m.createDataChannel(introduction.Mac, peerConnection, f); err != nil {
-		return err
+// Members returns the macs of the community members which were present when this client was accepted
+func (m *ClientManager) Members(community string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]string{}, m.members[community]...)
+}
+
+func (m *ClientManager) HandleIntroduction(conn Conn, uuid string, wg *sync.WaitGroup, f func(msg webrtc.DataChannelMessage), introduction api.Introduction) error {
+	m.addMember(introduction.Community, introduction.Mac)
+
+	if introduction.Repeer {
+		m.dropStale(introduction.Mac)
 	}
 
-	offer, err := peerConnection.CreateOffer(nil)
-	if err != nil {
-		return err
+	if m.hasConnection(introduction.Mac) {
+		// We are already connected to this peer through another community
+		m.addCommunity(introduction.Mac, introduction.Community)
+
+		m.checkMesh()
+
+		return nil
 	}
 
-	if err := peerConnection.SetLocalDescription(offer); err != nil {
+	// The mesh is incomplete until the handshake with the new member finishes
+	m.checkMesh()
+
+	if err := m.admitPeer(introduction.Mac); err != nil {
 		return err
 	}
 
-	data, err := json.Marshal(offer)
-	if err != nil {
-		return err
+	m.startHandshake(introduction.Mac)
+
+	return m.queueHandshake(introduction.Mac, wg, func() error {
+		peerConnection, err := m.createPeer(introduction.Mac, conn, uuid, wg, f)
+		if err != nil {
+			return err
+		}
+
+		m.addCommunity(introduction.Mac, introduction.Community)
+
+		if err := m.createDataChannel(introduction.Mac, peerConnection, f); err != nil {
+			return err
+		}
+
+		offer, err := m.describe(introduction.Mac, peerConnection, func() (webrtc.SessionDescription, error) {
+			return peerConnection.CreateOffer(nil)
+		})
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(offer)
+		if err != nil {
+			return err
+		}
+
+		offerMessage := api.NewOffer(data, uuid, introduction.Mac)
+		offerMessage.Community = introduction.Community
+		offerMessage.Epoch = m.offerEpoch(introduction.Mac)
+		m.setTTL(&offerMessage.Message)
+
+		if err := m.write(conn, offerMessage); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (m *ClientManager) HandleOffer(conn Conn, wg *sync.WaitGroup, uuid string, f func(msg webrtc.DataChannelMessage), offer api.Offer) error {
+	// An offer which was sent before a newer one, e.g. before we reconnected, would be answered with a mismatched answer
+	if m.staleOffer(offer) {
+		log.Printf("Ignoring stale offer %v from peer %v\n", offer.Epoch, offer.SenderMac)
+
+		return nil
 	}
 
-	if err := wsjson.Write(context.Background(), conn, api.NewOffer(data, uuid, introduction.Mac)); err != nil {
-		return err
+	// The peer might have given up on the handshake while the offer was delayed
+	if offer.Expired(m.config.clock().Now()) {
+		log.Printf("Ignoring expired offer from peer %v\n", offer.SenderMac)
+
+		return nil
 	}
-	return nil
-}
 
-func (m *ClientManager) HandleOffer(conn *websocket.Conn, wg *sync.WaitGroup, uuid string, f func(msg webrtc.DataChannelMessage), offer api.Offer) error {
-	wg.Add(1)
+	// Members which joined while we were getting ready are not introduced to us, but offer to us instead
+	m.addMember(offer.Community, offer.SenderMac)
 
 	var offer_val webrtc.SessionDescription
 
@@ -85,201 +265,1624 @@ func (m *ClientManager) HandleOffer(conn *websocket.Conn, wg *sync.WaitGroup, uu
 		return err
 	}
 
-	peerConnection, err := m.createPeer(offer.SenderMac, conn, uuid, f)
-	if err != nil {
+	if err := m.admitPeer(offer.SenderMac); err != nil {
 		return err
 	}
 
-	if err := peerConnection.SetRemoteDescription(offer_val); err != nil {
-		return err
+	m.startHandshake(offer.SenderMac)
+
+	return m.queueHandshake(offer.SenderMac, wg, func() error {
+		peerConnection := m.reusableConnection(offer.SenderMac)
+		reused := peerConnection != nil
+
+		if !reused {
+			var err error
+			peerConnection, err = m.createPeer(offer.SenderMac, conn, uuid, wg, f)
+			if err != nil {
+				return err
+			}
+		}
+
+		m.addCommunity(offer.SenderMac, offer.Community)
+
+		// A negotiated channel is not announced by the remote, so we have to create our end of it ourselves
+		if !reused && m.config.negotiated() {
+			if err := m.createDataChannel(offer.SenderMac, peerConnection, f); err != nil {
+				return err
+			}
+		}
+
+		if err := peerConnection.SetRemoteDescription(offer_val); err != nil {
+			return err
+		}
+
+		if err := m.addPendingCandidates(offer.SenderMac, peerConnection); err != nil {
+			return err
+		}
+
+		answer_val, err := m.describe(offer.SenderMac, peerConnection, func() (webrtc.SessionDescription, error) {
+			return peerConnection.CreateAnswer(nil)
+		})
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(answer_val)
+		if err != nil {
+			return err
+		}
+
+		answer := api.NewAnswer(data, offer.ReceiverMac, offer.SenderMac)
+		answer.Epoch = offer.Epoch
+		m.setTTL(&answer.Message)
+
+		if err := m.write(conn, answer); err != nil {
+			return err
+		}
+
+		// The data channel of a renegotiated connection stays open, so it won't complete the handshake
+		if reused {
+			m.settleHandshake(offer.SenderMac)
+		}
+
+		wg.Done()
+		return nil
+	})
+}
+
+// describe creates an offer or answer and sets it as local description, retrying with backoff if either fails.
+// Nothing is sent before it succeeded, so a retry can't lead to a second offer or answer.
+func (m *ClientManager) describe(mac string, peerConnection *webrtc.PeerConnection, create func() (webrtc.SessionDescription, error)) (webrtc.SessionDescription, error) {
+	backoff := m.config.handshakeRetryBackoff()
+
+	for attempt := 0; ; attempt++ {
+		description, err := create()
+		if err == nil {
+			if munge := testhooks.MungeDescription(); munge != nil {
+				description = munge(mac, description)
+			}
+
+			if err = peerConnection.SetLocalDescription(description); err == nil {
+				return description, nil
+			}
+		}
+
+		// The peer might have been removed in the meantime
+		if attempt >= m.config.HandshakeRetries || peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return webrtc.SessionDescription{}, err
+		}
+
+		log.Printf("Could not create description for peer %v, retrying: %v\n", mac, err)
+
+		<-m.config.clock().After(backoff)
+
+		backoff *= 2
 	}
+}
 
-	answer_val, err := peerConnection.CreateAnswer(nil)
-	if err != nil {
-		return err
+func (m *ClientManager) HandleAnswer(wg *sync.WaitGroup, answer api.Answer) error {
+	if answer.Expired(m.config.clock().Now()) {
+		log.Printf("Ignoring expired answer from peer %v\n", answer.SenderMac)
+
+		// No other answer to the offer will arrive, so the handshake is over
+		if !m.endRestart(answer.SenderMac) {
+			wg.Done()
+		}
+		return nil
 	}
 
-	err = peerConnection.SetLocalDescription(answer_val)
+	peerConnection, err := m.getPeerConnection(answer.SenderMac)
 	if err != nil {
 		return err
 	}
 
-	data, err := json.Marshal(answer_val)
-	if err != nil {
-		return err
+	// The handshake completes with the answer to the latest offer
+	if m.staleAnswer(answer) {
+		log.Printf("Ignoring stale answer %v from peer %v\n", answer.Epoch, answer.SenderMac)
+
+		// The handshake of the stale offer was superseded, the answer to a restart is still to come though
+		if !m.restarting(answer.SenderMac) {
+			wg.Done()
+		}
+		return nil
 	}
 
-	if err := wsjson.Write(context.Background(), conn, api.NewAnswer(data, offer.ReceiverMac, offer.SenderMac)); err != nil {
+	restarting := m.endRestart(answer.SenderMac)
+
+	if err := m.handleAnswer(peerConnection, answer); err != nil {
+		// Don't leave the peer behind half-connected, so that it can be introduced again
+		m.abortHandshake(answer.SenderMac)
+
+		if !restarting {
+			wg.Done()
+		}
 		return err
 	}
 
-	wg.Done()
+	if !restarting {
+		wg.Done()
+	}
 	return nil
 }
 
-func (m *ClientManager) HandleAnswer(wg *sync.WaitGroup, answer api.Answer) error {
-	var answer_val webrtc.SessionDescription
+// RestartICE renegotiates the connection to a peer with fresh ICE credentials, e.g. after the network changed.
+// The peer has to use ReuseConnections, as it would replace the connection otherwise.
+func (m *ClientManager) RestartICE(mac string) error {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if !ok || p.connection == nil || p.signaling == nil {
+		m.lock.Unlock()
 
-	if err := json.Unmarshal([]byte(answer.Payload), &answer_val); err != nil {
-		return err
+		return errors.New("No connection to this peer has been created so far")
 	}
+	peerConnection, conn := p.connection, p.signaling
+	p.restarting = true
+	m.lock.Unlock()
 
-	peerConnection, err := m.getPeerConnection(answer.SenderMac)
+	offer, err := m.describe(mac, peerConnection, func() (webrtc.SessionDescription, error) {
+		return peerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	})
 	if err != nil {
 		return err
 	}
 
-	if err := peerConnection.SetRemoteDescription(answer_val); err != nil {
+	data, err := json.Marshal(offer)
+	if err != nil {
 		return err
 	}
 
-	if len(m.peers[answer.SenderMac].candidates) > 0 {
-		for _, candidate := range m.peers[answer.SenderMac].candidates {
-			if err := peerConnection.AddICECandidate(candidate); err != nil {
-				return err
-			}
-		}
+	offerMessage := api.NewOffer(data, m.Mac(), mac)
+	offerMessage.Epoch = m.offerEpoch(mac)
+	m.setTTL(&offerMessage.Message)
 
-		m.peers[answer.SenderMac].candidates = []webrtc.ICECandidateInit{}
-	}
+	return m.write(conn, offerMessage)
+}
 
-	wg.Done()
-	return nil
+// setTTL lets an offer or answer expire after the SignalingTTL
+func (m *ClientManager) setTTL(msg *api.Message) {
+	if m.config.SignalingTTL > 0 {
+		msg.SetTTL(m.config.clock().Now(), m.config.SignalingTTL)
+	}
 }
 
-func (m *ClientManager) HandleCandidate(candidate api.Candidate) error {
+// offerEpoch returns the epoch of a new offer to a peer. Epochs start at the current time, so that they
+// keep increasing if the process restarts.
+func (m *ClientManager) offerEpoch(mac string) uint64 {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	peerConnection, err := m.getPeerConnection(candidate.SenderMac)
-	if err != nil {
-		return err
+	epoch := uint64(m.config.clock().Now().UnixNano())
+	if epoch <= m.epoch {
+		epoch = m.epoch + 1
 	}
+	m.epoch = epoch
 
-	if peerConnection.RemoteDescription() != nil {
-		if err := peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: string(candidate.Payload)}); err != nil {
-			return err
-		}
+	if p, ok := m.peers[mac]; ok {
+		p.offerEpoch = epoch
 	}
 
-	m.peers[candidate.SenderMac].candidates = append(m.peers[candidate.SenderMac].candidates, webrtc.ICECandidateInit{Candidate: string(candidate.Payload)})
-
-	return nil
+	return epoch
 }
 
-func (m *ClientManager) HandleResignation() error {
-	return nil
-}
+// staleOffer reports whether a newer offer of the same peer has already been handled, remembering the epoch otherwise
+func (m *ClientManager) staleOffer(offer api.Offer) bool {
+	if offer.Epoch == 0 {
+		return false
+	}
 
-func (m *ClientManager) createPeer(mac string, conn *websocket.Conn, uuid string, f func(msg webrtc.DataChannelMessage)) (*webrtc.PeerConnection, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
-	if err != nil {
-		return nil, err
+	if offer.Epoch <= m.offerEpochs[offer.SenderMac] {
+		return true
 	}
+	m.offerEpochs[offer.SenderMac] = offer.Epoch
 
-	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		log.Printf("Peer Connection State has changed: %s\n", s.String())
-	})
+	return false
+}
 
-	m.peers[mac] = &peer{
-		connection: peerConnection,
-		candidates: []webrtc.ICECandidateInit{},
-	}
+// endRestart reports whether the answer of a peer is the one to RestartICE, which does not belong to a handshake
+// started through the signaling client and thus doesn't hold the WaitGroup
+func (m *ClientManager) endRestart(mac string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-		if i == nil {
-			return
-		} else {
-			m.lock.Lock()
-			defer func() {
-				m.lock.Unlock()
-			}()
-
-			if err := wsjson.Write(context.Background(), conn, api.NewCandidate([]byte(i.ToJSON().Candidate), uuid, mac)); err != nil {
-				panic(err)
-			}
-		}
-	})
+	p, ok := m.peers[mac]
+	if !ok || !p.restarting {
+		return false
+	}
+	p.restarting = false
 
-	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
-		dc.OnOpen(func() {
-			log.Println("sendChannel has opened")
+	return true
+}
 
-			m.peers[mac].channel = dc
+// restarting reports whether RestartICE is waiting for the answer of a peer
+func (m *ClientManager) restarting(mac string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-			m.onConnected()
-		})
-		dc.OnClose(func() {
-			log.Println("sendChannel has closed")
-		})
-		dc.OnMessage(f)
-	})
+	p, ok := m.peers[mac]
 
-	return peerConnection, nil
+	return ok && p.restarting
 }
 
-func (m *ClientManager) createDataChannel(mac string, peerConnection *webrtc.PeerConnection, f func(msg webrtc.DataChannelMessage)) error {
-	dc, err := peerConnection.CreateDataChannel("foo", nil)
-	if err != nil {
-		return err
+func (m *ClientManager) staleAnswer(answer api.Answer) bool {
+	if answer.Epoch == 0 {
+		return false
 	}
-	dc.OnOpen(func() {
-		log.Println("sendChannel has opened")
 
-		m.peers[mac].channel = dc
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-		m.onConnected()
-	})
-	dc.OnClose(func() {
-		log.Println("sendChannel has closed")
-	})
-	dc.OnMessage(f)
+	p, ok := m.peers[answer.SenderMac]
 
-	return nil
+	return ok && p.offerEpoch != 0 && answer.Epoch != p.offerEpoch
 }
 
-func (m *ClientManager) getPeerConnection(mac string) (*webrtc.PeerConnection, error) {
-	return m.peers[mac].connection, nil
+// reusableConnection returns the connection to a peer if it can be renegotiated instead of being replaced
+func (m *ClientManager) reusableConnection(mac string) *webrtc.PeerConnection {
+	if !m.config.ReuseConnections {
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok || p.connection == nil || p.connection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return nil
+	}
+
+	return p.connection
 }
 
-func (m *ClientManager) SendMessage(msg []byte) error {
-	wrappedMsg, err := json.Marshal(apiDataChannels.WrappedMessage{Mac: m.mac, Payload: msg})
-	if err != nil {
+func (m *ClientManager) handleAnswer(peerConnection *webrtc.PeerConnection, answer api.Answer) error {
+	var answer_val webrtc.SessionDescription
+
+	if err := json.Unmarshal([]byte(answer.Payload), &answer_val); err != nil {
+		return err
+	}
+
+	if err := peerConnection.SetRemoteDescription(answer_val); err != nil {
 		return err
 	}
 
-	for key := range m.peers {
-		if key != m.mac {
-			if err := m.peers[key].channel.Send(wrappedMsg); err != nil {
-				return nil
-			} else {
+	return m.addPendingCandidates(answer.SenderMac, peerConnection)
+}
+
+func (m *ClientManager) HandleCandidate(candidate api.Candidate) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[candidate.SenderMac]
+	if !ok {
+		return errors.New("Received a candidate from an unknown peer")
+	}
+
+	for _, payload := range candidate.Payloads() {
+		// The handshake with this peer might still be queued or waiting for its remote description
+		if p.connection != nil && p.connection.RemoteDescription() != nil {
+			if err := p.connection.AddICECandidate(webrtc.ICECandidateInit{Candidate: string(payload)}); err != nil {
 				return err
 			}
+
+			continue
 		}
+
+		p.candidates = append(p.candidates, webrtc.ICECandidateInit{Candidate: string(payload)})
 	}
+
 	return nil
 }
 
-func (m *ClientManager) SendMessageUnicast(msg []byte, mac string) error {
-	wrappedMsg, err := json.Marshal(apiDataChannels.WrappedMessage{Mac: m.mac, Payload: msg})
-	if err != nil {
-		return err
-	}
+func (m *ClientManager) HandleResignation(resignation api.Resignation) error {
+	m.lock.Lock()
+	for community, macs := range m.roster {
+		if resignation.Community != "" && community != resignation.Community {
+			continue
+		}
 
-	if err := m.peers[mac].channel.Send(wrappedMsg); err != nil {
-		return nil
-	} else {
-		return err
+		remaining := []string{}
+		for _, mac := range macs {
+			if mac != resignation.Mac {
+				remaining = append(remaining, mac)
+			}
+		}
+		m.roster[community] = remaining
 	}
+	m.lock.Unlock()
+
+	m.checkMesh()
+
+	return nil
+}
+
+func (m *ClientManager) addMember(community string, mac string) {
+	if community == "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, member := range m.roster[community] {
+		if member == mac {
+			return
+		}
+	}
+
+	m.roster[community] = append(m.roster[community], mac)
+}
+
+// checkMesh calls OnMeshComplete if all known members have an open data channel, unless it was called since the mesh last broke
+func (m *ClientManager) checkMesh() {
+	m.lock.Lock()
+	expected := 0
+	complete := true
+	for _, macs := range m.roster {
+		for _, mac := range macs {
+			if mac == m.mac {
+				continue
+			}
+
+			expected++
+
+			p, ok := m.peers[mac]
+			if !ok || p.channel == nil || p.channel.ReadyState() != webrtc.DataChannelStateOpen {
+				complete = false
+			}
+		}
+	}
+
+	// A peer which is alone in its communities has no mesh to complete
+	complete = complete && expected > 0
+
+	fire := complete && !m.meshComplete
+	m.meshComplete = complete
+	m.lock.Unlock()
+
+	if fire && m.config.OnMeshComplete != nil {
+		m.config.OnMeshComplete()
+	}
+}
+
+func (m *ClientManager) hasConnection(mac string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+
+	return ok && p.connection != nil
+}
+
+// HandleLeave closes the connections to all peers which are not part of another community than the one being left
+func (m *ClientManager) HandleLeave(community string) error {
+	m.lock.Lock()
+	delete(m.members, community)
+	delete(m.roster, community)
+
+	macs := []string{}
+	for mac, p := range m.peers {
+		remaining := []string{}
+		for _, c := range p.communities {
+			if c != community {
+				remaining = append(remaining, c)
+			}
+		}
+		p.communities = remaining
+
+		if len(remaining) == 0 {
+			macs = append(macs, mac)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, mac := range macs {
+		m.removePeer(mac)
+	}
+
+	m.checkMesh()
+
+	return nil
+}
+
+func (m *ClientManager) addCommunity(mac string, community string) {
+	if community == "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		return
+	}
+
+	for _, c := range p.communities {
+		if c == community {
+			return
+		}
+	}
+
+	p.communities = append(p.communities, community)
+}
+
+func (m *ClientManager) createPeer(mac string, conn Conn, uuid string, wg *sync.WaitGroup, f func(msg webrtc.DataChannelMessage)) (*webrtc.PeerConnection, error) {
+	// Lookups can take a while, so they are done before taking the lock
+	iceServers := m.resolveICEServers()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Queued handshakes are only admitted once they run
+	if m.peerLimitReached(mac) {
+		return nil, &TooManyPeers{m.config.MaxPeers}
+	}
+
+	peerConnection, err := m.newPeerConnection(webrtc.Configuration{
+		ICEServers:         iceServers,
+		ICETransportPolicy: m.config.iceTransportPolicy(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections which are closed before they were established, e.g. cancelled handshakes, are not re-established
+	var established uint32
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		log.Printf("Peer Connection State has changed: %s\n", s.String())
+
+		if s == webrtc.PeerConnectionStateConnected {
+			atomic.StoreUint32(&established, 1)
+		}
+
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			m.releaseHandshakeOf(mac, peerConnection)
+		}
+
+		if m.config.RepeerFailed && (s == webrtc.PeerConnectionStateFailed || (s == webrtc.PeerConnectionStateClosed && atomic.LoadUint32(&established) == 1)) {
+			go m.repeer(mac, peerConnection, conn, wg, f)
+		}
+	})
+
+	peerConnection.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		if m.config.OnICEStateChange != nil {
+			m.config.OnICEStateChange(mac, s)
+		}
+	})
+
+	if m.config.OnSelectedCandidatePairChange != nil {
+		peerConnection.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+			m.config.OnSelectedCandidatePairChange(mac, *pair)
+		})
+	}
+
+	if p, ok := m.peers[mac]; ok && p.connection == nil {
+		p.connection = peerConnection
+		p.signaling = conn
+	} else {
+		replacement := &peer{
+			connection: peerConnection,
+			signaling:  conn,
+			candidates: []webrtc.ICECandidateInit{},
+		}
+
+		// The context belongs to the peer rather than to the connection which is replaced, and the handshake slot
+		// reserved for the new connection has to be released once it opens
+		if p, ok := m.peers[mac]; ok {
+			replacement.appContext = p.appContext
+			replacement.handshaking = p.handshaking
+		}
+
+		m.peers[mac] = replacement
+	}
+
+	// Capped candidates are collected until gathering is complete, so that the least useful ones can be dropped
+	var gatheredLock sync.Mutex
+	gathered := []webrtc.ICECandidate{}
+	var batch candidateBatch
+	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i != nil && !m.config.wantsCandidateType(i.Typ) {
+			return
+		}
+
+		if i != nil && m.config.CandidateFilter != nil && !m.config.CandidateFilter(*i) {
+			return
+		}
+
+		if m.config.MaxCandidates <= 0 && m.config.CandidateBatchInterval <= 0 {
+			if i != nil {
+				m.sendCandidates(conn, uuid, mac, *i)
+			}
+
+			return
+		}
+
+		if m.config.MaxCandidates <= 0 {
+			// No more candidates are worth waiting for once gathering is complete
+			if i == nil {
+				m.sendCandidates(conn, uuid, mac, batch.take()...)
+
+				return
+			}
+
+			if batch.add(*i) {
+				go func() {
+					<-m.config.clock().After(m.config.CandidateBatchInterval)
+
+					m.sendCandidates(conn, uuid, mac, batch.take()...)
+				}()
+			}
+
+			return
+		}
+
+		gatheredLock.Lock()
+		if i != nil {
+			gathered = append(gathered, *i)
+			gatheredLock.Unlock()
+
+			return
+		}
+
+		// Gathering starts over after an ICE restart
+		selected := selectCandidates(gathered, m.config.MaxCandidates)
+		gathered = []webrtc.ICECandidate{}
+		gatheredLock.Unlock()
+
+		if m.config.CandidateBatchInterval > 0 {
+			m.sendCandidates(conn, uuid, mac, selected...)
+
+			return
+		}
+
+		for _, candidate := range selected {
+			m.sendCandidates(conn, uuid, mac, candidate)
+		}
+	})
+
+	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		// The peer speaks another version of the application protocol
+		if m.config.DataChannelProtocol != "" && dc.Protocol() != m.config.DataChannelProtocol {
+			m.reportError(mac, PhaseDataChannel, &ProtocolMismatch{dc.Protocol(), m.config.DataChannelProtocol})
+
+			go m.removePeer(mac)
+
+			return
+		}
+
+		dc.OnOpen(func() {
+			log.Println("sendChannel has opened")
+
+			m.openChannel(mac, dc)
+		})
+		dc.OnClose(func() {
+			log.Println("sendChannel has closed")
+		})
+		dc.OnError(func(err error) {
+			m.reportError(mac, PhaseDataChannel, err)
+		})
+		dc.OnMessage(m.handleMessage(mac, dc, f))
+	})
+
+	return peerConnection, nil
+}
+
+// admitPeer refuses a handshake with a new peer if the configured maximum of peers is reached
+func (m *ClientManager) admitPeer(mac string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.peerLimitReached(mac) {
+		return &TooManyPeers{m.config.MaxPeers}
+	}
+
+	return nil
+}
+
+// peerLimitReached counts the peer connections besides the one to mac. The lock has to be held.
+func (m *ClientManager) peerLimitReached(mac string) bool {
+	if m.config.MaxPeers <= 0 {
+		return false
+	}
+
+	peers := 0
+	for other, p := range m.peers {
+		if other != mac && p.connection != nil {
+			peers++
+		}
+	}
+
+	return peers >= m.config.MaxPeers
+}
+
+func (m *ClientManager) createDataChannel(mac string, peerConnection *webrtc.PeerConnection, f func(msg webrtc.DataChannelMessage)) error {
+	dc, err := peerConnection.CreateDataChannel("foo", m.config.dataChannelInit())
+	if err != nil {
+		return err
+	}
+	dc.OnOpen(func() {
+		log.Println("sendChannel has opened")
+
+		m.openChannel(mac, dc)
+	})
+	dc.OnClose(func() {
+		log.Println("sendChannel has closed")
+	})
+	dc.OnError(func(err error) {
+		m.reportError(mac, PhaseDataChannel, err)
+	})
+	dc.OnMessage(m.handleMessage(mac, dc, f))
+
+	return nil
+}
+
+func (m *ClientManager) openChannel(mac string, dc *webrtc.DataChannel) {
+	// A detached channel can only be read through Conn, so our control messages would end up in its stream
+	var detached io.ReadWriteCloser
+	if m.config.DetachDataChannels {
+		var err error
+		detached, err = dc.Detach()
+		if err != nil {
+			m.reportError(mac, PhaseDataChannel, err)
+		}
+	}
+
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if ok {
+		p.channel = dc
+		p.lastSeen = m.config.clock().Now()
+		p.stream = detached
+
+		for _, waiter := range m.openWaiters[mac] {
+			close(waiter)
+		}
+		delete(m.openWaiters, mac)
+
+		delete(m.repeers, mac)
+	}
+	writable := m.writable[mac]
+	m.lock.Unlock()
+
+	dc.SetBufferedAmountLowThreshold(m.config.BufferedAmountLowThreshold)
+	if writable != nil {
+		dc.OnBufferedAmountLow(writable)
+	}
+
+	if !ok {
+		return
+	}
+
+	m.releaseHandshake(mac)
+
+	m.completeHandshake(mac)
+
+	if m.config.SessionResumption && detached == nil {
+		m.announceSession(dc)
+	}
+
+	if detached == nil {
+		go m.keepalive(mac, dc)
+	}
+
+	m.onConnected(mac, dc)
+
+	m.checkMesh()
+}
+
+func (m *ClientManager) handleMessage(mac string, dc *webrtc.DataChannel, f func(msg webrtc.DataChannelMessage)) func(msg webrtc.DataChannelMessage) {
+	f = m.limitHandler(f)
+
+	deliver := func(msg webrtc.DataChannelMessage) {
+		m.deliverUnlessPaused(mac, msg, f)
+	}
+
+	return func(msg webrtc.DataChannelMessage) {
+		if !m.checkMessageSize(mac, len(msg.Data)) {
+			return
+		}
+
+		m.lock.Lock()
+		var stream *channelConn
+		if p, ok := m.peers[mac]; ok {
+			p.lastSeen = m.config.clock().Now()
+
+			stream, _ = p.stream.(*channelConn)
+		}
+		m.lock.Unlock()
+
+		if stream != nil {
+			stream.deliver(msg.Data)
+
+			return
+		}
+
+		var w apiDataChannels.WrappedMessage
+		if err := json.Unmarshal(msg.Data, &w); err != nil {
+			deliver(msg)
+
+			return
+		}
+
+		if w.Opcode == apiDataChannels.OpcodeKeepalive {
+			return
+		}
+
+		// The sender might have been evicted while its messages were in flight
+		if !m.knownSender(w.Mac) {
+			m.dropMessage(mac, &UnknownSender{w.Mac})
+
+			return
+		}
+
+		if m.config.SessionResumption && !m.handleSession(mac, dc, w) {
+			return
+		}
+
+		m.countReceived(mac, len(msg.Data))
+
+		if w.Compression != "" {
+			if err := decompress(&w); err != nil {
+				log.Printf("Could not decompress message from peer %v: %v\n", mac, err)
+
+				return
+			}
+
+			// A small message can decompress to a huge payload
+			if !m.checkMessageSize(mac, len(w.Payload)) {
+				return
+			}
+
+			data, err := json.Marshal(w)
+			if err != nil {
+				return
+			}
+
+			msg.Data = data
+		}
+
+		if w.Reply {
+			m.resolveRequest(w.Correlation, w.Payload)
+
+			return
+		}
+
+		m.deliverInOrder(mac, w.Order, msg, deliver)
+	}
+}
+
+// limitHandler waits for a free slot before each call of a message handler if their concurrency is limited. Messages
+// of the same peer keep their order, as pion delivers them one after another.
+func (m *ClientManager) limitHandler(f func(msg webrtc.DataChannelMessage)) func(msg webrtc.DataChannelMessage) {
+	if m.handlers == nil {
+		return f
+	}
+
+	return func(msg webrtc.DataChannelMessage) {
+		m.handlers <- struct{}{}
+		defer func() {
+			<-m.handlers
+		}()
+
+		f(msg)
+	}
+}
+
+// checkMessageSize reports whether a received message is small enough to be delivered
+func (m *ClientManager) checkMessageSize(mac string, size int) bool {
+	if m.config.MaxMessageSize <= 0 || size <= m.config.MaxMessageSize {
+		return true
+	}
+
+	m.dropMessage(mac, &MessageTooLarge{size, m.config.MaxMessageSize})
+
+	return false
+}
+
+// knownSender reports whether a message was sent by a peer we are connected to
+func (m *ClientManager) knownSender(mac string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.peers[mac]
+
+	return ok
+}
+
+func (m *ClientManager) dropMessage(mac string, err error) {
+	if m.config.OnMessageDropped != nil {
+		m.config.OnMessageDropped(mac, err)
+	} else {
+		log.Printf("Could not deliver message from peer %v: %v\n", mac, err)
+	}
+}
+
+// reportError passes an error which occurred in the background to OnError
+func (m *ClientManager) reportError(mac string, phase string, err error) {
+	peerErr := &PeerError{mac, phase, err}
+
+	if m.config.OnError != nil {
+		m.config.OnError(peerErr)
+	} else {
+		log.Println(peerErr)
+	}
+}
+
+func (m *ClientManager) keepalive(mac string, dc *webrtc.DataChannel) {
+	if m.config.KeepaliveInterval <= 0 {
+		return
+	}
+
+	keepalive, err := json.Marshal(apiDataChannels.WrappedMessage{Mac: m.Mac(), Opcode: apiDataChannels.OpcodeKeepalive})
+	if err != nil {
+		return
+	}
+
+	timer := m.config.clock().NewTimer(m.config.KeepaliveInterval)
+	defer timer.Stop()
+
+	for range timer.C() {
+		m.lock.Lock()
+		p, ok := m.peers[mac]
+		if !ok || p.channel != dc {
+			m.lock.Unlock()
+
+			return
+		}
+		lastSeen := p.lastSeen
+		m.lock.Unlock()
+
+		if m.config.clock().Now().Sub(lastSeen) > m.config.keepaliveTimeout() {
+			log.Printf("Peer %v timed out, evicting it\n", mac)
+
+			m.removePeer(mac)
+
+			return
+		}
+
+		if err := dc.Send(keepalive); err != nil {
+			m.reportError(mac, PhaseKeepalive, err)
+		}
+
+		timer.Reset(m.config.KeepaliveInterval)
+	}
+}
+
+func (m *ClientManager) removePeer(mac string) {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if ok && p.handshaking {
+		p.handshaking = false
+
+		<-m.handshakes
+	}
+	delete(m.peers, mac)
+	delete(m.handshakeStarts, mac)
+	m.lock.Unlock()
+
+	if !ok || p.connection == nil {
+		return
+	}
+
+	if err := p.connection.Close(); err != nil {
+		m.reportError(mac, PhaseDisconnect, err)
+	}
+
+	if m.config.OnDisconnected != nil {
+		m.config.OnDisconnected(mac)
+	}
+
+	m.checkMesh()
+}
+
+// Disconnect closes the data channel and connection to a single peer, e.g. to drop a misbehaving one, and calls OnDisconnected.
+// The other peers and the signaling connection are not affected.
+func (m *ClientManager) Disconnect(mac string) error {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	var channel *webrtc.DataChannel
+	if ok {
+		channel = p.channel
+	}
+	m.lock.Unlock()
+
+	if !ok {
+		return errors.New("Not connected to this peer")
+	}
+
+	if channel != nil {
+		if err := channel.Close(); err != nil {
+			m.reportError(mac, PhaseDisconnect, err)
+		}
+	}
+
+	m.removePeer(mac)
+
+	return nil
+}
+
+// Close closes the connections to all peers, including the ones whose handshake is still in progress.
+// Sends fail with ErrClosed from now on.
+func (m *ClientManager) Close() error {
+	m.sendsLock.Lock()
+	atomic.StoreUint32(&m.closed, 1)
+
+	if m.sends > 0 && m.sendsDone == nil {
+		m.sendsDone = make(chan struct{})
+	}
+	done := m.sendsDone
+	m.sendsLock.Unlock()
+
+	// Wait for the sends in flight
+	if done != nil {
+		<-done
+	}
+
+	m.lock.Lock()
+	macs := []string{}
+	for mac := range m.peers {
+		macs = append(macs, mac)
+	}
+	m.lock.Unlock()
+
+	for _, mac := range macs {
+		m.removePeer(mac)
+	}
+
+	return nil
+}
+
+// beginSend counts a send in flight, which Close waits for, unless Close has begun
+func (m *ClientManager) beginSend() error {
+	m.sendsLock.Lock()
+	defer m.sendsLock.Unlock()
+
+	if atomic.LoadUint32(&m.closed) == 1 {
+		return ErrClosed
+	}
+	m.sends++
+
+	return nil
+}
+
+func (m *ClientManager) endSend() {
+	m.sendsLock.Lock()
+	defer m.sendsLock.Unlock()
+
+	m.sends--
+	if m.sends == 0 && m.sendsDone != nil {
+		close(m.sendsDone)
+		m.sendsDone = nil
+	}
+}
+
+// CancelHandshake aborts the handshake with a peer whose data channel has not opened so far, freeing its handshake slot
+func (m *ClientManager) CancelHandshake(mac string) error {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if !ok {
+		m.lock.Unlock()
+
+		return errors.New("No handshake with this peer is in progress")
+	}
+
+	if p.channel != nil {
+		m.lock.Unlock()
+
+		return errors.New("The handshake with this peer has already completed")
+	}
+
+	if p.handshaking {
+		p.handshaking = false
+
+		<-m.handshakes
+	}
+	delete(m.peers, mac)
+	delete(m.handshakeStarts, mac)
+	m.lock.Unlock()
+
+	if p.connection != nil {
+		if err := p.connection.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *ClientManager) startHandshake(mac string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.handshakeStarts[mac] = m.config.clock().Now()
+}
+
+// completeHandshake records how long the handshake with a peer took, including the time it was queued
+func (m *ClientManager) completeHandshake(mac string) {
+	m.lock.Lock()
+	start, ok := m.handshakeStarts[mac]
+	if !ok {
+		m.lock.Unlock()
+
+		return
+	}
+	delete(m.handshakeStarts, mac)
+
+	duration := m.config.clock().Now().Sub(start)
+
+	bucket := len(m.config.HandshakeDurationBuckets)
+	for i, bound := range m.config.HandshakeDurationBuckets {
+		if duration <= bound {
+			bucket = i
+
+			break
+		}
+	}
+	m.handshakeDurations[bucket]++
+	m.lock.Unlock()
+
+	if m.config.OnHandshakeComplete != nil {
+		m.config.OnHandshakeComplete(mac, duration)
+	}
+}
+
+// HandshakeDurations returns the amount of completed handshakes per bucket of HandshakeDurationBuckets. The last
+// count is of the handshakes which took longer than the largest bucket.
+func (m *ClientManager) HandshakeDurations() []uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]uint64{}, m.handshakeDurations...)
+}
+
+// queueHandshake runs the handshake with a peer once a handshake slot is free. The WaitGroup is incremented for the
+// handshake and decremented if it fails.
+func (m *ClientManager) queueHandshake(mac string, wg *sync.WaitGroup, handshake func() error) error {
+	wg.Add(1)
+
+	run := func(reserve bool) error {
+		if reserve {
+			m.reserveHandshake(mac)
+		}
+
+		if err := handshake(); err != nil {
+			m.abortHandshake(mac)
+
+			wg.Done()
+			return err
+		}
+
+		return nil
+	}
+
+	// A peer which holds a slot already, e.g. because it offers again, doesn't take a second one
+	m.lock.Lock()
+	p, holding := m.peers[mac]
+	holding = holding && p.handshaking
+	m.lock.Unlock()
+
+	if holding {
+		return run(false)
+	}
+
+	select {
+	case m.handshakes <- struct{}{}:
+		return run(true)
+	default:
+	}
+
+	// Register the peer right away so that its candidates are buffered while the handshake is queued
+	m.lock.Lock()
+	if _, ok := m.peers[mac]; !ok {
+		m.peers[mac] = &peer{
+			candidates: []webrtc.ICECandidateInit{},
+		}
+	}
+	m.lock.Unlock()
+
+	go func() {
+		m.handshakes <- struct{}{}
+
+		// The handshake might have been cancelled while it was queued
+		m.lock.Lock()
+		_, ok := m.peers[mac]
+		m.lock.Unlock()
+
+		if !ok {
+			<-m.handshakes
+
+			wg.Done()
+			return
+		}
+
+		if err := run(true); err != nil {
+			m.reportError(mac, PhaseHandshake, err)
+		}
+	}()
+
+	return nil
+}
+
+// abortHandshake removes a peer whose handshake failed, unless its data channel opened in the meantime
+func (m *ClientManager) abortHandshake(mac string) {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	opened := ok && p.channel != nil
+	m.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if opened {
+		m.settleHandshake(mac)
+
+		return
+	}
+
+	if err := m.CancelHandshake(mac); err != nil {
+		m.reportError(mac, PhaseHandshake, err)
+	}
+}
+
+// settleHandshake frees the handshake slot of a peer whose data channel is already open
+func (m *ClientManager) settleHandshake(mac string) {
+	m.releaseHandshake(mac)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.handshakeStarts, mac)
+}
+
+func (m *ClientManager) reserveHandshake(mac string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		p = &peer{
+			candidates: []webrtc.ICECandidateInit{},
+		}
+
+		m.peers[mac] = p
+	}
+
+	// The peer took a slot while this handshake waited for one, so the slot it waited for is given back
+	if p.handshaking {
+		<-m.handshakes
+
+		return
+	}
+
+	p.handshaking = true
+}
+
+func (m *ClientManager) releaseHandshake(mac string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.peers[mac]; ok && p.handshaking {
+		p.handshaking = false
+
+		<-m.handshakes
+	}
+}
+
+// releaseHandshakeOf only releases the handshake slot of a peer if it belongs to the given connection, so that a replaced
+// connection which fails or closes late doesn't release the slot of the handshake replacing it
+func (m *ClientManager) releaseHandshakeOf(mac string, peerConnection *webrtc.PeerConnection) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.peers[mac]; ok && p.handshaking && p.connection == peerConnection {
+		p.handshaking = false
+
+		<-m.handshakes
+	}
+}
+
+func (m *ClientManager) addPendingCandidates(mac string, peerConnection *webrtc.PeerConnection) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		return nil
+	}
+
+	for _, candidate := range p.candidates {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+
+	p.candidates = []webrtc.ICECandidateInit{}
+
+	return nil
+}
+
+// sendCandidates sends the candidates to a peer in a single message
+func (m *ClientManager) sendCandidates(conn Conn, uuid string, mac string, candidates ...webrtc.ICECandidate) {
+	if len(candidates) == 0 {
+		return
+	}
+
+	candidate := api.NewCandidate([]byte(candidates[0].ToJSON().Candidate), uuid, mac)
+	for _, i := range candidates[1:] {
+		candidate.Batch = append(candidate.Batch, []byte(i.ToJSON().Candidate))
+	}
+
+	if err := m.write(conn, candidate); err != nil {
+		log.Printf("Could not send candidate to peer %v, retrying: %v\n", mac, err)
+
+		go m.resendCandidate(conn, candidate)
+	}
+}
+
+func (m *ClientManager) resendCandidate(conn Conn, candidate *api.Candidate) {
+	backoff := m.config.candidateRetryBackoff()
+
+	var err error
+	for attempt := 0; attempt < m.config.candidateRetries(); attempt++ {
+		// Add jitter so that the candidates of all peers are not resent at once
+		<-m.config.clock().After(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+
+		if err = m.write(conn, candidate); err == nil {
+			return
+		}
+
+		backoff *= 2
+	}
+
+	if err != nil {
+		m.reportError(candidate.ReceiverMac, PhaseCandidates, err)
+	}
+}
+
+// write sends a message to the signaling server. Writes are serialized by their own lock, so that they
+// neither hold up nor depend on the lock of the peers.
+func (m *ClientManager) write(conn Conn, v interface{}) error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	return writes.WithTimeout(conn, m.config.writeTimeout(), v, m.outbound)
+}
+
+// PeerConnection returns the current connection to a peer
+func (m *ClientManager) PeerConnection(mac string) (*webrtc.PeerConnection, error) {
+	return m.getPeerConnection(mac)
+}
+
+func (m *ClientManager) getPeerConnection(mac string) (*webrtc.PeerConnection, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok || p.connection == nil {
+		return nil, errors.New("No connection to this peer has been created so far")
+	}
+
+	return p.connection, nil
+}
+
+// SendMessage sends a message to all connected peers. Empty and nil messages are both received with an empty, non-nil payload.
+func (m *ClientManager) SendMessage(msg []byte) error {
+	return m.SendMessageCtx(context.Background(), msg)
+}
+
+// SendMessageCtx sends a message to all connected peers, aborting once the context is done
+func (m *ClientManager) SendMessageCtx(ctx context.Context, msg []byte) error {
+	return m.broadcast(ctx, msg, "")
+}
+
+// BroadcastExcept sends a message to all peers except the given one, e.g. to relay a message to everyone but its originator
+func (m *ClientManager) BroadcastExcept(excludeMac string, msg []byte) error {
+	return m.broadcast(context.Background(), msg, excludeMac)
+}
+
+func (m *ClientManager) broadcast(ctx context.Context, msg []byte, excludeMac string) error {
+	if atomic.LoadUint32(&m.closed) == 1 {
+		return ErrClosed
+	}
+
+	var sendErr error
+	for _, mac := range m.connectedPeers() {
+		if mac == excludeMac {
+			continue
+		}
+
+		if err := m.SendMessageUnicastCtx(ctx, msg, mac); err != nil && sendErr == nil {
+			sendErr = err
+		}
+	}
+
+	return sendErr
+}
+
+func (m *ClientManager) SendMessageUnicast(msg []byte, mac string) error {
+	return m.SendMessageUnicastCtx(context.Background(), msg, mac)
+}
+
+// SendMessageUnicastCtx sends a message to a single peer, returning the context's error if it is done before the message could be
+// sent, e.g. while it is throttled or waits for another send to the peer
+func (m *ClientManager) SendMessageUnicastCtx(ctx context.Context, msg []byte, mac string) error {
+	return m.sendUnicast(ctx, mac, apiDataChannels.WrappedMessage{Payload: msg})
+}
+
+func (m *ClientManager) sendUnicast(ctx context.Context, mac string, w apiDataChannels.WrappedMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if atomic.LoadUint32(&m.closed) == 1 {
+		return ErrClosed
+	}
+
+	channel, err := m.getChannel(mac)
+	if err != nil {
+		return err
+	}
+
+	w, err = m.wrap(w)
+	if err != nil {
+		return err
+	}
+
+	// Throttled before the message is numbered, as a message which is not sent must not take a number
+	if err := m.throttle(ctx, mac, w); err != nil {
+		return err
+	}
+
+	// Close might have begun while the message was throttled
+	if err := m.beginSend(); err != nil {
+		return err
+	}
+	defer m.endSend()
+
+	slot := m.sendSlot(mac)
+	select {
+	case slot <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-slot
+	}()
+
+	if hook := testhooks.BeforeSend(); hook != nil {
+		hook(mac)
+	}
+
+	m.number(mac, &w)
+
+	wrappedMsg, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	if err := channel.Send(wrappedMsg); err != nil {
+		return err
+	}
+
+	m.countSent(mac, len(wrappedMsg))
+
+	return nil
+}
+
+// SendJSONUnicast marshals v to JSON and sends it to a single peer
+func (m *ClientManager) SendJSONUnicast(mac string, v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return m.SendMessageUnicast(msg, mac)
+}
+
+// BroadcastJSON marshals v to JSON once and sends it to all connected peers
+func (m *ClientManager) BroadcastJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return m.SendMessage(msg)
+}
+
+// throttle paces the messages to a peer so that the configured send rate is kept on average
+func (m *ClientManager) throttle(ctx context.Context, mac string, w apiDataChannels.WrappedMessage) error {
+	if m.config.MaxSendRate <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	size := len(data)
+
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if !ok {
+		m.lock.Unlock()
+
+		return nil
+	}
+
+	now := m.config.clock().Now()
+	if p.nextSend.Before(now) {
+		p.nextSend = now
+	}
+
+	wait := p.nextSend.Sub(now)
+	cost := time.Duration(size) * time.Second / time.Duration(m.config.MaxSendRate)
+	p.nextSend = p.nextSend.Add(cost)
+	m.lock.Unlock()
+
+	timer := m.config.clock().NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		// The message is not sent, so the following ones don't have to wait for it
+		m.lock.Lock()
+		p.nextSend = p.nextSend.Add(-cost)
+		m.lock.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// IsConnected returns whether the data channel to the given peer is open
+func (m *ClientManager) IsConnected(mac string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+
+	return ok && p.channel != nil && p.channel.ReadyState() == webrtc.DataChannelStateOpen
+}
+
+// WaitForPeerMac blocks until the data channel to the given peer is open, returning immediately if it already is,
+// or until the context is done
+func (m *ClientManager) WaitForPeerMac(ctx context.Context, mac string) error {
+	m.lock.Lock()
+	if p, ok := m.peers[mac]; ok && p.channel != nil && p.channel.ReadyState() == webrtc.DataChannelStateOpen {
+		m.lock.Unlock()
+
+		return nil
+	}
+
+	waiter := make(chan struct{})
+	m.openWaiters[mac] = append(m.openWaiters[mac], waiter)
+	m.lock.Unlock()
+
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		waiters := m.openWaiters[mac]
+		for i, candidate := range waiters {
+			if candidate == waiter {
+				m.openWaiters[mac] = append(waiters[:i], waiters[i+1:]...)
+
+				break
+			}
+		}
+		if len(m.openWaiters[mac]) == 0 {
+			delete(m.openWaiters, mac)
+		}
+
+		return ctx.Err()
+	}
+}
+
+// Peers returns the macs of the peers whose data channel is open, in ascending order
+func (m *ClientManager) Peers() []string {
+	macs := m.connectedPeers()
+	sort.Strings(macs)
+
+	return macs
+}
+
+// PendingPeers returns the macs of the peers whose handshake is queued or in progress, in ascending order
+func (m *ClientManager) PendingPeers() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	macs := []string{}
+	for mac, p := range m.peers {
+		if mac != m.mac && p.channel == nil {
+			macs = append(macs, mac)
+		}
+	}
+	sort.Strings(macs)
+
+	return macs
+}
+
+func (m *ClientManager) connectedPeers() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	macs := []string{}
+	for mac, p := range m.peers {
+		if mac != m.mac && p.channel != nil {
+			macs = append(macs, mac)
+		}
+	}
+
+	return macs
+}
+
+// DataChannel returns the open data channel to a peer, e.g. to read its BufferedAmount.
+// Messages sent on it directly bypass the wrapping, compression, session numbering and throttling of SendMessage, so the
+// remote ClientManager drops them. Replacing its OnOpen, OnMessage or OnClose handlers breaks delivery and keepalives.
+// Use Conn for the detached channel with DetachDataChannels. The channel is replaced when the peer reconnects.
+func (m *ClientManager) DataChannel(mac string) (*webrtc.DataChannel, error) {
+	return m.getChannel(mac)
+}
+
+// OnChannelWritable calls f each time the data buffered for sending to a peer drops to BufferedAmountLowThreshold,
+// so that a stream can resume sending instead of polling BufferedAmount. It replaces the previous callback of the
+// peer and is kept when the peer reconnects.
+func (m *ClientManager) OnChannelWritable(mac string, f func()) {
+	m.lock.Lock()
+	m.writable[mac] = f
+
+	var channel *webrtc.DataChannel
+	if p, ok := m.peers[mac]; ok {
+		channel = p.channel
+	}
+	m.lock.Unlock()
+
+	if channel != nil {
+		channel.OnBufferedAmountLow(f)
+	}
+}
+
+// SetPeerContext associates a value with a peer, e.g. its user ID, replacing the previous one. It is dropped once the
+// peer disconnects, so it is only kept for peers which are connected or in a handshake.
+func (m *ClientManager) SetPeerContext(mac string, v interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.peers[mac]; ok {
+		p.appContext = v
+	}
+}
+
+// PeerContext returns the value associated with a peer by SetPeerContext
+func (m *ClientManager) PeerContext(mac string) (interface{}, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok || p.appContext == nil {
+		return nil, false
+	}
+
+	return p.appContext, true
+}
+
+func (m *ClientManager) getChannel(mac string) (*webrtc.DataChannel, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok || p.channel == nil {
+		return nil, errors.New("No data channel to this peer has been opened so far")
+	}
+
+	return p.channel, nil
 }
 
 func refString(s string) *string {
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sync"
+
+	apiDataChannels "github.com/alphahorizonio/libentangle/pkg/api/datachannels/v1"
+	"github.com/pion/webrtc/v3"
+)
+
+// JSONRouter decodes the JSON payloads of received messages and dispatches them by their type field, which
+// complements SendJSONUnicast and BroadcastJSON. Its HandleMessage method can be passed as the message handler to Connect.
+type JSONRouter struct {
+	lock sync.RWMutex
+
+	handlers map[string]reflect.Value
+	fallback func(mac string, payload []byte)
+}
+
+// NewJSONRouter creates a router calling fallback with the payloads of messages whose type has no registered handler
+func NewJSONRouter(fallback func(mac string, payload []byte)) *JSONRouter {
+	return &JSONRouter{
+		handlers: map[string]reflect.Value{},
+		fallback: fallback,
+	}
+}
+
+// OnJSON registers a handler for the messages with the given type. The handler has to be a func(mac string, msg T),
+// where T is the type the payload is unmarshaled into, e.g. a struct with a `json:"type"` field. Panics for other handlers.
+func (r *JSONRouter) OnJSON(typ string, handler interface{}) {
+	h := reflect.ValueOf(handler)
+
+	t := h.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0).Kind() != reflect.String || t.NumOut() != 0 {
+		panic("JSON handler for type " + typ + " is not a func(mac string, msg T)")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.handlers[typ] = h
+}
+
+// HandleMessage unwraps a message received from a peer and dispatches its payload
+func (r *JSONRouter) HandleMessage(msg webrtc.DataChannelMessage) {
+	var w apiDataChannels.WrappedMessage
+	if err := json.Unmarshal(msg.Data, &w); err != nil {
+		log.Printf("Could not unwrap message: %v\n", err)
+
+		return
+	}
+
+	r.Dispatch(w.Mac, w.Payload)
+}
+
+// Dispatch calls the handler registered for the type of a payload, or the fallback if there is none
+func (r *JSONRouter) Dispatch(mac string, payload []byte) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		r.dispatchFallback(mac, payload)
+
+		return
+	}
+
+	r.lock.RLock()
+	h, ok := r.handlers[envelope.Type]
+	r.lock.RUnlock()
+
+	if !ok {
+		r.dispatchFallback(mac, payload)
+
+		return
+	}
+
+	v := reflect.New(h.Type().In(1))
+	if err := json.Unmarshal(payload, v.Interface()); err != nil {
+		log.Printf("Could not decode message of type %v from peer %v: %v\n", envelope.Type, mac, err)
+
+		return
+	}
+
+	h.Call([]reflect.Value{reflect.ValueOf(mac).Convert(h.Type().In(0)), v.Elem()})
+}
+
+func (r *JSONRouter) dispatchFallback(mac string, payload []byte) {
+	if r.fallback != nil {
+		r.fallback(mac, payload)
+	}
+}
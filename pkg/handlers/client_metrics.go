@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StatsCollector periodically scrapes the WebRTC stats of all peers of a ClientManager and exposes them as
+// Prometheus gauges labeled by mac. Register it with a prometheus.Registerer to export them.
+type StatsCollector struct {
+	manager *ClientManager
+
+	// Held while the gauges are replaced, so that they are not collected half way
+	lock            sync.Mutex
+	rtt             *prometheus.GaugeVec
+	sentBytes       *prometheus.GaugeVec
+	receivedBytes   *prometheus.GaugeVec
+	retransmissions *prometheus.GaugeVec
+	candidates      *prometheus.GaugeVec
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewStatsCollector scrapes the stats of the manager's peers right away and then in the given interval until it is closed
+func NewStatsCollector(manager *ClientManager, interval time.Duration) *StatsCollector {
+	c := &StatsCollector{
+		manager: manager,
+
+		rtt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libentangle_peer_rtt_seconds",
+			Help: "Latest round trip time of the selected candidate pair of a peer.",
+		}, []string{"mac"}),
+		sentBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libentangle_peer_sent_bytes",
+			Help: "Bytes sent to a peer over its ICE transport.",
+		}, []string{"mac"}),
+		receivedBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libentangle_peer_received_bytes",
+			Help: "Bytes received from a peer over its ICE transport.",
+		}, []string{"mac"}),
+		retransmissions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libentangle_peer_retransmissions",
+			Help: "Connectivity checks retransmitted to a peer on the selected candidate pair.",
+		}, []string{"mac"}),
+		candidates: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libentangle_peer_candidate_info",
+			Help: "Types of the local and remote candidate a peer is connected with, always 1.",
+		}, []string{"mac", "local", "remote"}),
+
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	c.scrape()
+
+	go func() {
+		defer close(c.done)
+
+		timer := manager.config.clock().NewTimer(interval)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C():
+				c.scrape()
+
+				timer.Reset(interval)
+			case <-c.closing:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// scrape replaces the gauges with the current stats, so that peers which disconnected disappear
+func (c *StatsCollector) scrape() {
+	type stats struct {
+		mac    string
+		pair   webrtc.ICECandidatePairStats
+		local  webrtc.ICECandidateStats
+		remote webrtc.ICECandidateStats
+		ice    webrtc.TransportStats
+	}
+
+	scraped := []stats{}
+	for _, mac := range c.manager.Peers() {
+		peerConnection, err := c.manager.getPeerConnection(mac)
+		if err != nil {
+			continue
+		}
+
+		report := peerConnection.GetStats()
+
+		pair, local, remote, err := selectedPair(report)
+		if err != nil {
+			continue
+		}
+
+		ice, _ := report["iceTransport"].(webrtc.TransportStats)
+
+		scraped = append(scraped, stats{mac, pair, local, remote, ice})
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rtt.Reset()
+	c.sentBytes.Reset()
+	c.receivedBytes.Reset()
+	c.retransmissions.Reset()
+	c.candidates.Reset()
+
+	for _, s := range scraped {
+		c.rtt.WithLabelValues(s.mac).Set(s.pair.CurrentRoundTripTime)
+		c.sentBytes.WithLabelValues(s.mac).Set(float64(s.ice.BytesSent))
+		c.receivedBytes.WithLabelValues(s.mac).Set(float64(s.ice.BytesReceived))
+		c.retransmissions.WithLabelValues(s.mac).Set(float64(s.pair.RetransmissionsSent))
+		c.candidates.WithLabelValues(s.mac, s.local.CandidateType.String(), s.remote.CandidateType.String()).Set(1)
+	}
+}
+
+func (c *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.rtt.Describe(ch)
+	c.sentBytes.Describe(ch)
+	c.receivedBytes.Describe(ch)
+	c.retransmissions.Describe(ch)
+	c.candidates.Describe(ch)
+}
+
+func (c *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rtt.Collect(ch)
+	c.sentBytes.Collect(ch)
+	c.receivedBytes.Collect(ch)
+	c.retransmissions.Collect(ch)
+	c.candidates.Collect(ch)
+}
+
+// Close stops scraping and waits until a scrape in progress is done. The last scraped stats are still exposed.
+func (c *StatsCollector) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+
+	<-c.done
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+
+	"github.com/alphahorizonio/libentangle/pkg/clock"
+	"github.com/pion/webrtc/v3"
+)
+
+// reorderBuffer holds the messages of a peer which arrived before a message they were sent after
+type reorderBuffer struct {
+	lock sync.Mutex
+
+	next    uint64
+	pending map[uint64]webrtc.DataChannelMessage
+
+	// Timeout of the missing message, and a channel closed once it arrives or is skipped
+	gapTimer  clock.Timer
+	gapClosed chan struct{}
+}
+
+// deliverInOrder delivers a message once all messages sent before it were delivered. Messages without an order are delivered immediately.
+func (m *ClientManager) deliverInOrder(mac string, order uint64, msg webrtc.DataChannelMessage, f func(msg webrtc.DataChannelMessage)) {
+	if !m.config.OrderedDelivery || order == 0 {
+		f(msg)
+
+		return
+	}
+
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if !ok {
+		m.lock.Unlock()
+
+		return
+	}
+
+	if p.reorder == nil {
+		p.reorder = &reorderBuffer{
+			next:    1,
+			pending: map[uint64]webrtc.DataChannelMessage{},
+		}
+	}
+	r := p.reorder
+	m.lock.Unlock()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if order < r.next {
+		m.dropMessage(mac, &OutOfOrder{order, r.next})
+
+		return
+	}
+
+	next := r.next
+	r.pending[order] = msg
+
+	if len(r.pending) > m.config.reorderWindow() {
+		m.skipGap(mac, r)
+	}
+
+	r.drain(f)
+
+	if r.next != next || len(r.pending) == 0 {
+		r.closeGap()
+	}
+
+	if len(r.pending) > 0 && r.gapClosed == nil {
+		m.awaitGap(mac, r, f)
+	}
+}
+
+// awaitGap skips the missing message if it did not arrive until the gap timeout
+func (m *ClientManager) awaitGap(mac string, r *reorderBuffer, f func(msg webrtc.DataChannelMessage)) {
+	closed := make(chan struct{})
+	timer := m.config.clock().NewTimer(m.config.reorderGapTimeout())
+
+	r.gapClosed = closed
+	r.gapTimer = timer
+
+	go func() {
+		select {
+		case <-closed:
+			return
+		case <-timer.C():
+		}
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		if r.gapClosed != closed {
+			return
+		}
+
+		m.skipGap(mac, r)
+
+		r.drain(f)
+
+		r.closeGap()
+		if len(r.pending) > 0 {
+			m.awaitGap(mac, r, f)
+		}
+	}()
+}
+
+// skipGap gives up on the missing messages before the first buffered one
+func (m *ClientManager) skipGap(mac string, r *reorderBuffer) {
+	first := uint64(0)
+	for order := range r.pending {
+		if first == 0 || order < first {
+			first = order
+		}
+	}
+
+	log.Printf("Skipping messages %v to %v from peer %v, which did not arrive\n", r.next, first-1, mac)
+
+	r.next = first
+}
+
+// drain delivers the buffered messages which are next in order
+func (r *reorderBuffer) drain(f func(msg webrtc.DataChannelMessage)) {
+	for {
+		msg, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+
+		delete(r.pending, r.next)
+		r.next++
+
+		f(msg)
+	}
+}
+
+func (r *reorderBuffer) closeGap() {
+	if r.gapClosed != nil {
+		r.gapTimer.Stop()
+		close(r.gapClosed)
+
+		r.gapTimer = nil
+		r.gapClosed = nil
+	}
+}
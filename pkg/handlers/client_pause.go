@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// pauseState holds the messages of a peer which arrived while receiving from it was paused
+type pauseState struct {
+	lock sync.Mutex
+
+	paused   bool
+	flushing bool
+	buffer   []pausedMessage
+}
+
+type pausedMessage struct {
+	msg webrtc.DataChannelMessage
+	f   func(msg webrtc.DataChannelMessage)
+}
+
+// PauseReceive stops delivering the messages of a peer to the message handler without disconnecting from it, e.g.
+// while the application is overloaded. They are buffered until ResumeReceive, up to PauseBufferSize, or dropped
+// with DropWhilePaused. The peer is resumed if the connection to it is replaced.
+func (m *ClientManager) PauseReceive(mac string) error {
+	s, err := m.getPauseState(mac)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.paused = true
+
+	return nil
+}
+
+// ResumeReceive delivers the messages buffered while the peer was paused in the order they arrived, and further ones as they arrive
+func (m *ClientManager) ResumeReceive(mac string) error {
+	s, err := m.getPauseState(mac)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.paused = false
+
+	// Another call is delivering the buffered messages already
+	if s.flushing {
+		s.lock.Unlock()
+
+		return nil
+	}
+	s.flushing = true
+	s.lock.Unlock()
+
+	// Messages arriving in the meantime are buffered behind the ones being delivered, so that they keep their order.
+	// The handler is called without the lock, so that it can pause the peer again.
+	for {
+		s.lock.Lock()
+		if s.paused || len(s.buffer) == 0 {
+			s.flushing = false
+			s.lock.Unlock()
+
+			return nil
+		}
+
+		next := s.buffer[0]
+		s.buffer = s.buffer[1:]
+		s.lock.Unlock()
+
+		next.f(next.msg)
+	}
+}
+
+func (m *ClientManager) getPauseState(mac string) (*pauseState, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		return nil, errors.New("Not connected to this peer")
+	}
+
+	if p.pause == nil {
+		p.pause = &pauseState{}
+	}
+
+	return p.pause, nil
+}
+
+// deliverUnlessPaused delivers a message unless receiving from the peer is paused, in which case it is buffered or dropped
+func (m *ClientManager) deliverUnlessPaused(mac string, msg webrtc.DataChannelMessage, f func(msg webrtc.DataChannelMessage)) {
+	m.lock.Lock()
+	var s *pauseState
+	if p, ok := m.peers[mac]; ok {
+		s = p.pause
+	}
+	m.lock.Unlock()
+
+	if s == nil {
+		f(msg)
+
+		return
+	}
+
+	s.lock.Lock()
+	if !s.paused && !s.flushing {
+		s.lock.Unlock()
+
+		f(msg)
+
+		return
+	}
+
+	if m.config.DropWhilePaused || len(s.buffer) >= m.config.pauseBufferSize() {
+		buffered := len(s.buffer)
+		s.lock.Unlock()
+
+		m.dropMessage(mac, &ReceivePaused{buffered})
+
+		return
+	}
+
+	s.buffer = append(s.buffer, pausedMessage{msg, f})
+	s.lock.Unlock()
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/pion/webrtc/v3"
+)
+
+// repeer replaces the failed or closed connection to a peer with a new handshake through the signaling server, as if the
+// peer was introduced again. Only the peer with the lower mac offers, so that both don't offer at the same time. The
+// other peer waits for the offer, and asks the signaling server to introduce it again in case the peer with the lower
+// mac didn't notice that the connection failed.
+func (m *ClientManager) repeer(mac string, failed *webrtc.PeerConnection, conn Conn, wg *sync.WaitGroup, f func(msg webrtc.DataChannelMessage)) {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if !ok || p.connection != failed {
+		// The connection was closed or replaced in the meantime
+		m.lock.Unlock()
+
+		return
+	}
+	communities := append([]string{}, p.communities...)
+	offering := m.mac < mac
+	attempt := m.repeers[mac]
+	m.repeers[mac]++
+	m.lock.Unlock()
+
+	m.removePeer(mac)
+
+	if attempt >= m.config.repeerAttempts() {
+		m.lock.Lock()
+		delete(m.repeers, mac)
+		m.lock.Unlock()
+
+		m.reportError(mac, PhaseHandshake, &RepeerExhausted{attempt})
+
+		return
+	}
+
+	// The offering peer gets a head start, so that its offer usually arrives before we ask for it
+	backoff := m.config.repeerBackoff() << attempt
+	if !offering {
+		backoff *= 2
+	}
+
+	<-m.config.clock().After(backoff)
+
+	// We might have been closed or the remote might have offered in the meantime
+	if atomic.LoadUint32(&m.closed) == 1 || m.hasConnection(mac) {
+		return
+	}
+
+	community := ""
+	if len(communities) > 0 {
+		community = communities[0]
+	}
+
+	if !offering {
+		if err := m.write(conn, api.NewRepeer(m.Mac(), mac, community)); err != nil {
+			m.reportError(mac, PhaseHandshake, err)
+		}
+
+		return
+	}
+
+	if err := m.HandleIntroduction(conn, m.Mac(), wg, f, *api.NewIntroduction(mac, community)); err != nil {
+		m.reportError(mac, PhaseHandshake, err)
+
+		return
+	}
+
+	for _, community := range communities {
+		m.addCommunity(mac, community)
+	}
+}
+
+// dropStale removes the established connection to a peer which asked to be introduced again, as it failed on the peer's
+// side even if it didn't fail on ours so far. A handshake which is already in progress is kept.
+func (m *ClientManager) dropStale(mac string) {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	stale := ok && p.channel != nil
+	m.lock.Unlock()
+
+	if stale {
+		m.removePeer(mac)
+	}
+}
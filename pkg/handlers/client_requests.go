@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+
+	apiDataChannels "github.com/alphahorizonio/libentangle/pkg/api/datachannels/v1"
+	"github.com/google/uuid"
+)
+
+// Request sends a message to a single peer and waits until it replies to it with Reply, returning the payload of the
+// reply. The message is delivered to the peer's message handler with a correlation ID in its WrappedMessage.
+func (m *ClientManager) Request(ctx context.Context, mac string, payload []byte) ([]byte, error) {
+	correlation := uuid.NewString()
+	reply := make(chan []byte, 1)
+
+	m.lock.Lock()
+	m.requests[correlation] = reply
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		delete(m.requests, correlation)
+		m.lock.Unlock()
+	}()
+
+	if err := m.sendUnicast(ctx, mac, apiDataChannels.WrappedMessage{Correlation: correlation, Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case payload := <-reply:
+		return payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reply answers the request with the given correlation ID, which resolves the peer's call to Request
+func (m *ClientManager) Reply(mac string, correlation string, payload []byte) error {
+	return m.sendUnicast(context.Background(), mac, apiDataChannels.WrappedMessage{Correlation: correlation, Reply: true, Payload: payload})
+}
+
+// resolveRequest passes a reply to its request. Replies to requests which timed out are dropped.
+func (m *ClientManager) resolveRequest(correlation string, payload []byte) {
+	m.lock.Lock()
+	reply, ok := m.requests[correlation]
+	delete(m.requests, correlation)
+	m.lock.Unlock()
+
+	if ok {
+		reply <- payload
+	}
+}
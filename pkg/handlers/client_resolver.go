@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Port of stun and turn URLs without an explicit one
+const defaultICEPort = "3478"
+
+// resolveICEServers replaces the hostnames of the ICE server URLs with their addresses looked up by the configured Resolver
+func (m *ClientManager) resolveICEServers() []webrtc.ICEServer {
+	iceServers := m.config.iceServers()
+	if m.config.Resolver == nil {
+		return iceServers
+	}
+
+	resolved := []webrtc.ICEServer{}
+	for _, server := range iceServers {
+		urls := []string{}
+		for _, url := range server.URLs {
+			urls = append(urls, m.resolveICEURL(url))
+		}
+
+		server.URLs = urls
+		resolved = append(resolved, server)
+	}
+
+	return resolved
+}
+
+// resolveICEURL resolves the host of a URL such as stun:example.com:3478 or turn:example.com?transport=tcp,
+// keeping the URL as it is if it can't be resolved
+func (m *ClientManager) resolveICEURL(url string) string {
+	parts := strings.SplitN(url, ":", 2)
+	if len(parts) != 2 || (parts[0] != "stun" && parts[0] != "turn") {
+		return url
+	}
+	scheme, rest := parts[0], parts[1]
+
+	query := ""
+	if i := strings.Index(rest, "?"); i != -1 {
+		rest, query = rest[:i], rest[i:]
+	}
+
+	host, port, err := net.SplitHostPort(rest)
+	if err != nil {
+		host, port = rest, defaultICEPort
+	}
+
+	if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return url
+	}
+
+	addrs, err := m.config.Resolver.LookupHost(context.Background(), host)
+	if err != nil || len(addrs) == 0 {
+		log.Printf("Could not resolve ICE server %v: %v\n", host, err)
+
+		return url
+	}
+
+	return scheme + ":" + net.JoinHostPort(addrs[0], port) + query
+}
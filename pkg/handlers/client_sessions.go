@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+
+	apiDataChannels "github.com/alphahorizonio/libentangle/pkg/api/datachannels/v1"
+	"github.com/pion/webrtc/v3"
+)
+
+// A session outlives the peer connections to a remote ClientManager, so that the messages sent through
+// them can be numbered continuously across reconnects
+type session struct {
+	sent uint64
+
+	// All messages up to received have been delivered, and the ones in ahead after a gap, e.g. new messages which
+	// arrived before the missed ones were resent
+	received uint64
+	ahead    map[uint64]struct{}
+
+	// Sent messages which the remote might not have received yet
+	buffer []apiDataChannels.WrappedMessage
+}
+
+// receive returns whether a message has not been delivered so far. Gaps which are wider than the resend buffer
+// of the remote can't be filled anymore, so they are skipped.
+func (s *session) receive(sequence uint64, window int) bool {
+	if _, ok := s.ahead[sequence]; ok || sequence <= s.received {
+		return false
+	}
+
+	if s.ahead == nil {
+		s.ahead = map[uint64]struct{}{}
+	}
+	s.ahead[sequence] = struct{}{}
+
+	for len(s.ahead) > window {
+		next := uint64(0)
+		for sequence := range s.ahead {
+			if next == 0 || sequence < next {
+				next = sequence
+			}
+		}
+
+		s.received = next - 1
+		s.advance()
+	}
+
+	s.advance()
+
+	return true
+}
+
+func (s *session) advance() {
+	for {
+		if _, ok := s.ahead[s.received+1]; !ok {
+			return
+		}
+
+		delete(s.ahead, s.received+1)
+		s.received++
+	}
+}
+
+// wrap prepares a message for sending, compressing its payload
+func (m *ClientManager) wrap(w apiDataChannels.WrappedMessage) (apiDataChannels.WrappedMessage, error) {
+	w.Mac = m.mac
+
+	// Sent as an empty string rather than null, so that empty messages are received with an empty instead of a nil payload
+	if w.Payload == nil {
+		w.Payload = []byte{}
+	}
+
+	// Compress before buffering, so that resent messages don't have to be compressed again
+	if err := m.compress(&w); err != nil {
+		return w, err
+	}
+
+	return w, nil
+}
+
+// number assigns the session and order numbers of a message to a peer and buffers it for resending. The send slot
+// of the peer has to be held until the message is sent, so that the messages are sent in the order of their numbers.
+func (m *ClientManager) number(mac string, w *apiDataChannels.WrappedMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		return
+	}
+
+	if m.config.SessionResumption && p.session != "" {
+		s := m.sessions[p.session]
+
+		s.sent++
+		w.Sequence = s.sent
+
+		s.buffer = append(s.buffer, *w)
+		if len(s.buffer) > m.config.resumeBufferSize() {
+			s.buffer = s.buffer[1:]
+		}
+	}
+
+	// Numbered after buffering, as resent messages are not part of the order of the new connection. Replies are
+	// not delivered to the message handler, so they are not part of the order either.
+	if m.config.OrderedDelivery && !w.Reply {
+		p.ordered++
+		w.Order = p.ordered
+	}
+}
+
+// sendSlot returns the semaphore which is held while a message to a peer is numbered and sent. Unlike a mutex, waiting
+// for it can be cancelled.
+func (m *ClientManager) sendSlot(mac string) chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		// The peer was removed in the meantime, so the message won't be numbered
+		return make(chan struct{}, 1)
+	}
+
+	if p.sendSlot == nil {
+		p.sendSlot = make(chan struct{}, 1)
+	}
+
+	return p.sendSlot
+}
+
+func (m *ClientManager) announceSession(dc *webrtc.DataChannel) {
+	m.sendWrapped(dc, apiDataChannels.WrappedMessage{Mac: m.mac, Opcode: apiDataChannels.OpcodeSession, Session: m.session})
+}
+
+// handleSession processes the session control messages and drops already delivered messages. It returns
+// whether the message should be delivered.
+func (m *ClientManager) handleSession(mac string, dc *webrtc.DataChannel, w apiDataChannels.WrappedMessage) bool {
+	switch w.Opcode {
+	case apiDataChannels.OpcodeSession:
+		m.lock.Lock()
+		s, ok := m.sessions[w.Session]
+		if !ok {
+			s = &session{}
+
+			m.sessions[w.Session] = s
+		}
+
+		if p, ok := m.peers[mac]; ok {
+			p.session = w.Session
+		}
+		received := s.received
+		m.lock.Unlock()
+
+		// Tell the remote which messages we have already received, so that it can resend the rest
+		m.sendWrapped(dc, apiDataChannels.WrappedMessage{Mac: m.mac, Opcode: apiDataChannels.OpcodeResume, Sequence: received})
+
+		return false
+	case apiDataChannels.OpcodeResume:
+		m.lock.Lock()
+		missed := []apiDataChannels.WrappedMessage{}
+		if p, ok := m.peers[mac]; ok && p.session != "" {
+			s := m.sessions[p.session]
+
+			for _, buffered := range s.buffer {
+				if buffered.Sequence > w.Sequence {
+					missed = append(missed, buffered)
+				}
+			}
+
+			s.buffer = append([]apiDataChannels.WrappedMessage{}, missed...)
+		}
+		m.lock.Unlock()
+
+		for _, buffered := range missed {
+			// The mac might have changed since the message was sent first
+			buffered.Mac = m.mac
+
+			m.sendWrapped(dc, buffered)
+		}
+
+		return false
+	}
+
+	if w.Sequence == 0 {
+		return true
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok || p.session == "" {
+		return true
+	}
+
+	return m.sessions[p.session].receive(w.Sequence, m.config.resumeBufferSize())
+}
+
+func (m *ClientManager) sendWrapped(dc *webrtc.DataChannel, w apiDataChannels.WrappedMessage) {
+	msg, err := json.Marshal(w)
+	if err != nil {
+		return
+	}
+
+	if err := dc.Send(msg); err != nil {
+		log.Printf("Could not send wrapped message %v: %v\n", w.Opcode, err)
+	}
+}
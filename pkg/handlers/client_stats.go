@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ConnectionInfo is a snapshot of everything known about the connection to a peer, e.g. for debugging tools
+type ConnectionInfo struct {
+	Mac string
+	// Whether the handshake with the peer is still in progress
+	Handshaking        bool
+	ConnectionState    webrtc.PeerConnectionState
+	ICEConnectionState webrtc.ICEConnectionState
+
+	// Candidate pair selected by ICE, nil until one was selected
+	SelectedPair        *webrtc.ICECandidatePair
+	LocalCandidateType  webrtc.ICECandidateType
+	RemoteCandidateType webrtc.ICECandidateType
+	// Transport protocol of the local candidate, either udp or tcp
+	Protocol string
+
+	// Labels of the data channels to the peer, empty until one was opened, and the bytes queued for sending on them
+	ChannelLabels  []string
+	BufferedAmount uint64
+
+	Counters PeerCounters
+}
+
+// Relayed reports whether the connection goes through a TURN server instead of connecting the peers directly
+func (i ConnectionInfo) Relayed() bool {
+	return i.LocalCandidateType == webrtc.ICECandidateTypeRelay || i.RemoteCandidateType == webrtc.ICECandidateTypeRelay
+}
+
+// ConnectionInfo returns a snapshot of the connection to a peer. The candidate types tell apart direct connections
+// from relayed ones and are empty until a candidate pair was selected.
+func (m *ClientManager) ConnectionInfo(mac string) (ConnectionInfo, error) {
+	m.lock.Lock()
+	p, ok := m.peers[mac]
+	if !ok || p.connection == nil {
+		m.lock.Unlock()
+
+		return ConnectionInfo{}, errors.New("No connection to this peer has been created so far")
+	}
+
+	info := ConnectionInfo{
+		Mac:           mac,
+		Handshaking:   p.handshaking,
+		ChannelLabels: []string{},
+		Counters:      p.counters,
+	}
+	peerConnection, channel := p.connection, p.channel
+	m.lock.Unlock()
+
+	// pion synchronizes these itself, so they are read outside of our lock
+	info.ConnectionState = peerConnection.ConnectionState()
+	info.ICEConnectionState = peerConnection.ICEConnectionState()
+
+	if channel != nil {
+		info.ChannelLabels = append(info.ChannelLabels, channel.Label())
+		info.BufferedAmount = channel.BufferedAmount()
+	}
+
+	pair, err := peerConnection.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return ConnectionInfo{}, err
+	}
+	info.SelectedPair = pair
+
+	if _, local, remote, err := selectedPair(peerConnection.GetStats()); err == nil {
+		info.LocalCandidateType = local.CandidateType
+		info.RemoteCandidateType = remote.CandidateType
+		info.Protocol = local.Protocol
+	}
+
+	return info, nil
+}
+
+// PeerCounters counts the messages exchanged with a peer through the ClientManager, independent of the WebRTC stats.
+// Bytes are counted as sent over the data channel, including the envelope and after compression. Keepalives and the
+// messages of Conn are not counted.
+type PeerCounters struct {
+	SentMessages     uint64
+	SentBytes        uint64
+	ReceivedMessages uint64
+	ReceivedBytes    uint64
+}
+
+// PeerCounters returns the counters of a peer, which start over if the connection to it is replaced
+func (m *ClientManager) PeerCounters(mac string) (PeerCounters, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[mac]
+	if !ok {
+		return PeerCounters{}, errors.New("No connection to this peer has been created so far")
+	}
+
+	return p.counters, nil
+}
+
+func (m *ClientManager) countSent(mac string, size int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.peers[mac]; ok {
+		p.counters.SentMessages++
+		p.counters.SentBytes += uint64(size)
+	}
+}
+
+func (m *ClientManager) countReceived(mac string, size int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.peers[mac]; ok {
+		p.counters.ReceivedMessages++
+		p.counters.ReceivedBytes += uint64(size)
+	}
+}
+
+// Quality holds the measurements a quality score is derived from. Zero values count as perfect.
+type Quality struct {
+	RTT time.Duration
+	// Share of lost connectivity checks, from 0 to 1
+	PacketLoss float64
+	Relayed    bool
+}
+
+// Score rates the quality from 0 to 100. Round trip times above 50ms cost up to 50 points, packet loss up to 40 points
+// at 10% and a relay 10 points.
+func (q Quality) Score() int {
+	score := 100
+
+	if q.RTT > 50*time.Millisecond {
+		score -= min(50, int((q.RTT-50*time.Millisecond)/(10*time.Millisecond)))
+	}
+
+	if q.PacketLoss > 0 {
+		score -= min(40, int(q.PacketLoss*400))
+	}
+
+	if q.Relayed {
+		score -= 10
+	}
+
+	if score < 0 {
+		return 0
+	}
+
+	return score
+}
+
+// PeerQuality scores the connection to a peer from 0 to 100 with its current stats, see Quality.Score.
+// pion v3.1 does not measure round trip times and loss of candidate pairs yet, so only relays lower the score for now.
+func (m *ClientManager) PeerQuality(mac string) (int, error) {
+	peerConnection, err := m.getPeerConnection(mac)
+	if err != nil {
+		return 0, err
+	}
+
+	pair, local, remote, err := selectedPair(peerConnection.GetStats())
+	if err != nil {
+		return 0, err
+	}
+
+	quality := Quality{
+		RTT:     time.Duration(pair.CurrentRoundTripTime * float64(time.Second)),
+		Relayed: local.CandidateType == webrtc.ICECandidateTypeRelay || remote.CandidateType == webrtc.ICECandidateTypeRelay,
+	}
+
+	if pair.RequestsSent > 0 && pair.ResponsesReceived < pair.RequestsSent {
+		quality.PacketLoss = 1 - float64(pair.ResponsesReceived)/float64(pair.RequestsSent)
+	}
+
+	return quality.Score(), nil
+}
+
+// selectedPair returns the nominated and succeeded candidate pair of a stats report with its candidates
+func selectedPair(report webrtc.StatsReport) (webrtc.ICECandidatePairStats, webrtc.ICECandidateStats, webrtc.ICECandidateStats, error) {
+	for _, s := range report {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+
+		local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+
+		remote, ok := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+
+		return pair, local, remote, nil
+	}
+
+	return webrtc.ICECandidatePairStats{}, webrtc.ICECandidateStats{}, webrtc.ICECandidateStats{}, errors.New("No candidate pair has been selected for this peer so far")
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
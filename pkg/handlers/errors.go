@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrClosed is returned by the send methods of a ClientManager once Close was called
+var ErrClosed = errors.New("The client manager is closed")
+
+// Phases of the connection to a peer in which a PeerError can occur
+const (
+	PhaseHandshake   = "handshake"
+	PhaseCandidates  = "candidate exchange"
+	PhaseDataChannel = "data channel"
+	PhaseKeepalive   = "keepalive"
+	PhaseDisconnect  = "disconnect"
+)
+
+// PeerError is an error which occurred in the background while connecting to, talking to or disconnecting from a peer
+type PeerError struct {
+	Mac   string
+	Phase string
+	Err   error
+}
+
+func (m *PeerError) Error() string {
+	return "The " + m.Phase + " with peer " + m.Mac + " failed: " + m.Err.Error()
+}
+
+func (m *PeerError) Unwrap() error {
+	return m.Err
+}
+
+type MessageTooLarge struct {
+	Size int
+	Max  int
+}
+
+func (m *MessageTooLarge) Error() string {
+	return "Dropping message of " + strconv.Itoa(m.Size) + " bytes, the maximum is " + strconv.Itoa(m.Max) + " bytes"
+}
+
+type UnknownSender struct {
+	Mac string
+}
+
+func (m *UnknownSender) Error() string {
+	return "Dropping message from " + m.Mac + ", which is not a connected peer"
+}
+
+type OutOfOrder struct {
+	Order    uint64
+	Expected uint64
+}
+
+func (m *OutOfOrder) Error() string {
+	return "Dropping message " + strconv.FormatUint(m.Order, 10) + ", which arrived after message " + strconv.FormatUint(m.Expected-1, 10) + " was delivered"
+}
+
+type MessageExpired struct {
+	Opcode string
+	Sender string
+}
+
+func (m *MessageExpired) Error() string {
+	return "Dropping " + m.Opcode + " from " + m.Sender + ", which expired before it was delivered"
+}
+
+type TooManyPeers struct {
+	Max int
+}
+
+func (m *TooManyPeers) Error() string {
+	return "Refusing to connect to another peer, the maximum of " + strconv.Itoa(m.Max) + " peers is reached"
+}
+
+type ProtocolMismatch struct {
+	Protocol string
+	Expected string
+}
+
+func (m *ProtocolMismatch) Error() string {
+	return "Refusing data channel with protocol " + strconv.Quote(m.Protocol) + ", expected " + strconv.Quote(m.Expected)
+}
+
+type ReceivePaused struct {
+	Buffered int
+}
+
+func (m *ReceivePaused) Error() string {
+	return "Dropping message from a paused peer, " + strconv.Itoa(m.Buffered) + " of its messages are buffered already"
+}
+
+type RepeerExhausted struct {
+	Attempts int
+}
+
+func (m *RepeerExhausted) Error() string {
+	return "Giving up on re-establishing the failed connection after " + strconv.Itoa(m.Attempts) + " attempts"
+}
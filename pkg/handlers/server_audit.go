@@ -0,0 +1,91 @@
+package handlers
+
+import "time"
+
+const (
+	AuditJoin      = "join"
+	AuditReject    = "reject"
+	AuditReady     = "ready"
+	AuditOffer     = "offer"
+	AuditAnswer    = "answer"
+	AuditCandidate = "candidate"
+	AuditPresence  = "presence"
+	AuditRelay     = "relay"
+	AuditRepeer    = "repeer"
+	AuditExit      = "exit"
+	AuditKick      = "kick"
+	AuditClosed    = "closed"
+)
+
+// AuditEvent records a handled signaling message, such as a mac joining or exiting a community
+type AuditEvent struct {
+	Type      string
+	Community string
+	Mac       string
+	// Receiver of offers, answers, candidates and relayed messages
+	PeerMac string
+	Time    time.Time
+}
+
+// audit queues an event for the AuditHook, which is called in order from a separate goroutine so that slow hooks
+// don't block the handlers. Events which don't fit into the queue, or which happen after draining, are dropped.
+func (m *CommunitiesManager) audit(typ string, community string, mac string, peerMac string) {
+	if m.config.AuditHook == nil {
+		return
+	}
+
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+
+	if m.auditStopped {
+		m.auditDropped++
+
+		return
+	}
+
+	if m.auditEvents == nil {
+		m.auditEvents = make(chan AuditEvent, m.config.auditBufferSize())
+
+		go func(events chan AuditEvent) {
+			for event := range events {
+				m.config.AuditHook(event)
+			}
+		}(m.auditEvents)
+	}
+
+	select {
+	case m.auditEvents <- AuditEvent{
+		Type:      typ,
+		Community: community,
+		Mac:       mac,
+		PeerMac:   peerMac,
+		Time:      m.config.clock().Now(),
+	}:
+	default:
+		m.auditDropped++
+	}
+}
+
+// stopAudit stops the goroutine calling the AuditHook once it has handled the queued events
+func (m *CommunitiesManager) stopAudit() {
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+
+	if m.auditStopped {
+		return
+	}
+	m.auditStopped = true
+
+	if m.auditEvents != nil {
+		close(m.auditEvents)
+	}
+}
+
+// DroppedAuditEvents returns the amount of audit events which were not passed to the AuditHook, because its queue
+// was full or because they happened after draining
+func (m *CommunitiesManager) DroppedAuditEvents() uint64 {
+	m.auditLock.Lock()
+	defer m.auditLock.Unlock()
+
+	return m.auditDropped
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"time"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/clock"
+	"github.com/alphahorizonio/libentangle/pkg/config"
+)
+
+type CommunitiesManagerConfig struct {
+	// Pre-shared secrets, keyed by community. Applicants for these communities are challenged to prove that they know the secret.
+	Secrets map[string][]byte
+
+	// Maximum amount of communities, applications creating another one are rejected while existing ones can still be joined.
+	// Zero allows any amount.
+	MaxCommunities int
+
+	// Minimum time between two presence updates of a member to a community, faster ones are dropped. Defaults to 100ms.
+	PresenceInterval time.Duration
+	// Maximum amount of messages each member can relay per second, further ones are dropped. Defaults to 10.
+	MaxRelayRate int
+	// Delay between the introductions of a ready member to each of the existing ones, which spreads the handshakes of
+	// large communities over time. Zero introduces it to all of them at once.
+	IntroductionSpacing time.Duration
+
+	// Assign the macs of applicants instead of trusting the ones they apply with, which prevents collisions and spoofing.
+	// The assigned mac is sent with the acceptance, and a connection keeps it for the further communities it applies for.
+	// Clients can't reconnect with the same mac by applying again then, only with their reconnect token.
+	AssignMacs bool
+
+	// Notify all connected peers once draining is done, so that they can reconnect to another signaling server
+	NotifyOnDrain bool
+
+	// Called with each join, exit and forwarded message, e.g. to keep an audit log. Nil disables auditing.
+	AuditHook func(event AuditEvent)
+	// Amount of audit events queued for a slow AuditHook before further events are dropped. Defaults to 256.
+	AuditBufferSize int
+
+	// Called with a copy of each message written to a client, e.g. to debug handshakes. It is called in order from a
+	// separate goroutine, messages are dropped while it is behind.
+	OnOutbound func(message api.Message)
+
+	// Time a member whose connection closed without exiting is kept, so that it can reconnect with the same mac.
+	// Collected members leave all of their communities then. Defaults to one minute.
+	DisconnectTimeout time.Duration
+	// Interval in which RunGC collects the members whose connection closed. Defaults to DisconnectTimeout.
+	GCInterval time.Duration
+	// Treat a closed connection like an exit, so that its members leave their communities right away instead of being
+	// kept for DisconnectTimeout. Clients can't reconnect with the same mac then.
+	ExitOnClose bool
+	// Time the reconnect token of an acceptance is valid, with which the mac can resume its memberships on a new
+	// connection without applying again. Defaults to one hour.
+	ReconnectTokenTTL time.Duration
+	// Clock used for the timeouts and intervals. Nil uses the real time.
+	Clock clock.Clock
+
+	// Maximum duration of a single write to a client. Defaults to config.DefaultWriteTimeout.
+	WriteTimeout time.Duration
+}
+
+func (c CommunitiesManagerConfig) auditBufferSize() int {
+	if c.AuditBufferSize > 0 {
+		return c.AuditBufferSize
+	}
+
+	return 256
+}
+
+func (c CommunitiesManagerConfig) disconnectTimeout() time.Duration {
+	if c.DisconnectTimeout > 0 {
+		return c.DisconnectTimeout
+	}
+
+	return time.Minute
+}
+
+func (c CommunitiesManagerConfig) gcInterval() time.Duration {
+	if c.GCInterval > 0 {
+		return c.GCInterval
+	}
+
+	return c.disconnectTimeout()
+}
+
+func (c CommunitiesManagerConfig) reconnectTokenTTL() time.Duration {
+	if c.ReconnectTokenTTL > 0 {
+		return c.ReconnectTokenTTL
+	}
+
+	return time.Hour
+}
+
+func (c CommunitiesManagerConfig) clock() clock.Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+
+	return clock.Real{}
+}
+
+func (c CommunitiesManagerConfig) presenceInterval() time.Duration {
+	if c.PresenceInterval > 0 {
+		return c.PresenceInterval
+	}
+
+	return 100 * time.Millisecond
+}
+
+func (c CommunitiesManagerConfig) maxRelayRate() int {
+	if c.MaxRelayRate > 0 {
+		return c.MaxRelayRate
+	}
+
+	return 10
+}
+
+func (c CommunitiesManagerConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout > 0 {
+		return c.WriteTimeout
+	}
+
+	return config.DefaultWriteTimeout
+}
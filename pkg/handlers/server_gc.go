@@ -0,0 +1,63 @@
+package handlers
+
+import "context"
+
+// RunGC periodically collects the members whose connection closed without exiting until the context is done,
+// so that communities of crashed clients don't linger
+func (m *CommunitiesManager) RunGC(ctx context.Context) {
+	timer := m.config.clock().NewTimer(m.config.gcInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			m.CollectGarbage()
+
+			timer.Reset(m.config.gcInterval())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CollectGarbage removes the members whose connection closed longer than DisconnectTimeout ago from all of their
+// communities, notifying the remaining members. Empty communities are dropped, as are challenges which were not answered
+// within DisconnectTimeout. It returns the first failed notification.
+func (m *CommunitiesManager) CollectGarbage() error {
+	m.lock.Lock()
+
+	now := m.config.clock().Now()
+
+	resignations := []notification{}
+	for mac, closed := range m.disconnected {
+		if now.Sub(closed) < m.config.disconnectTimeout() {
+			continue
+		}
+
+		resignations = append(resignations, m.collect(mac)...)
+	}
+
+	for key, pending := range m.challenges {
+		if now.Sub(pending.issued) >= m.config.disconnectTimeout() {
+			delete(m.challenges, key)
+		}
+	}
+	m.lock.Unlock()
+
+	return m.notify(resignations...)
+}
+
+// collect lets a member which did not exit leave all of its communities and forgets it, returning the resignations
+// to the remaining members
+func (m *CommunitiesManager) collect(mac string) []notification {
+	resignations := []notification{}
+	for _, community := range m.getCommunities(mac) {
+		resignations = append(resignations, m.exitCommunity(community, mac)...)
+
+		m.audit(AuditExit, community, mac, "")
+	}
+
+	m.forget(mac)
+
+	return resignations
+}
@@ -2,170 +2,931 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/alphahorizonio/libentangle/internal/tap"
+	"github.com/alphahorizonio/libentangle/internal/writes"
 	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/google/uuid"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 type CommunitiesManager struct {
 	lock sync.Mutex
 
 	communities map[string][]string
-	macs        map[string]websocket.Conn
+	macs        map[string]Conn
+	// Reverse index of macs, the macs each open connection applied with
+	owners map[Conn]map[string]struct{}
 
-	introducedPeers [][2]string
+	introducedPeers map[string][][2]string
+
+	// Nonces sent to applicants which have not answered their challenge yet
+	challenges map[challenge]pendingChallenge
+
+	// Macs whose connection closed without exiting with the time it closed, and the communities they can apply for again after reconnecting
+	disconnected map[string]time.Time
+	reattaching  map[string]map[string]bool
+
+	// Time of the last relayed presence update of each member, keyed by community and mac
+	presences map[[2]string]time.Time
+	// Start of the current one second window of each member's relayed messages, and the amount relayed in it
+	relays map[string]relayWindow
+	// Closed once the last relayed write to each connection is done, which the next one waits for, so that relayed
+	// messages arrive in the order they were handled even if their senders are handled concurrently
+	relayTails map[Conn]chan struct{}
+
+	// Macs which may not apply for a community, keyed by community and mac
+	bans map[[2]string]struct{}
+
+	// Idempotency keys of the accepted applications, keyed by community and mac
+	applications map[[2]string]string
+	// Latest reconnect token issued to each mac
+	tokens map[string]reconnectToken
+
+	// Introduced pairs which have not exchanged an answer yet
+	handshakes map[[2]string]struct{}
+	draining   bool
+	drained    chan struct{}
+
+	auditLock    sync.Mutex
+	auditEvents  chan AuditEvent
+	auditStopped bool
+	auditDropped uint64
+
+	outbound *tap.Tap
+
+	config CommunitiesManagerConfig
+}
+
+type relayWindow struct {
+	start time.Time
+	count int
+}
+
+type reconnectToken struct {
+	token   string
+	expires time.Time
+}
+
+type challenge struct {
+	conn      Conn
+	community string
+	mac       string
+}
+
+type pendingChallenge struct {
+	nonce  []byte
+	issued time.Time
 }
 
 func NewCommunitiesManager() *CommunitiesManager {
+	return NewCommunitiesManagerWithConfig(CommunitiesManagerConfig{})
+}
+
+func NewCommunitiesManagerWithConfig(config CommunitiesManagerConfig) *CommunitiesManager {
 	return &CommunitiesManager{
-		communities: map[string][]string{},
-		macs:        map[string]websocket.Conn{},
+		communities:     map[string][]string{},
+		macs:            map[string]Conn{},
+		owners:          map[Conn]map[string]struct{}{},
+		introducedPeers: map[string][][2]string{},
+		challenges:      map[challenge]pendingChallenge{},
+		handshakes:      map[[2]string]struct{}{},
+		disconnected:    map[string]time.Time{},
+		reattaching:     map[string]map[string]bool{},
+		presences:       map[[2]string]time.Time{},
+		relays:          map[string]relayWindow{},
+		relayTails:      map[Conn]chan struct{}{},
+		bans:            map[[2]string]struct{}{},
+		applications:    map[[2]string]string{},
+		tokens:          map[string]reconnectToken{},
+		outbound:        tap.New(config.OnOutbound),
+		config:          config,
 	}
 }
 
-func (m *CommunitiesManager) HandleApplication(application api.Application, conn *websocket.Conn) error {
+func (m *CommunitiesManager) HandleApplication(application api.Application, conn Conn) error {
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	replies, err := m.apply(application, conn)
+	m.lock.Unlock()
 
-	if _, ok := m.macs[application.Mac]; ok {
-		// Send rejection. That mac is already contained
-		if err := wsjson.Write(context.Background(), conn, api.NewRejection()); err != nil {
-			return err
+	if err != nil {
+		return err
+	}
+
+	return m.notify(replies...)
+}
+
+// apply handles an application and returns the replies to the applicant. It has to be called with the lock held.
+func (m *CommunitiesManager) apply(application api.Application, conn Conn) ([]notification, error) {
+	if m.draining {
+		m.audit(AuditReject, application.Community, application.Mac, "")
+
+		return []notification{{conn, api.NewRejectionWithReason(api.RejectionDraining)}}, nil
+	}
+
+	// The proof is bound to the mac the applicant chose
+	applied := application.Mac
+	if m.config.AssignMacs {
+		application.Mac = m.assignMac(conn)
+	}
+
+	if _, banned := m.bans[[2]string{application.Community, application.Mac}]; banned {
+		m.audit(AuditReject, application.Community, application.Mac, "")
+
+		return []notification{{conn, api.NewRejectionWithReason(api.RejectionBanned)}}, nil
+	}
+
+	if secret, ok := m.config.Secrets[application.Community]; ok {
+		key := challenge{conn, application.Community, applied}
+
+		if len(application.Proof) == 0 {
+			nonce := make([]byte, 32)
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+
+			m.challenges[key] = pendingChallenge{nonce, m.config.clock().Now()}
+
+			return []notification{{conn, api.NewChallenge(application.Community, nonce)}}, nil
 		}
 
-		return nil
+		// Each nonce can only be answered once
+		pending, challenged := m.challenges[key]
+		delete(m.challenges, key)
+
+		if !challenged || !api.VerifyProof(secret, pending.nonce, application.Community, applied, application.Proof) {
+			m.audit(AuditReject, application.Community, application.Mac, "")
+
+			return []notification{{conn, api.NewRejection()}}, nil
+		}
 	}
 
-	m.macs[application.Mac] = *conn
+	membership := [2]string{application.Community, application.Mac}
+
+	// A retried application which was already accepted, e.g. if the client's write failed after it was sent, doesn't register the mac twice
+	if application.Key != "" && m.applications[membership] == application.Key {
+		// The acceptance was already sent on this connection
+		if m.macs[application.Mac] == conn {
+			return nil, nil
+		}
+
+		// The client sent it again on a new connection, which takes over the one it left behind
+		m.reattach(application.Mac, conn)
+	}
+
+	// A client reconnecting with the same mac takes over the memberships of its closed connection
+	if _, disconnected := m.disconnected[application.Mac]; disconnected && m.macs[application.Mac] != conn {
+		m.reattach(application.Mac, conn)
+	}
+
+	if m.reattaching[application.Mac][application.Community] {
+		m.applications[membership] = application.Key
+
+		acceptance, err := m.rejoin(application.Community, application.Mac, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		return []notification{acceptance}, nil
+	}
+
+	if existing, ok := m.macs[application.Mac]; ok && (existing != conn || m.isMember(application.Community, application.Mac)) {
+		// Send rejection. That mac is already contained
+		m.audit(AuditReject, application.Community, application.Mac, "")
+
+		return []notification{{conn, api.NewRejection()}}, nil
+	}
+
+	if _, ok := m.communities[application.Community]; !ok && m.config.MaxCommunities > 0 && len(m.communities) >= m.config.MaxCommunities {
+		m.audit(AuditReject, application.Community, application.Mac, "")
+
+		return []notification{{conn, api.NewRejectionWithReason(api.RejectionCommunityLimit)}}, nil
+	}
+
+	// A mac which is already known on this connection joins another community
+	m.own(application.Mac, conn)
+	m.applications[membership] = application.Key
+
+	m.audit(AuditJoin, application.Community, application.Mac, "")
 
 	// Check if community exists
 	if _, ok := m.communities[application.Community]; ok {
+		// Let the new member know which peers to expect
+		members := append([]string{}, m.communities[application.Community]...)
+
 		m.communities[application.Community] = append(m.communities[application.Community], application.Mac)
 
-		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance()); err != nil {
-			return err
+		acceptance, err := m.accept(conn, application.Community, application.Mac, members...)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil
+		return []notification{acceptance}, nil
 	} else {
 		// Community does not exist. Create commuity and insert mac
 		m.communities[application.Community] = append(m.communities[application.Community], application.Mac)
 
-		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance()); err != nil {
+		acceptance, err := m.accept(conn, application.Community, application.Mac)
+		if err != nil {
+			return nil, err
+		}
+
+		return []notification{acceptance}, nil
+	}
+
+}
+
+// HandleReconnect resumes the memberships of a mac on a new connection if it presents the unexpired token of its latest
+// acceptance, which takes over its previous connection. It is accepted to each of its communities again.
+func (m *CommunitiesManager) HandleReconnect(reconnect api.Reconnect, conn Conn) error {
+	m.lock.Lock()
+
+	issued, ok := m.tokens[reconnect.Mac]
+	if !ok || subtle.ConstantTimeCompare([]byte(issued.token), []byte(reconnect.Token)) != 1 || !m.config.clock().Now().Before(issued.expires) {
+		m.audit(AuditReject, "", reconnect.Mac, "")
+		m.lock.Unlock()
+
+		return m.write(conn, api.NewRejectionWithReason(api.RejectionInvalidToken))
+	}
+
+	m.reattach(reconnect.Mac, conn)
+
+	communities := m.getCommunities(reconnect.Mac)
+	sort.Strings(communities)
+
+	acceptances := []notification{}
+	for _, community := range communities {
+		acceptance, err := m.rejoin(community, reconnect.Mac, conn)
+		if err != nil {
+			m.lock.Unlock()
+
 			return err
 		}
 
-		return nil
+		acceptances = append(acceptances, acceptance)
 	}
+	m.lock.Unlock()
 
+	return m.notify(acceptances...)
 }
 
-func (m *CommunitiesManager) HandleReady(ready api.Ready, conn *websocket.Conn) error {
+func (m *CommunitiesManager) HandleReady(ready api.Ready, conn Conn) error {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 
-	community, err := m.getCommunity(ready.Mac)
-	if err != nil {
-		return err
+	// Only the connection which applied with a mac may announce it, so that introductions can't be triggered on behalf of other peers
+	if _, ok := m.macs[ready.Mac]; ok && !m.owns(conn, ready.Mac) {
+		m.lock.Unlock()
+
+		return errors.New("This mac does not belong to this connection!")
 	}
 
-	// Broadcast the introduction to all connections, excluding our own
-	for _, mac := range m.communities[community] {
-		if mac != ready.Mac {
-			receiver := m.macs[mac]
+	community := ready.Community
+	if community == "" {
+		var err error
+		community, err = m.getCommunity(ready.Mac)
+		if err != nil {
+			m.lock.Unlock()
+
+			return err
+		}
+	} else if !m.isMember(community, ready.Mac) {
+		m.lock.Unlock()
 
-			if !m.introduced(ready.Mac, mac) {
-				if err := wsjson.Write(context.Background(), &receiver, api.NewIntroduction(ready.Mac)); err != nil {
-					return err
-				}
+		return errors.New("This mac is not part of this community!")
+	}
+
+	// Pick the connections to introduce to, excluding our own.
+	// Members are introduced in ascending order of their macs, so that the order is the same across runs.
+	members := append([]string{}, m.communities[community]...)
+	sort.Strings(members)
+
+	macs := []string{}
+	receivers := []Conn{}
+	for _, mac := range members {
+		if mac != ready.Mac {
+			if !m.introduced(community, ready.Mac, mac) {
+				macs = append(macs, mac)
+				receivers = append(receivers, m.macs[mac])
 
-				m.introduce(ready.Mac, mac)
+				m.introduce(community, ready.Mac, mac)
 			}
 		} else {
 			continue
 		}
 	}
 
+	m.audit(AuditReady, community, ready.Mac, "")
+
+	m.lock.Unlock()
+
+	if m.config.IntroductionSpacing <= 0 {
+		return m.introduceAll(community, ready.Mac, macs, receivers)
+	}
+
+	// Staggered introductions are sent in the background so that they don't hold up the ready member's connection
+	go m.introduceAll(community, ready.Mac, macs, receivers)
+
 	return nil
 }
 
+// introduceAll sends the introduction of mac to the receivers, waiting IntroductionSpacing between each of them
+func (m *CommunitiesManager) introduceAll(community string, mac string, macs []string, receivers []Conn) error {
+	// Broadcast the introduction without blocking other community operations
+	var firstErr error
+	for i, receiver := range receivers {
+		if i > 0 && m.config.IntroductionSpacing > 0 {
+			<-m.config.clock().After(m.config.IntroductionSpacing)
+		}
+
+		if err := m.write(receiver, api.NewIntroduction(mac, community)); err != nil {
+			// Allow the introduction to be retried, unless the receiver left in the meantime
+			m.lock.Lock()
+			m.removePair(community, mac, macs[i])
+			m.lock.Unlock()
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
 func (m *CommunitiesManager) HandleOffer(offer api.Offer) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	// The sender might have given up on a message which was delayed, e.g. while the server was overloaded
+	if offer.Expired(m.config.clock().Now()) {
+		return &MessageExpired{offer.Opcode, offer.SenderMac}
+	}
 
-	receiver := m.macs[offer.ReceiverMac]
+	receiver, err := m.getReceiver(offer.ReceiverMac)
+	if err != nil {
+		return err
+	}
 
-	if err := wsjson.Write(context.Background(), &receiver, offer); err != nil {
+	if err := m.write(receiver, offer); err != nil {
 		return err
 	}
 
+	m.audit(AuditOffer, offer.Community, offer.SenderMac, offer.ReceiverMac)
+
 	return nil
 }
 
 func (m *CommunitiesManager) HandleAnswer(answer api.Answer) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	if answer.Expired(m.config.clock().Now()) {
+		return &MessageExpired{answer.Opcode, answer.SenderMac}
+	}
 
-	receiver := m.macs[answer.ReceiverMac]
+	receiver, err := m.getReceiver(answer.ReceiverMac)
+	if err != nil {
+		return err
+	}
 
-	if err := wsjson.Write(context.Background(), &receiver, answer); err != nil {
+	if err := m.write(receiver, answer); err != nil {
 		return err
 	}
 
+	m.audit(AuditAnswer, "", answer.SenderMac, answer.ReceiverMac)
+
+	m.lock.Lock()
+	m.completeHandshake(answer.SenderMac, answer.ReceiverMac)
+	m.lock.Unlock()
+
 	return nil
 }
 
 func (m *CommunitiesManager) HandleCandidate(candidate api.Candidate) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	if candidate.Expired(m.config.clock().Now()) {
+		return &MessageExpired{candidate.Opcode, candidate.SenderMac}
+	}
 
-	receiver := m.macs[candidate.ReceiverMac]
+	receiver, err := m.getReceiver(candidate.ReceiverMac)
+	if err != nil {
+		return err
+	}
 
-	if err := wsjson.Write(context.Background(), &receiver, candidate); err != nil {
+	if err := m.write(receiver, candidate); err != nil {
 		return err
 	}
 
+	m.audit(AuditCandidate, "", candidate.SenderMac, candidate.ReceiverMac)
+
 	return nil
 }
 
-func (m *CommunitiesManager) HandleExited(exited api.Exited) error {
+// HandlePresence relays the presence update of a member to the other members of its community.
+// Updates following the previous one sooner than PresenceInterval are dropped.
+func (m *CommunitiesManager) HandlePresence(presence api.Presence) error {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 
-	community, err := m.getCommunity(exited.Mac)
-	if err != nil {
-		return err
+	if !m.isMember(presence.Community, presence.Mac) {
+		m.lock.Unlock()
+
+		return errors.New("This mac is not part of this community!")
 	}
 
-	m.removeAssociatedPairs(exited.Mac)
+	key := [2]string{presence.Community, presence.Mac}
+	now := m.config.clock().Now()
+	if last, ok := m.presences[key]; ok && now.Sub(last) < m.config.presenceInterval() {
+		m.lock.Unlock()
 
-	for _, mac := range m.communities[community] {
-		if mac != exited.Mac {
-			receiver := m.macs[mac]
+		return errors.New("Presence updates are sent too often!")
+	}
+	m.presences[key] = now
+
+	receivers := []Conn{}
+	for _, mac := range m.communities[presence.Community] {
+		if mac != presence.Mac {
+			receivers = append(receivers, m.macs[mac])
+		}
+	}
+
+	m.audit(AuditPresence, presence.Community, presence.Mac, "")
 
-			if err := wsjson.Write(context.Background(), &receiver, api.NewResignation(exited.Mac)); err != nil {
-				return err
+	m.lock.Unlock()
+
+	var firstErr error
+	for _, receiver := range receivers {
+		if err := m.write(receiver, presence); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// HandleRelay forwards a message between two members of a community, e.g. before their data channel is open.
+// Messages exceeding MaxRelayRate are dropped.
+func (m *CommunitiesManager) HandleRelay(relay api.Relay) error {
+	now := m.config.clock().Now()
+	if relay.Expired(now) {
+		return &MessageExpired{relay.Opcode, relay.SenderMac}
+	}
+
+	m.lock.Lock()
+
+	shared := false
+	for _, community := range m.getCommunities(relay.SenderMac) {
+		if m.isMember(community, relay.ReceiverMac) {
+			shared = true
+
+			break
+		}
+	}
+
+	if !shared {
+		m.lock.Unlock()
+
+		return errors.New("These macs are not part of the same community!")
+	}
+
+	window := m.relays[relay.SenderMac]
+	if now.Sub(window.start) >= time.Second {
+		window = relayWindow{start: now}
+	}
+
+	if window.count >= m.config.maxRelayRate() {
+		m.lock.Unlock()
+
+		return errors.New("Relayed messages are sent too often!")
+	}
+	window.count++
+	m.relays[relay.SenderMac] = window
+
+	receiver := m.macs[relay.ReceiverMac]
+
+	m.audit(AuditRelay, "", relay.SenderMac, relay.ReceiverMac)
+
+	previous := m.relayTails[receiver]
+	done := make(chan struct{})
+	m.relayTails[receiver] = done
+
+	m.lock.Unlock()
+
+	defer close(done)
+
+	if previous != nil {
+		<-previous
+	}
+
+	err := m.write(receiver, relay)
+
+	m.lock.Lock()
+	if m.relayTails[receiver] == done {
+		delete(m.relayTails, receiver)
+	}
+	m.lock.Unlock()
+
+	return err
+}
+
+// HandleRepeer introduces the sender to the receiver again, so that the receiver replaces its connection to the sender,
+// which failed on the sender's side, with a new handshake
+func (m *CommunitiesManager) HandleRepeer(repeer api.Repeer, conn Conn) error {
+	m.lock.Lock()
+
+	// Only the connection which applied with a mac may ask for it, so that connections can't be torn down on behalf of other peers
+	if !m.owns(conn, repeer.SenderMac) {
+		m.lock.Unlock()
+
+		return errors.New("This mac does not belong to this connection!")
+	}
+
+	community := repeer.Community
+	if community == "" || !m.isMember(community, repeer.SenderMac) || !m.isMember(community, repeer.ReceiverMac) {
+		community = ""
+		for _, candidate := range m.getCommunities(repeer.SenderMac) {
+			if m.isMember(candidate, repeer.ReceiverMac) {
+				community = candidate
+
+				break
 			}
-		} else {
+		}
+	}
+
+	if community == "" {
+		m.lock.Unlock()
+
+		return errors.New("These macs are not part of the same community!")
+	}
+
+	receiver := m.macs[repeer.ReceiverMac]
+
+	m.audit(AuditRepeer, community, repeer.SenderMac, repeer.ReceiverMac)
+
+	m.lock.Unlock()
+
+	introduction := api.NewIntroduction(repeer.SenderMac, community)
+	introduction.Repeer = true
+
+	return m.write(receiver, introduction)
+}
+
+// HandleClosed remembers the macs of a closed connection which did not exit, so that they can reconnect.
+// With ExitOnClose, they leave their communities right away instead.
+func (m *CommunitiesManager) HandleClosed(conn Conn) {
+	m.lock.Lock()
+
+	resignations := []notification{}
+	for mac := range m.owners[conn] {
+		m.audit(AuditClosed, "", mac, "")
+
+		if m.config.ExitOnClose {
+			resignations = append(resignations, m.collect(mac)...)
+
 			continue
 		}
+
+		m.disconnected[mac] = m.config.clock().Now()
+	}
+
+	// The macs keep referring to the closed connection until they reconnect or are collected
+	delete(m.owners, conn)
+
+	// Challenges are bound to the connection they were sent on, so they can't be answered anymore
+	for key := range m.challenges {
+		if key.conn == conn {
+			delete(m.challenges, key)
+		}
 	}
+	m.lock.Unlock()
 
-	// Remove this peer from all maps
-	delete(m.macs, exited.Mac)
-	delete(m.macs, exited.Mac)
+	// Failed resignations are not ours to handle, the connections of their receivers fail on their own
+	m.notify(resignations...)
+}
+
+func (m *CommunitiesManager) reattach(mac string, conn Conn) {
+	m.own(mac, conn)
+	delete(m.disconnected, mac)
+
+	communities := map[string]bool{}
+	for _, community := range m.getCommunities(mac) {
+		communities[community] = true
+	}
+	m.reattaching[mac] = communities
+}
+
+// rejoin accepts a reattached mac to one of its communities again
+func (m *CommunitiesManager) rejoin(community string, mac string, conn Conn) (notification, error) {
+	delete(m.reattaching[mac], community)
+
+	// Peers have to be introduced again, as the client might have lost its connections to them
+	m.removeAssociatedPairs(community, mac)
+
+	members := []string{}
+	for _, member := range m.communities[community] {
+		if member != mac {
+			members = append(members, member)
+		}
+	}
+
+	m.audit(AuditJoin, community, mac, "")
+
+	return m.accept(conn, community, mac, members...)
+}
+
+// accept returns an acceptance with a new reconnect token, which replaces the one issued to the mac before
+func (m *CommunitiesManager) accept(conn Conn, community string, mac string, members ...string) (notification, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return notification{}, err
+	}
+
+	acceptance := api.NewAcceptance(community, members...)
+	acceptance.Token = base64.RawURLEncoding.EncodeToString(token)
+
+	if m.config.AssignMacs {
+		acceptance.Mac = mac
+	}
+
+	m.tokens[mac] = reconnectToken{acceptance.Token, m.config.clock().Now().Add(m.config.reconnectTokenTTL())}
+
+	return notification{conn, acceptance}, nil
+}
+
+// Snapshots the connection of a mac, so that writes to it happen outside of the lock
+func (m *CommunitiesManager) getReceiver(mac string) (Conn, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	receiver, ok := m.macs[mac]
+	if !ok {
+		return nil, errors.New("This mac is not connected!")
+	}
+
+	return receiver, nil
+}
+
+// Drain stops accepting new applications and waits until the handshakes of the introduced peers are complete,
+// so that the signaling server can be restarted without breaking them. Existing peers keep being served, but the
+// AuditHook is only called with the events queued until it returns.
+func (m *CommunitiesManager) Drain(ctx context.Context) error {
+	defer m.stopAudit()
+
+	m.lock.Lock()
+	m.draining = true
+
+	drained := m.drained
+	if drained == nil {
+		drained = make(chan struct{})
+		if len(m.handshakes) == 0 {
+			close(drained)
+		} else {
+			m.drained = drained
+		}
+	}
+	m.lock.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if !m.config.NotifyOnDrain {
+		return nil
+	}
+
+	m.lock.Lock()
+	receivers := []Conn{}
+	for _, conn := range m.macs {
+		receivers = append(receivers, conn)
+	}
+	m.lock.Unlock()
+
+	var firstErr error
+	for _, receiver := range receivers {
+		if err := m.write(receiver, api.NewDraining()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m *CommunitiesManager) HandleExited(exited api.Exited) error {
+	m.lock.Lock()
+
+	communities := []string{exited.Community}
+	if exited.Community == "" {
+		communities = m.getCommunities(exited.Mac)
+		if len(communities) == 0 {
+			m.lock.Unlock()
+
+			return errors.New("This mac is not part of any community so far!")
+		}
+	} else if !m.isMember(exited.Community, exited.Mac) {
+		m.lock.Unlock()
+
+		return errors.New("This mac is not part of this community!")
+	}
+
+	resignations := []notification{}
+	for _, community := range communities {
+		delete(m.reattaching[exited.Mac], community)
+
+		resignations = append(resignations, m.exitCommunity(community, exited.Mac)...)
+
+		m.audit(AuditExit, community, exited.Mac, "")
+	}
+
+	// Remove this peer from all maps, unless it only left a single community and is still part of another one
+	if _, err := m.getCommunity(exited.Mac); exited.Community == "" || err != nil {
+		m.forget(exited.Mac)
+	}
+	m.lock.Unlock()
+
+	// A failed resignation must not keep the other members from being notified, so the first error is returned at the end
+	return m.notify(resignations...)
+}
+
+// Kick removes a mac from a community, notifying the remaining members, and closes its connection with StatusPolicyViolation.
+// Its memberships in other communities are kept until they are collected, as with any closed connection. It can apply again unless it is banned.
+func (m *CommunitiesManager) Kick(community string, mac string) error {
+	m.lock.Lock()
+
+	if !m.isMember(community, mac) {
+		m.lock.Unlock()
+
+		return errors.New("This mac is not part of this community!")
+	}
+
+	conn := m.macs[mac]
+
+	delete(m.reattaching[mac], community)
+
+	resignations := m.exitCommunity(community, mac)
+
+	m.audit(AuditKick, community, mac, "")
+
+	if _, err := m.getCommunity(mac); err != nil {
+		m.forget(mac)
+	}
+	m.lock.Unlock()
+
+	err := m.notify(resignations...)
+
+	// Closing waits for the client to acknowledge, so it must not block the other handlers
+	if conn != nil {
+		conn.Close(websocket.StatusPolicyViolation, "Kicked from community "+community)
+	}
+
+	return err
+}
+
+// Ban keeps a mac from applying for a community until it is unbanned, kicking it if it is a member
+func (m *CommunitiesManager) Ban(community string, mac string) error {
+	m.lock.Lock()
+	m.bans[[2]string{community, mac}] = struct{}{}
+	member := m.isMember(community, mac)
+	m.lock.Unlock()
+
+	if !member {
+		return nil
+	}
+
+	return m.Kick(community, mac)
+}
+
+// Unban allows a banned mac to apply for a community again
+func (m *CommunitiesManager) Unban(community string, mac string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.bans, [2]string{community, mac})
+}
+
+// Communities returns the names of the communities with at least one member, in ascending order
+func (m *CommunitiesManager) Communities() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	communities := []string{}
+	for community := range m.communities {
+		communities = append(communities, community)
+	}
+	sort.Strings(communities)
+
+	return communities
+}
+
+// MeshPair is a pair of members of a community which were introduced to each other
+type MeshPair struct {
+	// The member which announced that it is ready and the one it was introduced to
+	ReadyMac      string
+	IntroducedMac string
+	// Whether their handshake is still in progress, i.e. no answer was forwarded between them yet
+	Pending bool
+}
+
+// MeshState returns the introduced pairs of a community in the order of their introduction, so that the progress
+// of the mesh formation can be monitored
+func (m *CommunitiesManager) MeshState(community string) []MeshPair {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	pairs := []MeshPair{}
+	for _, pair := range m.introducedPeers[community] {
+		_, pending := m.handshakes[handshakeKey(pair[0], pair[1])]
+
+		pairs = append(pairs, MeshPair{pair[0], pair[1], pending})
+	}
+
+	return pairs
+}
+
+// own maps a mac to the connection it applied on, moving it from the connection it used before
+func (m *CommunitiesManager) own(mac string, conn Conn) {
+	m.disown(mac)
+
+	m.macs[mac] = conn
+
+	if _, ok := m.owners[conn]; !ok {
+		m.owners[conn] = map[string]struct{}{}
+	}
+	m.owners[conn][mac] = struct{}{}
+}
+
+func (m *CommunitiesManager) disown(mac string) {
+	previous, ok := m.macs[mac]
+	if !ok {
+		return
+	}
+
+	delete(m.owners[previous], mac)
+	if len(m.owners[previous]) == 0 {
+		delete(m.owners, previous)
+	}
+}
+
+// assignMac returns the mac of a connection which was already accepted, or a new one
+func (m *CommunitiesManager) assignMac(conn Conn) string {
+	for mac := range m.owners[conn] {
+		return mac
+	}
+
+	return uuid.NewString()
+}
+
+func (m *CommunitiesManager) owns(conn Conn, mac string) bool {
+	_, ok := m.owners[conn][mac]
+
+	return ok
+}
+
+func (m *CommunitiesManager) forget(mac string) {
+	m.disown(mac)
+	delete(m.macs, mac)
+	delete(m.disconnected, mac)
+	delete(m.reattaching, mac)
+	delete(m.relays, mac)
+	delete(m.tokens, mac)
+
+	for key := range m.challenges {
+		if key.mac == mac {
+			delete(m.challenges, key)
+		}
+	}
+}
+
+// exitCommunity removes a member from a community and returns the resignations to the remaining members
+func (m *CommunitiesManager) exitCommunity(community string, exitedMac string) []notification {
+	m.removeAssociatedPairs(community, exitedMac)
+	delete(m.presences, [2]string{community, exitedMac})
+	delete(m.applications, [2]string{community, exitedMac})
 
 	// Remove member from community
-	m.communities[community] = m.deleteCommunity(m.communities[community], exited.Mac)
+	m.communities[community] = m.deleteCommunity(m.communities[community], exitedMac)
 
 	if len(m.communities[community]) == 0 {
 		delete(m.communities, community)
+		delete(m.introducedPeers, community)
 	}
 
-	return nil
+	resignations := []notification{}
+	for _, mac := range m.communities[community] {
+		resignations = append(resignations, notification{m.macs[mac], api.NewResignation(exitedMac, community)})
+	}
+
+	return resignations
+}
+
+func (m *CommunitiesManager) isMember(community string, mac string) bool {
+	for _, member := range m.communities[community] {
+		if member == mac {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (m *CommunitiesManager) getCommunity(mac string) (string, error) {
@@ -180,6 +941,17 @@ func (m *CommunitiesManager) getCommunity(mac string) (string, error) {
 	return "", errors.New("This mac is not part of any community so far!")
 }
 
+func (m *CommunitiesManager) getCommunities(mac string) []string {
+	communities := []string{}
+	for community := range m.communities {
+		if m.isMember(community, mac) {
+			communities = append(communities, community)
+		}
+	}
+
+	return communities
+}
+
 func (m *CommunitiesManager) deleteCommunity(s []string, str string) []string {
 	var elementIndex int
 	for index, element := range s {
@@ -190,12 +962,34 @@ func (m *CommunitiesManager) deleteCommunity(s []string, str string) []string {
 	return append(s[:elementIndex], s[elementIndex+1:]...)
 }
 
-func (m *CommunitiesManager) introduce(firstMac string, secondMac string) {
-	m.introducedPeers = append(m.introducedPeers, [2]string{firstMac, secondMac})
+func (m *CommunitiesManager) introduce(community string, firstMac string, secondMac string) {
+	m.introducedPeers[community] = append(m.introducedPeers[community], [2]string{firstMac, secondMac})
+
+	m.handshakes[handshakeKey(firstMac, secondMac)] = struct{}{}
+}
+
+// completeHandshake forgets a pending handshake and lets Drain return once the last one is done
+func (m *CommunitiesManager) completeHandshake(firstMac string, secondMac string) {
+	delete(m.handshakes, handshakeKey(firstMac, secondMac))
+
+	if m.drained != nil && len(m.handshakes) == 0 {
+		close(m.drained)
+
+		m.drained = nil
+	}
+}
+
+// Both peers can send the offer, so a handshake is identified by its pair of macs regardless of their order
+func handshakeKey(firstMac string, secondMac string) [2]string {
+	if firstMac > secondMac {
+		return [2]string{secondMac, firstMac}
+	}
+
+	return [2]string{firstMac, secondMac}
 }
 
-func (m *CommunitiesManager) introduced(firstMac string, secondMac string) bool {
-	for _, pair := range m.introducedPeers {
+func (m *CommunitiesManager) introduced(community string, firstMac string, secondMac string) bool {
+	for _, pair := range m.introducedPeers[community] {
 		if pair[0] == firstMac && pair[1] == secondMac {
 			return true
 		}
@@ -206,16 +1000,62 @@ func (m *CommunitiesManager) introduced(firstMac string, secondMac string) bool
 	return false
 }
 
-func (m *CommunitiesManager) removeAssociatedPairs(mac string) {
+func (m *CommunitiesManager) removePair(community string, firstMac string, secondMac string) {
+	if _, ok := m.introducedPeers[community]; !ok {
+		return
+	}
+
+	newSlice := make([][2]string, 0)
+
+	for _, pair := range m.introducedPeers[community] {
+		if (pair[0] == firstMac && pair[1] == secondMac) || (pair[0] == secondMac && pair[1] == firstMac) {
+			m.completeHandshake(firstMac, secondMac)
+
+			continue
+		} else {
+			newSlice = append(newSlice, pair)
+		}
+	}
+
+	m.introducedPeers[community] = newSlice
+}
+
+func (m *CommunitiesManager) removeAssociatedPairs(community string, mac string) {
 	newSlice := make([][2]string, 0)
 
-	for _, pair := range m.introducedPeers {
+	for _, pair := range m.introducedPeers[community] {
 		if pair[0] == mac || pair[1] == mac {
+			// A peer which left won't answer anymore
+			m.completeHandshake(pair[0], pair[1])
+
 			continue
 		} else {
 			newSlice = append(newSlice, pair)
 		}
 	}
 
-	m.introducedPeers = newSlice
+	m.introducedPeers[community] = newSlice
+}
+
+// notification is a message which is written once the lock is released, so that a slow receiver can't hold up the other handlers
+type notification struct {
+	receiver Conn
+	message  interface{}
+}
+
+// notify writes the notifications in order. The member a write fails for is not ours to handle, so the remaining
+// notifications are written anyway and the first error is returned.
+func (m *CommunitiesManager) notify(notifications ...notification) error {
+	var firstErr error
+	for _, n := range notifications {
+		if err := m.write(n.receiver, n.message); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m *CommunitiesManager) write(conn Conn, v interface{}) error {
+	return writes.WithTimeout(conn, m.config.writeTimeout(), v, m.outbound)
 }
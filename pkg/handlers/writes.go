@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"context"
+
+	"nhooyr.io/websocket"
+)
+
+// Conn is the subset of *websocket.Conn used by the handlers, so that they can be tested without a network connection
+type Conn interface {
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Read(ctx context.Context) (websocket.MessageType, []byte, error)
+	Close(code websocket.StatusCode, reason string) error
+}
@@ -0,0 +1,33 @@
+package logging
+
+// Verbosity levels of the structured loggers, from the least to the most verbose
+const (
+	LevelError = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+// LeveledLogger is implemented by loggers which can tell whether they emit the messages of a level
+type LeveledLogger interface {
+	Enabled(level int) bool
+}
+
+// Enabled reports whether a logger emits the messages of a level. Loggers which can't tell are assumed to emit all of them.
+func Enabled(l StructuredLogger, level int) bool {
+	if leveled, ok := l.(LeveledLogger); ok {
+		return leveled.Enabled(level)
+	}
+
+	return true
+}
+
+// Trace only constructs the fields of a message if the logger emits it, as trace messages are logged for every signaling message
+func Trace(l StructuredLogger, event string, fields func() map[string]interface{}) {
+	if !Enabled(l, LevelTrace) {
+		return
+	}
+
+	l.Trace(event, fields())
+}
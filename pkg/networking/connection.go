@@ -13,18 +13,26 @@ import (
 
 type ConnectionManager struct {
 	manager *handlers.ClientManager
+	client  *signaling.SignalingClient
+
+	config signaling.SignalingClientConfig
 }
 
 func NewConnectionManager(manager *handlers.ClientManager) *ConnectionManager {
+	return NewConnectionManagerWithConfig(manager, signaling.SignalingClientConfig{})
+}
+
+func NewConnectionManagerWithConfig(manager *handlers.ClientManager, config signaling.SignalingClientConfig) *ConnectionManager {
 	return &ConnectionManager{
 		manager: manager,
+		config:  config,
 	}
 }
 
 func (m *ConnectionManager) Connect(signaler string, community string, f func(msg webrtc.DataChannelMessage), l logging.StructuredLogger) {
-	client := signaling.NewSignalingClient(
-		func(conn *websocket.Conn, uuid string) error {
-			return m.manager.HandleAcceptance(conn, uuid)
+	client := signaling.NewSignalingClientWithConfig(
+		func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+			return m.manager.HandleAcceptance(conn, uuid, acceptance)
 		},
 		func(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, introduction api.Introduction) error {
 			return m.manager.HandleIntroduction(conn, uuid, wg, f, introduction)
@@ -38,12 +46,15 @@ func (m *ConnectionManager) Connect(signaler string, community string, f func(ms
 		func(candidate api.Candidate) error {
 			return m.manager.HandleCandidate(candidate)
 		},
-		func() error {
-			return m.manager.HandleResignation()
+		func(resignation api.Resignation) error {
+			return m.manager.HandleResignation(resignation)
 		},
 		l,
+		m.config,
 	)
 
+	m.client = client
+
 	go func() {
 		go client.HandleConn(signaler, community, f)
 	}()
@@ -64,3 +75,73 @@ func (m *ConnectionManager) WriteUnicast(p []byte, mac string) error {
 	}
 	return &NoConnectionEstablished{}
 }
+
+// Close exits all communities, stops handling the connection to the signaling server and closes the connections to all peers
+func (m *ConnectionManager) Close() error {
+	if m.client != nil {
+		if err := m.client.Close(); err != nil {
+			return err
+		}
+	}
+
+	return m.manager.Close()
+}
+
+// Done is closed once the connection to the signaling server is handled no more, e.g. after Close or a rejection.
+// It is nil before Connect.
+func (m *ConnectionManager) Done() <-chan struct{} {
+	if m.client == nil {
+		return nil
+	}
+
+	return m.client.Done()
+}
+
+// Err returns the reason the connection to the signaling server is handled no more once Done is closed
+func (m *ConnectionManager) Err() error {
+	if m.client == nil {
+		return &NoConnectionEstablished{}
+	}
+
+	return m.client.Err()
+}
+
+// Join applies for another community using the existing connection to the signaling server
+func (m *ConnectionManager) Join(community string) error {
+	if m.client == nil {
+		return &NoConnectionEstablished{}
+	}
+
+	return m.client.Join(community)
+}
+
+// SendPresence publishes a status such as typing or away to the other members of a community without a data channel
+func (m *ConnectionManager) SendPresence(community string, payload []byte) error {
+	if m.client == nil {
+		return &NoConnectionEstablished{}
+	}
+
+	return m.client.SendPresence(community, payload)
+}
+
+// SendRelay sends application data to another member of our communities through the signaling server, without a data channel
+func (m *ConnectionManager) SendRelay(receiver string, payload []byte) error {
+	if m.client == nil {
+		return &NoConnectionEstablished{}
+	}
+
+	return m.client.SendRelay(receiver, payload)
+}
+
+// Leave exits a single community and closes the connections to its peers while staying connected to the signaling server
+func (m *ConnectionManager) Leave(community string) error {
+	if m.client == nil {
+		return &NoConnectionEstablished{}
+	}
+
+	if err := m.client.Leave(community); err != nil {
+		return err
+	}
+
+	return m.manager.HandleLeave(community)
+}
@@ -3,41 +3,87 @@ package signaling
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/JakWai01/sile-fystem/pkg/logging"
+	"github.com/alphahorizonio/libentangle/internal/tap"
+	"github.com/alphahorizonio/libentangle/internal/writes"
 	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
 	"github.com/alphahorizonio/libentangle/pkg/config"
+	"github.com/alphahorizonio/libentangle/pkg/logging"
 	"github.com/google/uuid"
 	"github.com/pion/webrtc/v3"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 type SignalingClient struct {
-	onAcceptance   func(conn *websocket.Conn, uuid string) error
+	lock sync.Mutex
+	conn *websocket.Conn
+	uuid string
+	// Reconnect token of our latest acceptance, with which we resume our memberships after failing over
+	token string
+
+	// Closed by Close, and by handleConn once it returned
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// Closed once HandleConn returned for good, with the error it returned
+	exited   chan struct{}
+	exitOnce sync.Once
+	err      error
+
+	onAcceptance   func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error
 	onIntroduction func(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, introduction api.Introduction) error
 	onOffer        func(conn *websocket.Conn, wg *sync.WaitGroup, uuid string, offer api.Offer) error
 	onAnswer       func(wg *sync.WaitGroup, answer api.Answer) error
 	onCandidate    func(candidate api.Candidate) error
-	onResignation  func() error
+	onResignation  func(resignation api.Resignation) error
 
-	log logging.StructuredLogger
+	inbound  *tap.Tap
+	outbound *tap.Tap
+
+	log    logging.StructuredLogger
+	config SignalingClientConfig
 }
 
 func NewSignalingClient(
-	onAcceptance func(conn *websocket.Conn, uuid string) error,
+	onAcceptance func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error,
+	onIntroduction func(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, introduction api.Introduction) error,
+	onOffer func(conn *websocket.Conn, wg *sync.WaitGroup, uuid string, offer api.Offer) error,
+	onAnswer func(wg *sync.WaitGroup, answer api.Answer) error,
+	onCandidate func(candidate api.Candidate) error,
+	onResignation func(resignation api.Resignation) error,
+
+	log logging.StructuredLogger,
+) *SignalingClient {
+	return NewSignalingClientWithConfig(
+		onAcceptance,
+		onIntroduction,
+		onOffer,
+		onAnswer,
+		onCandidate,
+		onResignation,
+		log,
+		SignalingClientConfig{},
+	)
+}
+
+func NewSignalingClientWithConfig(
+	onAcceptance func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error,
 	onIntroduction func(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, introduction api.Introduction) error,
 	onOffer func(conn *websocket.Conn, wg *sync.WaitGroup, uuid string, offer api.Offer) error,
 	onAnswer func(wg *sync.WaitGroup, answer api.Answer) error,
 	onCandidate func(candidate api.Candidate) error,
-	onResignation func() error,
+	onResignation func(resignation api.Resignation) error,
 
 	log logging.StructuredLogger,
+	config SignalingClientConfig,
 ) *SignalingClient {
 	return &SignalingClient{
 		onAcceptance:   onAcceptance,
@@ -46,110 +92,344 @@ func NewSignalingClient(
 		onAnswer:       onAnswer,
 		onCandidate:    onCandidate,
 		onResignation:  onResignation,
+		inbound:        tap.New(config.OnInbound),
+		outbound:       tap.New(config.OnOutbound),
 		log:            log,
+		config:         config,
+		closing:        make(chan struct{}),
+		exited:         make(chan struct{}),
+	}
+}
+
+// HandleConn connects to the signaling server and handles its messages until the connection fails or the client exits.
+// If the connection fails, the servers in Addrs are tried in turn. If OnReconnectAttempt is set, failed connections are
+// dialed again to the address it returns. Once accepted, the client reconnects with the token of its latest acceptance,
+// so that it keeps the mac the server assigned, and only applies again if the server rejects the token.
+func (s *SignalingClient) HandleConn(laddrKey string, communityKey string, f func(msg webrtc.DataChannelMessage)) (err error) {
+	defer func() {
+		s.exitOnce.Do(func() {
+			s.lock.Lock()
+			s.err = err
+			s.lock.Unlock()
+
+			close(s.exited)
+		})
+	}()
+
+	addrs := append([]string{laddrKey}, s.config.Addrs...)
+
+	// Keep our identity when failing over, so that we are known by the same mac on every server
+	mac := uuid.NewString()
+
+	for attempt := 1; ; attempt++ {
+		err := s.handleConn(laddrKey, mac, communityKey, f)
+		if err == nil {
+			return err
+		}
+
+		// The server won't accept us on another attempt either
+		var rejected *ApplicationRejected
+		var required *SecretRequired
+		if errors.As(err, &rejected) || errors.As(err, &required) {
+			return err
+		}
+
+		s.log.Debug("SignalingClient.HandleConn", map[string]interface{}{
+			"attempt": attempt,
+			"error":   err.Error(),
+		})
+
+		next := addrs[attempt%len(addrs)]
+		if s.config.OnReconnectAttempt == nil {
+			// Try each server once
+			if attempt >= len(addrs) {
+				return err
+			}
+
+			laddrKey = next
+
+			continue
+		}
+
+		addr, ok := s.config.OnReconnectAttempt(attempt)
+		if !ok {
+			return err
+		}
+
+		if addr == "" {
+			addr = next
+		}
+
+		laddrKey = addr
 	}
 }
 
-func (s *SignalingClient) HandleConn(laddrKey string, communityKey string, f func(msg webrtc.DataChannelMessage)) error {
-	uuid := uuid.NewString()
-	wsAddress := "ws://" + laddrKey
+func (s *SignalingClient) handleConn(laddrKey string, uuid string, communityKey string, f func(msg webrtc.DataChannelMessage)) (err error) {
+	// Don't reconnect once we were closed
+	select {
+	case <-s.closing:
+		return nil
+	default:
+	}
+
 	fatal := make(chan error)
 
-	conn, _, err := websocket.Dial(context.Background(), wsAddress, nil)
+	// Servers which assign the macs would give us a new one if we applied again
+	s.lock.Lock()
+	token := s.token
+	if token != "" {
+		uuid = s.uuid
+	}
+	s.lock.Unlock()
+
+	var first interface{} = api.NewApplication(communityKey, uuid)
+	if token != "" {
+		first = api.NewReconnect(uuid, token)
+	}
+
+	conn, err := s.apply(laddrKey, first)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(websocket.StatusNormalClosure, "Closing websocket connection nominally")
 
-	var wg sync.WaitGroup
+	// We were closed while backing off
+	if conn == nil {
+		return nil
+	}
 
-	go func() {
-		if err := wsjson.Write(context.Background(), conn, api.NewApplication(communityKey, uuid)); err != nil {
-			fatal <- err
+	done := make(chan struct{})
+	defer close(done)
+
+	// Stops the goroutines below once we return, after the connection is closed so that the close status is still sent
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		// Let the server know why we left
+		conn.Close(closeStatus(err))
+
+		cancel()
+	}()
+
+	report := func(err error) {
+		select {
+		case fatal <- err:
+		case <-ctx.Done():
 		}
+	}
 
-		c := make(chan os.Signal)
+	s.lock.Lock()
+	s.conn = conn
+	s.uuid = uuid
+	s.done = done
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+
+	if s.config.HandleSignals {
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
 		go func() {
-			<-c
+			defer signal.Stop(c)
 
-			if err := wsjson.Write(context.Background(), conn, api.NewExited(uuid)); err != nil {
-				fatal <- err
+			select {
+			case <-c:
+			case <-ctx.Done():
+				return
 			}
 
-			os.Exit(0)
+			// Exits like Close, without waiting for HandleConn to return
+			s.closeOnce.Do(func() {
+				close(s.closing)
+			})
 		}()
-
-	}()
+	}
 
 	go func() {
+		// Servers which assign the macs replace the one we applied with
+		mac := uuid
+
 		for {
-			_, data, err := conn.Read(context.Background())
+			_, data, err := conn.Read(ctx)
 			if err != nil {
 				if err == io.EOF {
 					continue
 				} else {
-					fatal <- err
+					report(err)
+
+					return
 				}
 			}
 
 			var v api.Message
 			if err := json.Unmarshal(data, &v); err != nil {
-				fatal <- err
+				s.logDecodeError(err, data)
+
+				continue
 			}
 
+			s.inbound.Send(v)
+
 			switch v.Opcode {
+			case api.OpcodeRejection:
+				var rejection api.Rejection
+				if err := json.Unmarshal(data, &rejection); err != nil {
+					s.logDecodeError(err, data)
+
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": rejection.Opcode,
+						"reason":    rejection.Reason,
+					}
+				})
+
+				// The server doesn't know our token, e.g. because it is not the one which issued it, so we apply again
+				if rejection.Reason == api.RejectionInvalidToken {
+					s.lock.Lock()
+					s.token = ""
+					s.lock.Unlock()
+
+					if err := s.write(conn, api.NewApplication(communityKey, mac)); err != nil {
+						report(err)
+
+						return
+					}
+
+					continue
+				}
+
+				if s.config.OnRejected != nil {
+					s.config.OnRejected(rejection.Reason)
+				}
+
+				report(&ApplicationRejected{rejection.Reason})
+
+				return
+			case api.OpcodeDraining:
+				s.log.Info("SignalingClient.HandleConn", map[string]interface{}{
+					"operation": v.Opcode,
+				})
 			case api.OpcodeAcceptance:
 				var acceptance api.Acceptance
 				if err := json.Unmarshal(data, &acceptance); err != nil {
-					fatal <- err
+					s.logDecodeError(err, data)
+
+					continue
 				}
 
-				s.log.Trace("SignalingClient.HandleConn", map[string]interface{}{
-					"operation": acceptance.Opcode,
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": acceptance.Opcode,
+						"members":   acceptance.Members,
+					}
 				})
 
-				s.onAcceptance(conn, uuid)
-				break
+				if acceptance.Mac != "" && acceptance.Mac != mac {
+					mac = acceptance.Mac
+
+					s.lock.Lock()
+					s.uuid = mac
+					s.lock.Unlock()
+				}
+
+				if acceptance.Token != "" {
+					s.lock.Lock()
+					s.token = acceptance.Token
+					s.lock.Unlock()
+				}
+
+				s.onAcceptance(conn, mac, acceptance)
+
+				if s.config.OnJoined != nil {
+					// Servers which don't name the community only accept the one we applied for first
+					community := acceptance.Community
+					if community == "" {
+						community = communityKey
+					}
+
+					s.config.OnJoined(community, mac)
+				}
+			case api.OpcodeChallenge:
+				var challenge api.Challenge
+				if err := json.Unmarshal(data, &challenge); err != nil {
+					s.logDecodeError(err, data)
+
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": challenge.Opcode,
+						"community": challenge.Community,
+					}
+				})
+
+				secret, ok := s.config.Secrets[challenge.Community]
+				if !ok {
+					report(&SecretRequired{challenge.Community})
+
+					return
+				}
+
+				if err := s.write(conn, api.NewProvenApplication(challenge.Community, mac, api.Prove(secret, challenge.Nonce, challenge.Community, mac))); err != nil {
+					report(err)
+
+					return
+				}
 			case api.OpcodeIntroduction:
 				var introduction api.Introduction
 				if err := json.Unmarshal(data, &introduction); err != nil {
-					fatal <- err
+					s.logDecodeError(err, data)
+
+					continue
 				}
 
-				s.log.Trace("SignalingClient.HandleConn", map[string]interface{}{
-					"operation": introduction.Opcode,
-					"mac":       introduction.Mac,
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": introduction.Opcode,
+						"mac":       introduction.Mac,
+						"community": introduction.Community,
+					}
 				})
 
-				s.onIntroduction(conn, uuid, &wg, introduction)
+				s.onIntroduction(conn, mac, &wg, introduction)
 				break
 			case api.OpcodeOffer:
 				var offer api.Offer
 				if err := json.Unmarshal(data, &offer); err != nil {
-					fatal <- err
+					s.logDecodeError(err, data)
+
+					continue
 				}
 
-				s.log.Trace("SignalingClient.HandleConn", map[string]interface{}{
-					"operation": offer.Opcode,
-					"payload":   offer.Payload,
-					"sender":    offer.SenderMac,
-					"receiver":  offer.ReceiverMac,
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": offer.Opcode,
+						"payload":   offer.Payload,
+						"sender":    offer.SenderMac,
+						"receiver":  offer.ReceiverMac,
+					}
 				})
 
-				s.onOffer(conn, &wg, uuid, offer)
+				s.onOffer(conn, &wg, mac, offer)
 				break
 			case api.OpcodeAnswer:
 				var answer api.Answer
 				if err := json.Unmarshal(data, &answer); err != nil {
-					fatal <- err
+					s.logDecodeError(err, data)
+
+					continue
 				}
 
-				s.log.Trace("SignalingClient.HandleConn", map[string]interface{}{
-					"operation": answer.Opcode,
-					"payload":   answer.Payload,
-					"sender":    answer.SenderMac,
-					"receiver":  answer.ReceiverMac,
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": answer.Opcode,
+						"payload":   answer.Payload,
+						"sender":    answer.SenderMac,
+						"receiver":  answer.ReceiverMac,
+					}
 				})
 
 				s.onAnswer(&wg, answer)
@@ -157,14 +437,18 @@ func (s *SignalingClient) HandleConn(laddrKey string, communityKey string, f fun
 			case api.OpcodeCandidate:
 				var candidate api.Candidate
 				if err := json.Unmarshal(data, &candidate); err != nil {
-					fatal <- err
+					s.logDecodeError(err, data)
+
+					continue
 				}
 
-				s.log.Trace("SignalingClient.HandleConn", map[string]interface{}{
-					"operation": candidate.Opcode,
-					"payload":   candidate.Payload,
-					"sender":    candidate.SenderMac,
-					"receiver":  candidate.ReceiverMac,
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": candidate.Opcode,
+						"payload":   candidate.Payload,
+						"sender":    candidate.SenderMac,
+						"receiver":  candidate.ReceiverMac,
+					}
 				})
 
 				s.onCandidate(candidate)
@@ -172,15 +456,56 @@ func (s *SignalingClient) HandleConn(laddrKey string, communityKey string, f fun
 			case api.OpcodeResignation:
 				var resignation api.Resignation
 				if err := json.Unmarshal(data, &resignation); err != nil {
-					fatal <- err
+					s.logDecodeError(err, data)
+
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": resignation.Opcode,
+						"mac":       resignation.Mac,
+					}
+				})
+
+				s.onResignation(resignation)
+			case api.OpcodePresence:
+				var presence api.Presence
+				if err := json.Unmarshal(data, &presence); err != nil {
+					s.logDecodeError(err, data)
+
+					continue
 				}
 
-				s.log.Trace("SignalingClient.HandleConn", map[string]interface{}{
-					"operation": resignation.Opcode,
-					"mac":       resignation.Mac,
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": presence.Opcode,
+						"mac":       presence.Mac,
+						"community": presence.Community,
+					}
 				})
 
-				s.onResignation()
+				if s.config.OnPresence != nil {
+					s.config.OnPresence(presence)
+				}
+			case api.OpcodeRelay:
+				var relay api.Relay
+				if err := json.Unmarshal(data, &relay); err != nil {
+					s.logDecodeError(err, data)
+
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingClient.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": relay.Opcode,
+						"sender":    relay.SenderMac,
+					}
+				})
+
+				if s.config.OnRelay != nil {
+					s.config.OnRelay(relay)
+				}
 			}
 		}
 	}()
@@ -190,11 +515,174 @@ func (s *SignalingClient) HandleConn(laddrKey string, communityKey string, f fun
 		case err := <-fatal:
 			return err
 		case <-config.ExitClient:
-			if err := wsjson.Write(context.Background(), conn, api.NewExited(uuid)); err != nil {
+			if err := s.write(conn, api.NewExited(s.mac())); err != nil {
+				return err
+			}
+			return nil
+		case <-s.closing:
+			if err := s.write(conn, api.NewExited(s.mac())); err != nil {
 				return err
 			}
 			return nil
+		}
+	}
+}
+
+// write sends a message to the signaling server, failing and closing the connection if it exceeds the write timeout
+func (s *SignalingClient) write(conn *websocket.Conn, v interface{}) error {
+	return writes.WithTimeout(conn, s.config.writeTimeout(), v, s.outbound)
+}
+
+// mac returns the mac we are known by on the current connection
+func (s *SignalingClient) mac() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.uuid
+}
+
+// apply dials the signaling server and sends the application or reconnect. If sending it fails, it is sent again on a
+// new connection, as failed writes close the connection, with the same key so that the server can tell the attempts apart.
+func (s *SignalingClient) apply(laddrKey string, message interface{}) (*websocket.Conn, error) {
+	if application, ok := message.(*api.Application); ok {
+		application.Key = uuid.NewString()
+	}
+
+	backoff := s.config.applicationRetryBackoff()
+	for attempt := 0; ; attempt++ {
+		conn, _, err := websocket.Dial(context.Background(), "ws://"+laddrKey, &websocket.DialOptions{
+			HTTPClient:      s.config.HTTPClient,
+			CompressionMode: s.config.compressionMode(),
+		})
+		if err != nil {
+			return nil, err
+		}
 
+		err = s.write(conn, message)
+		if err == nil {
+			return conn, nil
 		}
+
+		conn.Close(closeStatus(err))
+
+		if attempt >= s.config.applicationRetries() {
+			return nil, err
+		}
+
+		s.log.Debug("SignalingClient.apply", map[string]interface{}{
+			"attempt": attempt + 1,
+			"error":   err.Error(),
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-s.closing:
+			return nil, nil
+		}
+
+		backoff *= 2
+	}
+}
+
+// Close exits all communities and stops handling the connection to the signaling server, waiting until it is closed.
+// HandleConn returns and won't reconnect then.
+func (s *SignalingClient) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+
+	s.lock.Lock()
+	done := s.done
+	s.lock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	return nil
+}
+
+// Done is closed once HandleConn returned and won't reconnect anymore, e.g. after Close, a signal handled with
+// HandleSignals or a rejection, so that the application can decide whether to exit
+func (s *SignalingClient) Done() <-chan struct{} {
+	return s.exited
+}
+
+// Err returns the error HandleConn returned with once Done is closed, nil if it exited cleanly
+func (s *SignalingClient) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// Join applies for another community over the existing connection to the signaling server
+func (s *SignalingClient) Join(community string) error {
+	s.lock.Lock()
+	conn, uuid := s.conn, s.uuid
+	s.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("Not connected to a signaling server so far")
 	}
+
+	return s.write(conn, api.NewApplication(community, uuid))
+}
+
+// SendPresence publishes a status of at most api.MaxPresenceSize bytes to the other members of a community through the
+// signaling server, which drops updates sent too often. An empty payload clears the status.
+func (s *SignalingClient) SendPresence(community string, payload []byte) error {
+	s.lock.Lock()
+	conn, uuid := s.conn, s.uuid
+	s.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("Not connected to a signaling server so far")
+	}
+
+	presence := api.NewPresence(uuid, community, payload)
+	if err := presence.Validate(); err != nil {
+		return err
+	}
+
+	return s.write(conn, presence)
+}
+
+// SendRelay sends application data of at most api.MaxRelaySize bytes to another member of our communities through the
+// signaling server, which drops messages sent too often. It works without a data channel, e.g. as a fallback if WebRTC fails.
+func (s *SignalingClient) SendRelay(receiver string, payload []byte) error {
+	s.lock.Lock()
+	conn, uuid := s.conn, s.uuid
+	s.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("Not connected to a signaling server so far")
+	}
+
+	relay := api.NewRelay(payload, uuid, receiver)
+	if err := relay.Validate(); err != nil {
+		return err
+	}
+
+	return s.write(conn, relay)
+}
+
+// Leave exits a single community while staying connected to the signaling server
+func (s *SignalingClient) Leave(community string) error {
+	s.lock.Lock()
+	conn, uuid := s.conn, s.uuid
+	s.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("Not connected to a signaling server so far")
+	}
+
+	return s.write(conn, api.NewScopedExited(uuid, community))
+}
+
+func (s *SignalingClient) logDecodeError(err error, data []byte) {
+	s.log.Warn("SignalingClient.HandleConn", map[string]interface{}{
+		"error": err.Error(),
+		"data":  string(data),
+	})
 }
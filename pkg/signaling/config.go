@@ -0,0 +1,111 @@
+package signaling
+
+import (
+	"net/http"
+	"time"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/config"
+	"nhooyr.io/websocket"
+)
+
+type SignalingClientConfig struct {
+	// Pre-shared secrets, keyed by community, used to answer the challenges of the signaling server
+	Secrets map[string][]byte
+
+	// Further signaling servers to fail over to. They are tried in turn after the one passed to HandleConn, keeping the mac.
+	Addrs []string
+
+	// Called with the presence updates of the other members of our communities. Nil ignores them.
+	OnPresence func(presence api.Presence)
+	// Called with the application data other members sent us through the signaling server with SendRelay. Nil drops it.
+	OnRelay func(relay api.Relay)
+	// Called once the signaling server accepted us as a member of a community, after the acceptance was handled
+	OnJoined func(community string, mac string)
+	// Called with a copy of each message received from and sent by the signaling client, e.g. to debug handshakes. The offers,
+	// answers and candidates are sent by the ClientManager, whose OnOutbound sees them. They are called in order from a
+	// separate goroutine, messages are dropped while they are behind.
+	OnInbound  func(message api.Message)
+	OnOutbound func(message api.Message)
+	// Called with the reason the signaling server rejected an application for, such as api.RejectionDraining.
+	// The reason is empty for servers which don't send one, e.g. if the mac is already in use.
+	OnRejected func(reason string)
+
+	// Called before dialing again after the connection to the signaling server failed, with the number of the attempt
+	// starting at 1. Returns the address to dial, an empty one dials the next of the servers, or false to give up.
+	// It can block to back off. Nil tries each server once.
+	OnReconnectAttempt func(attempt int) (addr string, ok bool)
+
+	// Maximum duration of a single write to the signaling server. Defaults to config.DefaultWriteTimeout.
+	WriteTimeout time.Duration
+
+	// Amount of times the application is sent again on a new connection if sending it failed. Defaults to 3.
+	ApplicationRetries int
+	// Initial delay before sending the application again, which doubles with each attempt. Defaults to 100ms.
+	ApplicationRetryBackoff time.Duration
+
+	// Client used to dial the signaling servers, e.g. with a custom transport. Nil uses http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Offer the permessage-deflate extension, which compresses the signaling messages if the server accepts it
+	Compression bool
+
+	// Exit all communities and return from HandleConn on SIGINT or SIGTERM, as Close does. Off by default, so that
+	// applications embedding the client keep their own signal handling and call Close themselves.
+	HandleSignals bool
+}
+
+func (c SignalingClientConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout > 0 {
+		return c.WriteTimeout
+	}
+
+	return config.DefaultWriteTimeout
+}
+
+func (c SignalingClientConfig) applicationRetries() int {
+	if c.ApplicationRetries > 0 {
+		return c.ApplicationRetries
+	}
+
+	return 3
+}
+
+func (c SignalingClientConfig) applicationRetryBackoff() time.Duration {
+	if c.ApplicationRetryBackoff > 0 {
+		return c.ApplicationRetryBackoff
+	}
+
+	return 100 * time.Millisecond
+}
+
+func (c SignalingClientConfig) compressionMode() websocket.CompressionMode {
+	return compressionMode(c.Compression)
+}
+
+// compressionMode keeps the deflate window across messages if compression is enabled, as signaling messages are repetitive
+func compressionMode(compression bool) websocket.CompressionMode {
+	if !compression {
+		return websocket.CompressionDisabled
+	}
+
+	return websocket.CompressionContextTakeover
+}
+
+type SignalingServerConfig struct {
+	// Called with a client's connection before its first message is read, which is the connection passed to the other callbacks
+	OnOpened func(conn *websocket.Conn)
+	// Called once a client's connection is closed, e.g. to let CommunitiesManager.HandleClosed accept its reconnect
+	OnClosed func(conn *websocket.Conn)
+	// Called with the presence updates of clients, e.g. CommunitiesManager.HandlePresence. Nil ignores them.
+	OnPresence func(presence api.Presence) error
+	// Called with the messages clients relay to each other, e.g. CommunitiesManager.HandleRelay. Nil drops them.
+	OnRelay func(relay api.Relay) error
+	// Called with the reconnects of clients, e.g. CommunitiesManager.HandleReconnect. Nil ignores them.
+	OnReconnect func(reconnect api.Reconnect, conn *websocket.Conn) error
+	// Called with the requests of clients to be introduced again to a peer, e.g. CommunitiesManager.HandleRepeer. Nil ignores them.
+	OnRepeer func(repeer api.Repeer, conn *websocket.Conn) error
+	// Called with a copy of each message received from a client, e.g. to debug handshakes. The messages sent to the clients
+	// are seen by CommunitiesManagerConfig.OnOutbound. It is called in order from a separate goroutine, messages are dropped while it is behind.
+	OnInbound func(message api.Message)
+}
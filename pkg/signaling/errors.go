@@ -0,0 +1,54 @@
+package signaling
+
+import (
+	"errors"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"nhooyr.io/websocket"
+)
+
+type ApplicationRejected struct {
+	Reason string
+}
+
+func (m *ApplicationRejected) Error() string {
+	switch m.Reason {
+	case api.RejectionDraining:
+		return "The application was rejected because the signaling server is draining. Try again after it restarted"
+	case api.RejectionCommunityLimit:
+		return "The application was rejected because the signaling server can't host any more communities. Join an existing one instead"
+	case api.RejectionBanned:
+		return "The application was rejected because the mac is banned from the community"
+	}
+
+	return "The application was rejected by the signaling server. Most likely, the mac is already in use or the secret is wrong"
+}
+
+type SecretRequired struct {
+	Community string
+}
+
+func (m *SecretRequired) Error() string {
+	return "The signaling server requires a secret for community " + m.Community + ", but none was configured"
+}
+
+// Close reasons must fit into a single control frame
+const maxCloseReasonLength = 123
+
+func closeStatus(err error) (websocket.StatusCode, string) {
+	if err == nil {
+		return websocket.StatusNormalClosure, "Closing websocket connection nominally"
+	}
+
+	reason := err.Error()
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+	}
+
+	var rejected *ApplicationRejected
+	if errors.As(err, &rejected) {
+		return websocket.StatusPolicyViolation, reason
+	}
+
+	return websocket.StatusInternalError, reason
+}
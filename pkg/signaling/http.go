@@ -0,0 +1,275 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	internalLogging "github.com/alphahorizonio/libentangle/internal/logging"
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+	"github.com/alphahorizonio/libentangle/pkg/logging"
+	"nhooyr.io/websocket"
+)
+
+const shutdownReason = "The signaling server is shutting down"
+
+type ServerOptions struct {
+	// Configuration of the CommunitiesManager, e.g. its secrets and MaxCommunities
+	Communities handlers.CommunitiesManagerConfig
+
+	// Maximum amount of open websocket connections, further ones are refused with 503 Service Unavailable. Zero allows any amount.
+	MaxConnections int
+	// Origins allowed to connect from browsers, as in websocket.AcceptOptions. Nil allows any origin.
+	OriginPatterns []string
+	// Accept the permessage-deflate extension if clients offer it, which compresses the signaling messages
+	Compression bool
+
+	// Called with a copy of each message received from a client. The messages sent to them are seen by Communities.OnOutbound.
+	OnInbound func(message api.Message)
+
+	// Logger of the signaling server. Nil logs JSON with the default verbosity of the CLI.
+	Logger logging.StructuredLogger
+}
+
+// ServerMetrics counts the connections of a Server
+type ServerMetrics struct {
+	// Websocket connections which are currently open
+	Connections int
+	// Websocket connections accepted and refused since the server started
+	Accepted uint64
+	Refused  uint64
+	// Communities with at least one member
+	Communities int
+}
+
+// Server is a signaling server backed by a CommunitiesManager, which accepts websocket connections on any path,
+// collects the members of crashed clients and drains on shutdown
+type Server struct {
+	Manager *handlers.CommunitiesManager
+
+	signaler *SignalingServer
+	opts     ServerOptions
+	log      logging.StructuredLogger
+
+	lock sync.Mutex
+	// Connections which are being accepted or open, and the open ones
+	connections int
+	conns       map[*websocket.Conn]struct{}
+	accepted    uint64
+	refused     uint64
+	closed      bool
+	servers     []*http.Server
+
+	cancelGC context.CancelFunc
+}
+
+func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.MaxConnections < 0 {
+		return nil, errors.New("The maximum amount of connections can't be negative")
+	}
+
+	l := opts.Logger
+	if l == nil {
+		l = internalLogging.NewJSONLogger(2)
+	}
+
+	manager := handlers.NewCommunitiesManagerWithConfig(opts.Communities)
+
+	s := &Server{
+		Manager: manager,
+		opts:    opts,
+		log:     l,
+		conns:   map[*websocket.Conn]struct{}{},
+	}
+
+	s.signaler = NewSignalingServerWithConfig(
+		func(application api.Application, conn *websocket.Conn) error {
+			return manager.HandleApplication(application, conn)
+		},
+		func(ready api.Ready, conn *websocket.Conn) error {
+			return manager.HandleReady(ready, conn)
+		},
+		func(offer api.Offer) error {
+			return manager.HandleOffer(offer)
+		},
+		func(answer api.Answer) error {
+			return manager.HandleAnswer(answer)
+		},
+		func(candidate api.Candidate) error {
+			return manager.HandleCandidate(candidate)
+		},
+		func(exited api.Exited) error {
+			return manager.HandleExited(exited)
+		},
+		l,
+		SignalingServerConfig{
+			OnOpened: func(conn *websocket.Conn) {
+				s.lock.Lock()
+				s.conns[conn] = struct{}{}
+				closed := s.closed
+				s.lock.Unlock()
+
+				// The server shut down while the connection was being accepted
+				if closed {
+					conn.Close(websocket.StatusGoingAway, shutdownReason)
+				}
+			},
+			OnClosed: func(conn *websocket.Conn) {
+				manager.HandleClosed(conn)
+
+				s.lock.Lock()
+				delete(s.conns, conn)
+				s.connections--
+				s.lock.Unlock()
+			},
+			OnPresence: func(presence api.Presence) error {
+				return manager.HandlePresence(presence)
+			},
+			OnRelay: func(relay api.Relay) error {
+				return manager.HandleRelay(relay)
+			},
+			OnReconnect: func(reconnect api.Reconnect, conn *websocket.Conn) error {
+				return manager.HandleReconnect(reconnect, conn)
+			},
+			OnRepeer: func(repeer api.Repeer, conn *websocket.Conn) error {
+				return manager.HandleRepeer(repeer, conn)
+			},
+			OnInbound: opts.OnInbound,
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancelGC = cancel
+
+	go manager.RunGC(ctx)
+
+	return s, nil
+}
+
+// ServeHTTP upgrades a request to a websocket connection and handles its signaling messages
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	if s.closed || (s.opts.MaxConnections > 0 && s.connections >= s.opts.MaxConnections) {
+		s.refused++
+		s.lock.Unlock()
+
+		s.log.Debug("Server.ServeHTTP", map[string]interface{}{
+			"status": http.StatusServiceUnavailable,
+			"remote": r.RemoteAddr,
+		})
+
+		http.Error(rw, "The signaling server does not accept any more connections", http.StatusServiceUnavailable)
+
+		return
+	}
+	s.connections++
+	s.lock.Unlock()
+
+	conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: s.opts.OriginPatterns == nil, // CORS
+		OriginPatterns:     s.opts.OriginPatterns,
+		CompressionMode:    compressionMode(s.opts.Compression),
+	})
+	if err != nil {
+		s.log.Debug("Server.ServeHTTP", map[string]interface{}{
+			"remote": r.RemoteAddr,
+			"error":  err.Error(),
+		})
+
+		s.lock.Lock()
+		s.connections--
+		s.lock.Unlock()
+
+		return
+	}
+
+	s.lock.Lock()
+	s.accepted++
+	s.lock.Unlock()
+
+	s.signaler.ServeConn(conn)
+}
+
+// ListenAndServe serves the signaling server on the address until it is shut down
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve serves the signaling server on the listener until it is shut down
+func (s *Server) Serve(listener net.Listener) error {
+	server := &http.Server{Handler: s}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+
+		return http.ErrServerClosed
+	}
+	s.servers = append(s.servers, server)
+	s.lock.Unlock()
+
+	return server.Serve(listener)
+}
+
+// Shutdown drains the CommunitiesManager, so that the handshakes in progress can complete, stops accepting
+// connections and closes the open ones with StatusGoingAway, so that clients fail over to another server
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	servers := append([]*http.Server{}, s.servers...)
+	s.lock.Unlock()
+
+	defer s.cancelGC()
+
+	drainErr := s.Manager.Drain(ctx)
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Websocket connections are hijacked, so they are not closed by the HTTP servers
+	s.lock.Lock()
+	conns := []*websocket.Conn{}
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+
+	// Each close waits for the client to acknowledge it
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+
+			conn.Close(websocket.StatusGoingAway, shutdownReason)
+		}(conn)
+	}
+	wg.Wait()
+
+	return drainErr
+}
+
+// Metrics returns the current connection counts of the server
+func (s *Server) Metrics() ServerMetrics {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return ServerMetrics{
+		Connections: s.connections,
+		Accepted:    s.accepted,
+		Refused:     s.refused,
+		Communities: len(s.Manager.Communities()),
+	}
+}
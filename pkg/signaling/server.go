@@ -4,8 +4,9 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/JakWai01/sile-fystem/pkg/logging"
+	"github.com/alphahorizonio/libentangle/internal/tap"
 	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/logging"
 	"nhooyr.io/websocket"
 )
 
@@ -19,7 +20,10 @@ type SignalingServer struct {
 	onCandidate   func(candidate api.Candidate) error
 	onExited      func(exited api.Exited) error
 
-	log logging.StructuredLogger
+	inbound *tap.Tap
+
+	log    logging.StructuredLogger
+	config SignalingServerConfig
 }
 
 func NewSignalingServer(
@@ -31,6 +35,29 @@ func NewSignalingServer(
 	onExited func(exited api.Exited) error,
 
 	log logging.StructuredLogger,
+) *SignalingServer {
+	return NewSignalingServerWithConfig(
+		onApplication,
+		onReady,
+		onOffer,
+		onAnswer,
+		onCandidate,
+		onExited,
+		log,
+		SignalingServerConfig{},
+	)
+}
+
+func NewSignalingServerWithConfig(
+	onApplication func(application api.Application, conn *websocket.Conn) error,
+	onReady func(ready api.Ready, conn *websocket.Conn) error,
+	onOffer func(offer api.Offer) error,
+	onAnswer func(answer api.Answer) error,
+	onCandidate func(candidate api.Candidate) error,
+	onExited func(exited api.Exited) error,
+
+	log logging.StructuredLogger,
+	config SignalingServerConfig,
 ) *SignalingServer {
 	return &SignalingServer{
 		onApplication: onApplication,
@@ -39,18 +66,44 @@ func NewSignalingServer(
 		onAnswer:      onAnswer,
 		onCandidate:   onCandidate,
 		onExited:      onExited,
+		inbound:       tap.New(config.OnInbound),
 		log:           log,
+		config:        config,
 	}
 }
 
+// HandleConn handles a copy of the connection, ServeConn handles the connection itself
 func (s *SignalingServer) HandleConn(conn websocket.Conn) {
+	s.ServeConn(&conn)
+}
 
+// ServeConn reads and handles the signaling messages of a connection in the background until it is closed
+func (s *SignalingServer) ServeConn(conn *websocket.Conn) {
 	go func() {
+		if s.config.OnOpened != nil {
+			s.config.OnOpened(conn)
+		}
+
+		if s.config.OnClosed != nil {
+			defer s.config.OnClosed(conn)
+		}
+
+		// Complete the closing handshake, which the client would otherwise wait for after exiting
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
 	loop:
 		for {
 			_, data, err := conn.Read(context.Background())
 			if err != nil {
-				continue
+				if status := websocket.CloseStatus(err); status != -1 {
+					s.log.Debug("SignalingServer.HandleConn", map[string]interface{}{
+						"status": status.String(),
+						"reason": err.Error(),
+					})
+				}
+
+				// The connection is closed after a failed read, e.g. because a write to it timed out
+				break loop
 			}
 
 			var v api.Message
@@ -58,6 +111,8 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 				continue
 			}
 
+			s.inbound.Send(v)
+
 			switch v.Opcode {
 			case api.OpcodeApplication:
 				var application api.Application
@@ -65,13 +120,21 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 					continue
 				}
 
-				s.log.Trace("SignalingServer.HandleConn", map[string]interface{}{
-					"operation": application.Opcode,
-					"community": application.Community,
-					"mac":       application.Mac,
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": application.Opcode,
+						"community": application.Community,
+						"mac":       application.Mac,
+					}
 				})
 
-				s.onApplication(application, &conn)
+				if err := application.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
+				s.onApplication(application, conn)
 				break
 			case api.OpcodeReady:
 				var ready api.Ready
@@ -79,12 +142,20 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 					continue
 				}
 
-				s.log.Trace("SignalingServer.HandleConn", map[string]interface{}{
-					"operation": ready.Opcode,
-					"mac":       ready.Mac,
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": ready.Opcode,
+						"mac":       ready.Mac,
+					}
 				})
 
-				s.onReady(ready, &conn)
+				if err := ready.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
+				s.onReady(ready, conn)
 				break
 			case api.OpcodeOffer:
 				var offer api.Offer
@@ -92,13 +163,21 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 					continue
 				}
 
-				s.log.Trace("SignalingServer.HandleConn", map[string]interface{}{
-					"operation": offer.Opcode,
-					"payload":   offer.Payload,
-					"sender":    offer.SenderMac,
-					"receiver":  offer.ReceiverMac,
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": offer.Opcode,
+						"payload":   offer.Payload,
+						"sender":    offer.SenderMac,
+						"receiver":  offer.ReceiverMac,
+					}
 				})
 
+				if err := offer.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
 				s.onOffer(offer)
 				break
 			case api.OpcodeAnswer:
@@ -107,13 +186,21 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 					continue
 				}
 
-				s.log.Trace("SignalingServer.HandleConn", map[string]interface{}{
-					"operation": answer.Opcode,
-					"payload":   answer.Payload,
-					"sender":    answer.SenderMac,
-					"receiver":  answer.ReceiverMac,
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": answer.Opcode,
+						"payload":   answer.Payload,
+						"sender":    answer.SenderMac,
+						"receiver":  answer.ReceiverMac,
+					}
 				})
 
+				if err := answer.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
 				s.onAnswer(answer)
 				break
 			case api.OpcodeCandidate:
@@ -122,13 +209,21 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 					continue
 				}
 
-				s.log.Trace("SignalingServer.HandleConn", map[string]interface{}{
-					"operation": candidate.Opcode,
-					"payload":   candidate.Payload,
-					"sender":    candidate.SenderMac,
-					"receiver":  candidate.ReceiverMac,
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": candidate.Opcode,
+						"payload":   candidate.Payload,
+						"sender":    candidate.SenderMac,
+						"receiver":  candidate.ReceiverMac,
+					}
 				})
 
+				if err := candidate.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
 				s.onCandidate(candidate)
 				break
 			case api.OpcodeExited:
@@ -137,16 +232,134 @@ func (s *SignalingServer) HandleConn(conn websocket.Conn) {
 					continue
 				}
 
-				s.log.Trace("SignalingServer.HandleConn", map[string]interface{}{
-					"operation": exited.Opcode,
-					"mac":       exited.Mac,
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": exited.Opcode,
+						"mac":       exited.Mac,
+						"community": exited.Community,
+					}
 				})
 
+				if err := exited.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
 				s.onExited(exited)
+
+				// A scoped exit only leaves a single community, the connection stays open
+				if exited.Community != "" {
+					break
+				}
+
 				break loop
+			case api.OpcodePresence:
+				var presence api.Presence
+				if err := json.Unmarshal(data, &presence); err != nil {
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": presence.Opcode,
+						"mac":       presence.Mac,
+						"community": presence.Community,
+					}
+				})
+
+				if err := presence.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
+				if s.config.OnPresence != nil {
+					s.config.OnPresence(presence)
+				}
+			case api.OpcodeRelay:
+				var relay api.Relay
+				if err := json.Unmarshal(data, &relay); err != nil {
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": relay.Opcode,
+						"sender":    relay.SenderMac,
+						"receiver":  relay.ReceiverMac,
+					}
+				})
+
+				if err := relay.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
+				if s.config.OnRelay != nil {
+					s.config.OnRelay(relay)
+				}
+			case api.OpcodeReconnect:
+				var reconnect api.Reconnect
+				if err := json.Unmarshal(data, &reconnect); err != nil {
+					continue
+				}
+
+				// The token is a credential, so it isn't logged
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": reconnect.Opcode,
+						"mac":       reconnect.Mac,
+					}
+				})
+
+				if err := reconnect.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
+				if s.config.OnReconnect != nil {
+					s.config.OnReconnect(reconnect, conn)
+				}
+			case api.OpcodeRepeer:
+				var repeer api.Repeer
+				if err := json.Unmarshal(data, &repeer); err != nil {
+					continue
+				}
+
+				logging.Trace(s.log, "SignalingServer.HandleConn", func() map[string]interface{} {
+					return map[string]interface{}{
+						"operation": repeer.Opcode,
+						"sender":    repeer.SenderMac,
+						"receiver":  repeer.ReceiverMac,
+						"community": repeer.Community,
+					}
+				})
+
+				if err := repeer.Validate(); err != nil {
+					s.rejectInvalid(conn, err)
+
+					break loop
+				}
+
+				if s.config.OnRepeer != nil {
+					s.config.OnRepeer(repeer, conn)
+				}
 			default:
 				continue
 			}
 		}
 	}()
 }
+
+// rejectInvalid closes a connection which sent a message violating the signaling protocol, before it can corrupt any state
+func (s *SignalingServer) rejectInvalid(conn *websocket.Conn, err error) {
+	s.log.Debug("SignalingServer.HandleConn", map[string]interface{}{
+		"status": websocket.StatusProtocolError.String(),
+		"reason": err.Error(),
+	})
+
+	conn.Close(websocket.StatusProtocolError, err.Error())
+}
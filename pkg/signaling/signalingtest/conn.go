@@ -0,0 +1,107 @@
+package signalingtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+	"nhooyr.io/websocket"
+)
+
+var _ handlers.Conn = &Conn{}
+
+// Conn is an in-memory handlers.Conn which records the messages written to it
+type Conn struct {
+	// Error returned by every write. Nil lets writes succeed.
+	WriteErr error
+
+	lock    sync.Mutex
+	written [][]byte
+	closed  bool
+	status  websocket.StatusCode
+}
+
+func NewConn() *Conn {
+	return &Conn{
+		written: [][]byte{},
+	}
+}
+
+func (c *Conn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return errors.New("Connection is closed")
+	}
+
+	if c.WriteErr != nil {
+		return c.WriteErr
+	}
+
+	c.written = append(c.written, append([]byte{}, p...))
+
+	return nil
+}
+
+// Read blocks until the context is done, as nothing is ever sent to a mock connection
+func (c *Conn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	<-ctx.Done()
+
+	return 0, nil, ctx.Err()
+}
+
+func (c *Conn) Close(code websocket.StatusCode, reason string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	c.status = code
+
+	return nil
+}
+
+// CloseStatus returns the status code the connection was closed with, or -1 if it is still open
+func (c *Conn) CloseStatus() websocket.StatusCode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		return -1
+	}
+
+	return c.status
+}
+
+// Messages returns the envelopes of all messages written so far
+func (c *Conn) Messages() []api.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	messages := []api.Message{}
+	for _, data := range c.written {
+		var v api.Message
+		if err := json.Unmarshal(data, &v); err != nil {
+			continue
+		}
+
+		messages = append(messages, v)
+	}
+
+	return messages
+}
+
+// Decode unmarshals the i-th message written so far into v
+func (c *Conn) Decode(i int, v interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if i < 0 || i >= len(c.written) {
+		return errors.New("No such message has been written")
+	}
+
+	return json.Unmarshal(c.written[i], v)
+}
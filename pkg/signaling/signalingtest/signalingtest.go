@@ -0,0 +1,228 @@
+package signalingtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/alphahorizonio/libentangle/internal/logging"
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+	"github.com/alphahorizonio/libentangle/pkg/networking"
+	"github.com/alphahorizonio/libentangle/pkg/signaling"
+	"github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+// Servers by address, so that the peers connecting to a server are closed with it
+var (
+	serversLock sync.Mutex
+	servers     = map[string]*Server{}
+)
+
+// Server is an in-process signaling server listening on a random local port
+type Server struct {
+	Addr    string
+	Manager *handlers.CommunitiesManager
+
+	server *http.Server
+
+	lock  sync.Mutex
+	conns map[*websocket.Conn]struct{}
+	peers []*Peer
+}
+
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	manager := handlers.NewCommunitiesManager()
+
+	s := &Server{
+		Addr:    listener.Addr().String(),
+		Manager: manager,
+		conns:   map[*websocket.Conn]struct{}{},
+	}
+
+	signaler := signaling.NewSignalingServerWithConfig(
+		func(application api.Application, conn *websocket.Conn) error {
+			return manager.HandleApplication(application, conn)
+		},
+		func(ready api.Ready, conn *websocket.Conn) error {
+			return manager.HandleReady(ready, conn)
+		},
+		func(offer api.Offer) error {
+			return manager.HandleOffer(offer)
+		},
+		func(answer api.Answer) error {
+			return manager.HandleAnswer(answer)
+		},
+		func(candidate api.Candidate) error {
+			return manager.HandleCandidate(candidate)
+		},
+		func(exited api.Exited) error {
+			return manager.HandleExited(exited)
+		},
+		logging.NewJSONLogger(0),
+		signaling.SignalingServerConfig{
+			OnOpened: func(conn *websocket.Conn) {
+				s.lock.Lock()
+				defer s.lock.Unlock()
+
+				s.conns[conn] = struct{}{}
+			},
+			OnClosed: func(conn *websocket.Conn) {
+				manager.HandleClosed(conn)
+
+				s.lock.Lock()
+				defer s.lock.Unlock()
+
+				delete(s.conns, conn)
+			},
+			OnPresence: func(presence api.Presence) error {
+				return manager.HandlePresence(presence)
+			},
+			OnRelay: func(relay api.Relay) error {
+				return manager.HandleRelay(relay)
+			},
+			OnReconnect: func(reconnect api.Reconnect, conn *websocket.Conn) error {
+				return manager.HandleReconnect(reconnect, conn)
+			},
+			OnRepeer: func(repeer api.Repeer, conn *websocket.Conn) error {
+				return manager.HandleRepeer(repeer, conn)
+			},
+		},
+	)
+
+	s.server = &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true, // CORS
+		})
+		if err != nil {
+			return
+		}
+
+		signaler.ServeConn(conn)
+	})}
+
+	go s.server.Serve(listener)
+
+	serversLock.Lock()
+	servers[s.Addr] = s
+	serversLock.Unlock()
+
+	return s, nil
+}
+
+// Close closes the peers which connected to the server, stops listening and closes the remaining connections
+func (s *Server) Close() error {
+	serversLock.Lock()
+	delete(servers, s.Addr)
+	serversLock.Unlock()
+
+	s.lock.Lock()
+	peers := s.peers
+	s.peers = nil
+	s.lock.Unlock()
+
+	for _, peer := range peers {
+		peer.Close()
+	}
+
+	err := s.server.Close()
+
+	// Websocket connections are hijacked, so they are not closed by the HTTP server
+	s.lock.Lock()
+	conns := []*websocket.Conn{}
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+
+			conn.Close(websocket.StatusGoingAway, "The signaling server is shutting down")
+		}(conn)
+	}
+	wg.Wait()
+
+	return err
+}
+
+// Peer is a client joined to a community, receiving its data channel messages on Messages
+type Peer struct {
+	Manager    *handlers.ClientManager
+	Connection *networking.ConnectionManager
+	Messages   chan webrtc.DataChannelMessage
+
+	opened chan struct{}
+}
+
+func NewPeer(addr string, community string, config handlers.ClientManagerConfig) *Peer {
+	p := &Peer{
+		Messages: make(chan webrtc.DataChannelMessage, 128),
+		opened:   make(chan struct{}, 128),
+	}
+
+	p.Manager = handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {
+		select {
+		case p.opened <- struct{}{}:
+		default:
+		}
+	}, config)
+	p.Connection = networking.NewConnectionManager(p.Manager)
+
+	p.Connection.Connect(addr, community, func(msg webrtc.DataChannelMessage) {
+		p.Messages <- msg
+	}, logging.NewJSONLogger(0))
+
+	serversLock.Lock()
+	if s, ok := servers[addr]; ok {
+		s.lock.Lock()
+		s.peers = append(s.peers, p)
+		s.lock.Unlock()
+	}
+	serversLock.Unlock()
+
+	return p
+}
+
+// Close exits the community and closes the connections to the signaling server and all other peers
+func (p *Peer) Close() error {
+	return p.Connection.Close()
+}
+
+// WaitForOpen blocks until a data channel to another peer has been opened
+func (p *Peer) WaitForOpen(ctx context.Context) error {
+	select {
+	case <-p.opened:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ConnectPeers joins two peers to the community and waits until they are connected to each other
+func ConnectPeers(ctx context.Context, addr string, community string, config handlers.ClientManagerConfig) (*Peer, *Peer, error) {
+	first := NewPeer(addr, community, config)
+	second := NewPeer(addr, community, config)
+
+	if err := first.WaitForOpen(ctx); err != nil {
+		return nil, nil, errors.New("Could not connect first peer: " + err.Error())
+	}
+
+	if err := second.WaitForOpen(ctx); err != nil {
+		return nil, nil, errors.New("Could not connect second peer: " + err.Error())
+	}
+
+	return first, second, nil
+}
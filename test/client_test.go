@@ -0,0 +1,3954 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alphahorizonio/libentangle/internal/logging"
+	"github.com/alphahorizonio/libentangle/internal/testhooks"
+	dataApi "github.com/alphahorizonio/libentangle/pkg/api/datachannels/v1"
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/clock"
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+	"github.com/alphahorizonio/libentangle/pkg/networking"
+	"github.com/alphahorizonio/libentangle/pkg/signaling/signalingtest"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestKeepaliveEviction(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	disconnected := make(chan string, 1)
+
+	peer := signalingtest.NewPeer(addr, "keepalive", handlers.ClientManagerConfig{
+		KeepaliveInterval: 50 * time.Millisecond,
+		KeepaliveTimeout:  300 * time.Millisecond,
+		OnDisconnected: func(mac string) {
+			disconnected <- mac
+		},
+	})
+
+	// The second peer never sends keepalives, so it must get evicted
+	silentPeer := signalingtest.NewPeer(addr, "keepalive", handlers.ClientManagerConfig{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := peer.WaitForOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case mac := <-disconnected:
+		if mac != silentPeer.Manager.Mac() {
+			t.Errorf("expected %v to be evicted, got %v", silentPeer.Manager.Mac(), mac)
+		}
+	case <-ctx.Done():
+		t.Fatal("silent peer was not evicted")
+	}
+
+	select {
+	case <-silentPeer.Messages:
+		t.Error("keepalive was delivered to the message callback")
+	default:
+	}
+}
+
+func TestKeepaliveEvictionFakeClock(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	fake := clock.NewFake(time.Now())
+	disconnected := make(chan string, 1)
+
+	peer := signalingtest.NewPeer(addr, "fake-keepalive", handlers.ClientManagerConfig{
+		KeepaliveInterval: time.Second,
+		KeepaliveTimeout:  3 * time.Second,
+		OnDisconnected: func(mac string) {
+			disconnected <- mac
+		},
+		Clock: fake,
+	})
+	silentPeer := signalingtest.NewPeer(addr, "fake-keepalive", handlers.ClientManagerConfig{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := peer.WaitForOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the keepalive loop to start before advancing past its interval
+	if err := fake.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Advance(2 * time.Second)
+
+	// The keepalive loop re-arms its timer once it checked the peer, which is still within the timeout
+	if err := fake.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case mac := <-disconnected:
+		t.Fatalf("%v was evicted before the timeout", mac)
+	default:
+	}
+
+	fake.Advance(2 * time.Second)
+
+	select {
+	case mac := <-disconnected:
+		if mac != silentPeer.Manager.Mac() {
+			t.Errorf("expected %v to be evicted, got %v", silentPeer.Manager.Mac(), mac)
+		}
+	case <-ctx.Done():
+		t.Fatal("silent peer was not evicted")
+	}
+}
+
+func TestHandshakeConcurrencyLimit(t *testing.T) {
+	const limit = 3
+
+	offers := make(chan api.Offer, 50)
+	macs := []string{}
+	for i := 0; i < 50; i++ {
+		macs = append(macs, fmt.Sprintf("peer-%v", i))
+	}
+
+	addr := startIntroducingSignalingServer(t, macs, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			var offer api.Offer
+			if err := json.Unmarshal(data, &offer); err == nil {
+				offers <- offer
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		MaxConcurrentHandshakes: limit,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "handshakes", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	// None of the handshakes can complete, so only the first ones may be started
+	timeout := time.After(2 * time.Second)
+	count := 0
+	for {
+		select {
+		case <-offers:
+			count++
+
+			if count > limit {
+				t.Fatalf("more than %v handshakes were started concurrently", limit)
+			}
+		case <-timeout:
+			if count != limit {
+				t.Fatalf("expected %v handshakes to be started, got %v", limit, count)
+			}
+
+			return
+		}
+	}
+}
+
+func TestICEStateChange(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type change struct {
+		mac   string
+		state webrtc.ICEConnectionState
+	}
+
+	peers := []*signalingtest.Peer{}
+	changes := []chan change{}
+	for i := 0; i < 2; i++ {
+		changed := make(chan change, 16)
+
+		peers = append(peers, signalingtest.NewPeer(addr, "ice", handlers.ClientManagerConfig{
+			ICEServers: []webrtc.ICEServer{},
+			OnICEStateChange: func(mac string, state webrtc.ICEConnectionState) {
+				changed <- change{mac, state}
+			},
+		}))
+		changes = append(changes, changed)
+	}
+
+	for _, peer := range peers {
+		if err := peer.WaitForOpen(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each peer reports the state of its connection to the other one
+	for i, changed := range changes {
+		remote := peers[1-i].Manager.Mac()
+
+		for connected := false; !connected; {
+			select {
+			case c := <-changed:
+				if c.mac != remote {
+					t.Fatalf("expected state change of %v, got one of %v", remote, c.mac)
+				}
+
+				connected = c.state == webrtc.ICEConnectionStateConnected
+			case <-ctx.Done():
+				t.Fatal("connected ICE state was not reported")
+			}
+		}
+	}
+}
+
+func TestRelayTransportPolicy(t *testing.T) {
+	candidates := make(chan struct{}, 10)
+	offers := make(chan struct{}, 1)
+
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		switch opcode {
+		case api.OpcodeOffer:
+			offers <- struct{}{}
+		case api.OpcodeCandidate:
+			candidates <- struct{}{}
+		}
+	})
+
+	// Without any TURN server, a relay-only policy must not gather any candidates
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:         []webrtc.ICEServer{},
+		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "relay", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	select {
+	case <-candidates:
+		t.Fatal("non-relay candidate was sent")
+	case <-time.After(time.Second):
+	}
+}
+
+func TestHostOnlyICEServers(t *testing.T) {
+	// A local STUN server, which notices any binding request but never answers it
+	stun, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Close()
+
+	bindings := make(chan struct{}, 100)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := stun.ReadFrom(buf); err != nil {
+				return
+			}
+
+			select {
+			case bindings <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	defaults := handlers.DefaultICEServers
+	handlers.DefaultICEServers = []webrtc.ICEServer{{URLs: []string{"stun:" + stun.LocalAddr().String()}}}
+	defer func() {
+		handlers.DefaultICEServers = defaults
+	}()
+
+	for _, test := range []struct {
+		name       string
+		iceServers []webrtc.ICEServer
+		binding    bool
+	}{
+		{"default", nil, true},
+		{"empty", []webrtc.ICEServer{}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			candidates := make(chan api.Candidate, 100)
+			offers := make(chan struct{}, 1)
+
+			addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+				switch opcode {
+				case api.OpcodeOffer:
+					offers <- struct{}{}
+				case api.OpcodeCandidate:
+					var candidate api.Candidate
+					if err := json.Unmarshal(data, &candidate); err == nil {
+						candidates <- candidate
+					}
+				}
+			})
+
+			manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+				ICEServers: test.iceServers,
+			})
+
+			networking.NewConnectionManager(manager).Connect(addr, "lan-"+test.name, func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+			select {
+			case <-offers:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no offer was sent")
+			}
+
+			timeout := time.After(2 * time.Second)
+			bound := false
+			for {
+				select {
+				case <-bindings:
+					if !test.binding {
+						t.Fatal("STUN binding request was sent without any ICE servers")
+					}
+
+					bound = true
+				case candidate := <-candidates:
+					for _, payload := range candidate.Payloads() {
+						if !strings.Contains(string(payload), "typ host") {
+							t.Fatalf("expected only host candidates, got %s", payload)
+						}
+					}
+				case <-timeout:
+					if test.binding && !bound {
+						t.Fatal("no STUN binding request was sent to the default ICE servers")
+					}
+
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestConnectPeers(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "harness", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-second.Messages:
+		var w dataApi.WrappedMessage
+		if err := json.Unmarshal(msg.Data, &w); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Mac != first.Manager.Mac() || string(w.Payload) != "hello" {
+			t.Errorf("unexpected message %v from %v", string(w.Payload), w.Mac)
+		}
+	case <-ctx.Done():
+		t.Fatal("message was not received")
+	}
+}
+
+func receive(t *testing.T, ctx context.Context, peer *signalingtest.Peer) dataApi.WrappedMessage {
+	select {
+	case msg := <-peer.Messages:
+		var w dataApi.WrappedMessage
+		if err := json.Unmarshal(msg.Data, &w); err != nil {
+			t.Fatal(err)
+		}
+
+		return w
+	case <-ctx.Done():
+		t.Fatal("message was not received")
+	}
+
+	return dataApi.WrappedMessage{}
+}
+
+func TestMultipleCommunities(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnected := make(chan string, 2)
+
+	peer := signalingtest.NewPeer(addr, "first", handlers.ClientManagerConfig{
+		OnDisconnected: func(mac string) {
+			disconnected <- mac
+		},
+	})
+	firstMember := signalingtest.NewPeer(addr, "first", handlers.ClientManagerConfig{})
+
+	if err := peer.WaitForOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	secondMember := signalingtest.NewPeer(addr, "second", handlers.ClientManagerConfig{})
+	if err := peer.Connection.Join("second"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.WaitForOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range []*signalingtest.Peer{firstMember, secondMember} {
+		if err := peer.Manager.SendMessageUnicast([]byte("hello"), member.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := receive(t, ctx, member); string(w.Payload) != "hello" {
+			t.Errorf("unexpected message %v", string(w.Payload))
+		}
+	}
+
+	// Leaving the first community must only close the connection to its members
+	if err := peer.Connection.Leave("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case mac := <-disconnected:
+		if mac != firstMember.Manager.Mac() {
+			t.Errorf("expected %v to be disconnected, got %v", firstMember.Manager.Mac(), mac)
+		}
+	case <-ctx.Done():
+		t.Fatal("peer of the left community was not disconnected")
+	}
+
+	if err := peer.Manager.SendMessageUnicast([]byte("still here"), secondMember.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := receive(t, ctx, secondMember); string(w.Payload) != "still here" {
+		t.Errorf("unexpected message %v", string(w.Payload))
+	}
+}
+
+func TestIsConnected(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	peer := signalingtest.NewPeer(addr, "connected", handlers.ClientManagerConfig{})
+	if peer.Manager.IsConnected("unknown") {
+		t.Error("unknown peer is reported as connected")
+	}
+
+	other := signalingtest.NewPeer(addr, "connected", handlers.ClientManagerConfig{})
+	if err := peer.WaitForOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !peer.Manager.IsConnected(other.Manager.Mac()) {
+		t.Error("open peer is not reported as connected")
+	}
+
+	if err := peer.Connection.Leave("connected"); err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Manager.IsConnected(other.Manager.Mac()) {
+		t.Error("closed peer is still reported as connected")
+	}
+}
+
+func TestSendRateThrottling(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const rate = 64 * 1024
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "throttling", handlers.ClientManagerConfig{
+		MaxSendRate: rate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 1024)
+
+	sent := 0
+	start := time.Now()
+	for i := 0; i < 32; i++ {
+		if err := first.Manager.SendMessageUnicast(payload, second.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		sent += len(payload)
+	}
+
+	// The envelope adds some overhead, so the payload throughput must stay below the cap
+	if throughput := float64(sent) / time.Since(start).Seconds(); throughput > rate*1.1 {
+		t.Errorf("throughput of %v bytes/s exceeds cap of %v bytes/s", int(throughput), rate)
+	}
+}
+
+func TestOnConnectedReceivesPeer(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	onConnected := func(connected chan string) func(mac string, channel *webrtc.DataChannel) {
+		return func(mac string, channel *webrtc.DataChannel) {
+			if channel == nil || channel.ReadyState() != webrtc.DataChannelStateOpen {
+				t.Error("channel passed to onConnected is not open")
+			}
+
+			connected <- mac
+		}
+	}
+
+	firstConnected := make(chan string, 1)
+	first := handlers.NewClientManager(onConnected(firstConnected))
+	networking.NewConnectionManager(first).Connect(addr, "connected", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	secondConnected := make(chan string, 1)
+	second := handlers.NewClientManager(onConnected(secondConnected))
+	networking.NewConnectionManager(second).Connect(addr, "connected", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	// Both open paths, the offering and the answering side, must report the respective other peer
+	for _, c := range []struct {
+		connected chan string
+		manager   *handlers.ClientManager
+		expected  *handlers.ClientManager
+	}{
+		{firstConnected, first, second},
+		{secondConnected, second, first},
+	} {
+		select {
+		case mac := <-c.connected:
+			if mac != c.expected.Mac() {
+				t.Errorf("expected %v to be passed to onConnected of %v, got %v", c.expected.Mac(), c.manager.Mac(), mac)
+			}
+		case <-ctx.Done():
+			t.Fatal("onConnected was not called")
+		}
+	}
+}
+
+func TestDataChannelInit(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	protocol := "control"
+	ordered := false
+
+	channels := make(chan *webrtc.DataChannel, 2)
+	onConnected := func(mac string, channel *webrtc.DataChannel) {
+		channels <- channel
+	}
+
+	config := handlers.ClientManagerConfig{
+		DataChannelInit: &webrtc.DataChannelInit{
+			Protocol: &protocol,
+			Ordered:  &ordered,
+		},
+	}
+
+	networking.NewConnectionManager(handlers.NewClientManagerWithConfig(onConnected, config)).Connect(addr, "init", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+	networking.NewConnectionManager(handlers.NewClientManagerWithConfig(onConnected, config)).Connect(addr, "init", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	// The options must reach both the created and the announced channel
+	for i := 0; i < 2; i++ {
+		select {
+		case channel := <-channels:
+			if channel.Protocol() != protocol || channel.Ordered() != ordered {
+				t.Errorf("expected channel with protocol %v and ordered %v, got %v and %v", protocol, ordered, channel.Protocol(), channel.Ordered())
+			}
+		case <-ctx.Done():
+			t.Fatal("channel was not opened")
+		}
+	}
+}
+
+func TestDataChannelProtocol(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	channels := make(chan *webrtc.DataChannel, 2)
+	onConnected := func(mac string, channel *webrtc.DataChannel) {
+		channels <- channel
+	}
+
+	// The protocol takes the place of the one of the channel options
+	protocol := "control"
+	config := handlers.ClientManagerConfig{
+		DataChannelInit: &webrtc.DataChannelInit{
+			Protocol: &protocol,
+		},
+		DataChannelProtocol: "entangle/2",
+	}
+
+	networking.NewConnectionManager(handlers.NewClientManagerWithConfig(onConnected, config)).Connect(addr, "protocol", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+	networking.NewConnectionManager(handlers.NewClientManagerWithConfig(onConnected, config)).Connect(addr, "protocol", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	// Both the created and the announced channel use the protocol
+	for i := 0; i < 2; i++ {
+		select {
+		case channel := <-channels:
+			if channel.Protocol() != "entangle/2" {
+				t.Errorf("expected channel with protocol entangle/2, got %v", channel.Protocol())
+			}
+		case <-ctx.Done():
+			t.Fatal("channel was not opened")
+		}
+	}
+}
+
+func TestDataChannelProtocolMismatch(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The member which joins first offers, so that its channel is announced to the second one
+	offerer := signalingtest.NewPeer(addr, "mismatch", handlers.ClientManagerConfig{
+		DataChannelProtocol: "entangle/1",
+	})
+	for offerer.Manager.Mac() == "" {
+		select {
+		case <-ctx.Done():
+			t.Fatal("offerer was not accepted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	errs := make(chan error, 16)
+	answerer := signalingtest.NewPeer(addr, "mismatch", handlers.ClientManagerConfig{
+		DataChannelProtocol: "entangle/2",
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	for {
+		select {
+		case err := <-errs:
+			var mismatch *handlers.ProtocolMismatch
+			if !errors.As(err, &mismatch) {
+				continue
+			}
+
+			if mismatch.Protocol != "entangle/1" || mismatch.Expected != "entangle/2" {
+				t.Fatalf("expected mismatch of entangle/1 and entangle/2, got %v and %v", mismatch.Protocol, mismatch.Expected)
+			}
+
+			if answerer.Manager.IsConnected(offerer.Manager.Mac()) {
+				t.Error("peer with another protocol is still connected")
+			}
+
+			return
+		case <-ctx.Done():
+			t.Fatal("protocol mismatch was not reported")
+		}
+	}
+}
+
+func TestMeshComplete(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	completed := make([]chan struct{}, 3)
+	configs := make([]handlers.ClientManagerConfig, 3)
+	for i := range configs {
+		c := make(chan struct{}, 10)
+
+		completed[i] = c
+		configs[i] = handlers.ClientManagerConfig{
+			OnMeshComplete: func() {
+				c <- struct{}{}
+			},
+		}
+	}
+
+	wait := func(i int) {
+		select {
+		case <-completed[i]:
+		case <-ctx.Done():
+			t.Fatalf("mesh of peer %v did not complete", i)
+		}
+	}
+
+	signalingtest.NewPeer(addr, "mesh", configs[0])
+	signalingtest.NewPeer(addr, "mesh", configs[1])
+
+	wait(0)
+	wait(1)
+
+	// The mesh breaks once the third peer joins and completes again once it is connected
+	signalingtest.NewPeer(addr, "mesh", configs[2])
+
+	wait(2)
+	wait(0)
+	wait(1)
+
+	time.Sleep(500 * time.Millisecond)
+
+	for i, c := range completed {
+		select {
+		case <-c:
+			t.Errorf("mesh complete of peer %v fired more than once", i)
+		default:
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	payload := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 512)
+
+	// The receiver records the messages as they are sent over the wire
+	var lock sync.Mutex
+	channels := map[string]*webrtc.DataChannel{}
+	receiverComplete := make(chan struct{}, 1)
+	receiver := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		channels[mac] = channel
+	}, handlers.ClientManagerConfig{
+		OnMeshComplete: func() {
+			receiverComplete <- struct{}{}
+		},
+	})
+	networking.NewConnectionManager(receiver).Connect(addr, "compression", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	complete := make(chan struct{}, 2)
+	onMeshComplete := func() {
+		complete <- struct{}{}
+	}
+
+	compressing := signalingtest.NewPeer(addr, "compression", handlers.ClientManagerConfig{
+		Compression:    dataApi.CompressionZstd,
+		OnMeshComplete: onMeshComplete,
+	})
+	plain := signalingtest.NewPeer(addr, "compression", handlers.ClientManagerConfig{
+		OnMeshComplete: onMeshComplete,
+	})
+
+	for _, c := range []chan struct{}{receiverComplete, complete, complete} {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			t.Fatal("peers were not connected to each other")
+		}
+	}
+
+	wire := make(chan dataApi.WrappedMessage, 2)
+	sizes := map[string]int{}
+	lock.Lock()
+	for mac, channel := range channels {
+		mac := mac
+
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var w dataApi.WrappedMessage
+			if err := json.Unmarshal(msg.Data, &w); err != nil || w.Opcode != "" {
+				return
+			}
+
+			lock.Lock()
+			sizes[mac] = len(msg.Data)
+			lock.Unlock()
+
+			wire <- w
+		})
+	}
+	lock.Unlock()
+
+	for _, peer := range []*signalingtest.Peer{compressing, plain} {
+		if err := peer.Manager.SendMessageUnicast(payload, receiver.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case w := <-wire:
+			if peer == compressing && w.Compression != dataApi.CompressionZstd {
+				t.Errorf("expected payload compressed with %v, got %v", dataApi.CompressionZstd, w.Compression)
+			}
+		case <-ctx.Done():
+			t.Fatal("message was not received")
+		}
+	}
+
+	lock.Lock()
+	compressedSize, plainSize := sizes[compressing.Manager.Mac()], sizes[plain.Manager.Mac()]
+	lock.Unlock()
+
+	if compressedSize*10 > plainSize {
+		t.Errorf("expected compressed message to be at most a tenth of %v bytes, got %v bytes", plainSize, compressedSize)
+	}
+
+	// Peers decompress transparently
+	if err := compressing.Manager.SendMessageUnicast(payload, plain.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, plain)
+	if !bytes.Equal(w.Payload, payload) || w.Compression != "" {
+		t.Errorf("payload was not decompressed")
+	}
+}
+
+func TestCancelHandshake(t *testing.T) {
+	offers := make(chan api.Offer, 2)
+
+	addr := startIntroducingSignalingServer(t, []string{"first", "second"}, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			var offer api.Offer
+			if err := json.Unmarshal(data, &offer); err == nil {
+				offers <- offer
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		MaxConcurrentHandshakes: 1,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "cancel", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case offer := <-offers:
+		if offer.ReceiverMac != "first" {
+			t.Fatalf("expected offer to first, got %v", offer.ReceiverMac)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	// The second handshake stays queued, as the first one never completes
+	select {
+	case offer := <-offers:
+		t.Fatalf("offer to %v was sent while the handshake limit was reached", offer.ReceiverMac)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := manager.CancelHandshake("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.CancelHandshake("first"); err == nil {
+		t.Error("cancelled handshake could be cancelled again")
+	}
+
+	if manager.IsConnected("first") {
+		t.Error("cancelled peer is still connected")
+	}
+
+	// Cancelling frees the slot for the queued handshake
+	select {
+	case offer := <-offers:
+		if offer.ReceiverMac != "second" {
+			t.Fatalf("expected offer to second, got %v", offer.ReceiverMac)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued handshake was not started")
+	}
+}
+
+func TestReofferKeepsHandshakeSlot(t *testing.T) {
+	offers := make(chan api.Offer, 4)
+
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		for {
+			_, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+
+			var offer api.Offer
+			if err := json.Unmarshal(data, &offer); err == nil && offer.Opcode == api.OpcodeOffer {
+				offers <- offer
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:              []webrtc.ICEServer{},
+		MaxConcurrentHandshakes: 2,
+	})
+
+	conn, _, err := websocket.Dial(context.Background(), "ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	if _, err := remote.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	description, err := remote.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	f := func(msg webrtc.DataChannelMessage) {}
+
+	// The remote offers again before the first handshake completed
+	for i := 0; i < 2; i++ {
+		if err := manager.HandleOffer(conn, &wg, "self", f, *api.NewOffer(data, "first", "self")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := manager.CancelHandshake("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both slots are free again, so neither handshake is queued
+	for _, mac := range []string{"second", "third"} {
+		if err := manager.HandleIntroduction(conn, "self", &wg, f, *api.NewIntroduction(mac, "reoffer")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-offers:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handshake was queued although a slot was free")
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		for {
+			if _, _, err := conn.Read(context.Background()); err != nil {
+				return
+			}
+		}
+	})
+
+	errs := make(chan error, 16)
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:              []webrtc.ICEServer{},
+		MaxConcurrentHandshakes: 1,
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	conn, _, err := websocket.Dial(context.Background(), "ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	f := func(msg webrtc.DataChannelMessage) {}
+
+	// The handshake with second is queued behind the one with first, which never completes
+	for _, mac := range []string{"first", "second"} {
+		if err := manager.HandleIntroduction(conn, "self", &wg, f, *api.NewIntroduction(mac, "errors")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The queued handshake fails in the background once it can't send its offer
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	if err := manager.CancelHandshake("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			var peerErr *handlers.PeerError
+			if !errors.As(err, &peerErr) {
+				t.Fatalf("expected a peer error, got %v", err)
+			}
+
+			if peerErr.Mac == "second" && peerErr.Phase == handlers.PhaseHandshake {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("failed handshake was not reported")
+		}
+	}
+}
+
+func TestNegotiatedDataChannel(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	negotiated := true
+	id := uint16(7)
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "negotiated", handlers.ClientManagerConfig{
+		DataChannelInit: &webrtc.DataChannelInit{
+			Negotiated: &negotiated,
+			ID:         &id,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, second)
+	if w.Mac != first.Manager.Mac() || string(w.Payload) != "hello" {
+		t.Errorf("unexpected message %v from %v", string(w.Payload), w.Mac)
+	}
+}
+
+func TestSendMessageUnicastCtxCancellation(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const rate = 1024
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "cancellation", handlers.ClientManagerConfig{
+		MaxSendRate: rate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sending this uses up the budget of the next ten seconds, so the following send blocks
+	if err := first.Manager.SendMessageUnicast(make([]byte, 10*rate), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	sendCtx, sendCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer sendCancel()
+
+	start := time.Now()
+	if err := first.Manager.SendMessageUnicastCtx(sendCtx, []byte("blocked"), second.Manager.Mac()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cancelled send returned after %v", elapsed)
+	}
+}
+
+func TestSendMessageUnicastCtxBlockedSend(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "blocked", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first send holds the send slot of the peer until it is released
+	blocked := make(chan struct{})
+	released := make(chan struct{})
+	var once sync.Once
+	t.Cleanup(testhooks.SetBeforeSend(func(mac string) {
+		once.Do(func() {
+			close(blocked)
+
+			<-released
+		})
+	}))
+	defer close(released)
+
+	go first.Manager.SendMessageUnicast([]byte("stuck"), second.Manager.Mac())
+
+	select {
+	case <-blocked:
+	case <-ctx.Done():
+		t.Fatal("first send did not start")
+	}
+
+	sendCtx, sendCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer sendCancel()
+
+	if err := first.Manager.SendMessageUnicastCtx(sendCtx, []byte("waiting"), second.Manager.Mac()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Close waits for the stuck send, but sends which start in the meantime fail right away
+	go first.Manager.Close()
+
+	for {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		err := first.Manager.SendMessageUnicastCtx(attemptCtx, []byte("closing"), second.Manager.Mac())
+		attemptCancel()
+
+		if errors.Is(err, handlers.ErrClosed) {
+			break
+		}
+
+		if ctx.Err() != nil {
+			t.Fatal("send during close did not fail with ErrClosed")
+		}
+	}
+}
+
+func TestHandshakeDuration(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	durations := make(chan time.Duration, 2)
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "duration", handlers.ClientManagerConfig{
+		OnHandshakeComplete: func(mac string, duration time.Duration) {
+			durations <- duration
+		},
+		HandshakeDurationBuckets: []time.Duration{time.Millisecond, time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case duration := <-durations:
+			if duration <= 0 {
+				t.Errorf("expected a positive handshake duration, got %v", duration)
+			}
+		case <-ctx.Done():
+			t.Fatal("handshake duration was not reported")
+		}
+	}
+
+	for _, peer := range []*signalingtest.Peer{first, second} {
+		counts := peer.Manager.HandshakeDurations()
+		if len(counts) != 3 || counts[0]+counts[1] != 1 || counts[2] != 0 {
+			t.Errorf("expected a single handshake below a minute, got buckets %v", counts)
+		}
+	}
+}
+
+func TestMalformedSessionDescription(t *testing.T) {
+	malformed := func(sdpType webrtc.SDPType) []byte {
+		data, err := json.Marshal(webrtc.SessionDescription{Type: sdpType, SDP: "malformed"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return data
+	}
+
+	thirdOffered := make(chan struct{}, 1)
+
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("malformed")); err != nil {
+			return
+		}
+
+		var ready api.Ready
+		if err := wsjson.Read(context.Background(), conn, &ready); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewOffer(malformed(webrtc.SDPTypeOffer), "offerer", application.Mac)); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewIntroduction("answerer", "malformed")); err != nil {
+			return
+		}
+
+		for {
+			var offer api.Offer
+			if err := wsjson.Read(context.Background(), conn, &offer); err != nil {
+				return
+			}
+
+			if offer.Opcode != api.OpcodeOffer {
+				continue
+			}
+
+			switch offer.ReceiverMac {
+			case "answerer":
+				if err := wsjson.Write(context.Background(), conn, api.NewAnswer(malformed(webrtc.SDPTypeAnswer), "answerer", application.Mac)); err != nil {
+					return
+				}
+
+				if err := wsjson.Write(context.Background(), conn, api.NewIntroduction("third", "malformed")); err != nil {
+					return
+				}
+			case "third":
+				thirdOffered <- struct{}{}
+			}
+		}
+	})
+
+	// Leaked handshakes would hold on to the only slot
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		MaxConcurrentHandshakes: 1,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "malformed", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-thirdOffered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed handshakes did not release their slot")
+	}
+
+	for _, mac := range []string{"offerer", "answerer"} {
+		if err := manager.CancelHandshake(mac); err == nil {
+			t.Errorf("failed handshake with %v was left behind", mac)
+		}
+	}
+}
+
+func TestReuseConnections(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "reuse", handlers.ClientManagerConfig{
+		ReuseConnections: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := second.Manager.PeerConnection(first.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.RestartICE(second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restart is done once the answer has been applied
+	offerer, err := first.Manager.PeerConnection(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for offerer.SignalingState() != webrtc.SignalingStateStable {
+		select {
+		case <-ctx.Done():
+			t.Fatal("renegotiation did not complete")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	after, err := second.Manager.PeerConnection(first.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after != before {
+		t.Error("connection was recreated instead of being renegotiated")
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, second)
+	if w.Mac != first.Manager.Mac() || string(w.Payload) != "hello" {
+		t.Errorf("unexpected message %v from %v", string(w.Payload), w.Mac)
+	}
+}
+
+func TestStaleOffer(t *testing.T) {
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	if _, err := remote.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	description, err := remote.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answers := make(chan api.Answer, 10)
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("test")); err != nil {
+			return
+		}
+
+		var ready api.Ready
+		if err := wsjson.Read(context.Background(), conn, &ready); err != nil {
+			return
+		}
+
+		// The offer with epoch 1 arrives after the newer one, followed by a duplicate of the newer one
+		for _, epoch := range []uint64{2, 1, 2} {
+			offer := api.NewOffer(payload, "remote", application.Mac)
+			offer.Epoch = epoch
+
+			if err := wsjson.Write(context.Background(), conn, offer); err != nil {
+				return
+			}
+		}
+
+		for {
+			_, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+
+			var answer api.Answer
+			if err := json.Unmarshal(data, &answer); err == nil && answer.Opcode == api.OpcodeAnswer {
+				answers <- answer
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "stale", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case answer := <-answers:
+		if answer.Epoch != 2 {
+			t.Errorf("expected an answer to epoch 2, got %v", answer.Epoch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("offer was not answered")
+	}
+
+	select {
+	case answer := <-answers:
+		t.Errorf("stale offer %v was answered", answer.Epoch)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestExpiredOfferClient(t *testing.T) {
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	if _, err := remote.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	description, err := remote.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answers := make(chan api.Answer, 10)
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("test")); err != nil {
+			return
+		}
+
+		var ready api.Ready
+		if err := wsjson.Read(context.Background(), conn, &ready); err != nil {
+			return
+		}
+
+		// The first offer was sent a minute ago and expired after a second
+		expired := api.NewOffer(payload, "remote", application.Mac)
+		expired.Epoch = 1
+		expired.SetTTL(time.Now().Add(-time.Minute), time.Second)
+
+		fresh := api.NewOffer(payload, "remote", application.Mac)
+		fresh.Epoch = 2
+		fresh.SetTTL(time.Now(), time.Minute)
+
+		for _, offer := range []*api.Offer{expired, fresh} {
+			if err := wsjson.Write(context.Background(), conn, offer); err != nil {
+				return
+			}
+		}
+
+		for {
+			_, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+
+			var answer api.Answer
+			if err := json.Unmarshal(data, &answer); err == nil && answer.Opcode == api.OpcodeAnswer {
+				answers <- answer
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:   []webrtc.ICEServer{},
+		SignalingTTL: 10 * time.Second,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "expired", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case answer := <-answers:
+		if answer.Epoch != 2 {
+			t.Errorf("expected an answer to epoch 2, got %v", answer.Epoch)
+		}
+
+		if answer.TTL != (10 * time.Second).Milliseconds() {
+			t.Errorf("expected the answer to expire after 10s, got %vms", answer.TTL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("offer was not answered")
+	}
+
+	select {
+	case answer := <-answers:
+		t.Errorf("expired offer %v was answered", answer.Epoch)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestStaleAnswer(t *testing.T) {
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+	defer manager.Close()
+
+	conn := signalingtest.NewConn()
+
+	var wg sync.WaitGroup
+	if err := manager.HandleIntroduction(conn, "self", &wg, func(msg webrtc.DataChannelMessage) {}, *api.NewIntroduction("peer", "stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	var offer api.Offer
+	for i, message := range conn.Messages() {
+		if message.Opcode == api.OpcodeOffer {
+			if err := conn.Decode(i, &offer); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if offer.Epoch == 0 {
+		t.Fatal("introduction was not offered")
+	}
+
+	// The answer belongs to an earlier offer, so the handshake waits for none
+	answer := api.NewAnswer([]byte("answer"), "peer", "self")
+	answer.Epoch = offer.Epoch - 1
+
+	if err := manager.HandleAnswer(&wg, *answer); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale answer blocked the handshake")
+	}
+}
+
+func TestResolver(t *testing.T) {
+	offers := make(chan struct{}, 1)
+
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			offers <- struct{}{}
+		}
+	})
+
+	// The lookup fails, so the STUN server is left to pion to resolve
+	consulted := make(chan string, 10)
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.split.example:3478"},
+			},
+		},
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				consulted <- address
+
+				return nil, errors.New("unreachable")
+			},
+		},
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "resolver", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-consulted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("custom resolver was not consulted")
+	}
+
+	select {
+	case <-offers:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no offer was sent after the lookup failed")
+	}
+}
+
+func TestMaxCandidates(t *testing.T) {
+	const max = 1
+
+	candidates := make(chan struct{}, 100)
+	offers := make(chan struct{}, 1)
+
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		switch opcode {
+		case api.OpcodeOffer:
+			offers <- struct{}{}
+		case api.OpcodeCandidate:
+			candidates <- struct{}{}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:    []webrtc.ICEServer{},
+		MaxCandidates: max,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "candidates", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	timeout := time.After(2 * time.Second)
+	count := 0
+	for {
+		select {
+		case <-candidates:
+			count++
+
+			if count > max {
+				t.Fatalf("more than %v candidates were sent", max)
+			}
+		case <-timeout:
+			if count == 0 {
+				t.Fatal("no candidate was sent")
+			}
+
+			return
+		}
+	}
+}
+
+func TestCandidateBatch(t *testing.T) {
+	candidates := make(chan api.Candidate, 100)
+	offers := make(chan struct{}, 1)
+
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		switch opcode {
+		case api.OpcodeOffer:
+			offers <- struct{}{}
+		case api.OpcodeCandidate:
+			var candidate api.Candidate
+			if err := json.Unmarshal(data, &candidate); err == nil {
+				candidates <- candidate
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:             []webrtc.ICEServer{},
+		CandidateBatchInterval: time.Second,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "batch", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	// Host candidates are gathered at once, so they all end up in the same batch
+	var candidate api.Candidate
+	select {
+	case candidate = <-candidates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no candidate was sent")
+	}
+
+	select {
+	case other := <-candidates:
+		t.Fatalf("expected a single candidate message, got another one with %v candidates", len(other.Payloads()))
+	case <-time.After(2 * time.Second):
+	}
+
+	if len(candidate.Payloads()) < 2 {
+		t.Skip("only a single host candidate was gathered")
+	}
+
+	for _, payload := range candidate.Payloads() {
+		if !strings.HasPrefix(string(payload), "candidate:") {
+			t.Errorf("expected a candidate in the batch, got %q", payload)
+		}
+	}
+}
+
+func TestCandidateBatchConnects(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "batch", handlers.ClientManagerConfig{
+		CandidateBatchInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, second)
+	if string(w.Payload) != "hello" {
+		t.Errorf("unexpected message %v", string(w.Payload))
+	}
+}
+
+// flakyConn fails the first writes of candidates, as if the signaling connection was interrupted
+type flakyConn struct {
+	*signalingtest.Conn
+
+	lock     sync.Mutex
+	failures int
+	failed   []string
+}
+
+func (c *flakyConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	var candidate api.Candidate
+	if err := json.Unmarshal(p, &candidate); err == nil && candidate.Opcode == api.OpcodeCandidate {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if c.failures > 0 {
+			c.failures--
+			c.failed = append(c.failed, string(candidate.Payload))
+
+			return errors.New("Signaling connection was interrupted")
+		}
+	}
+
+	return c.Conn.Write(ctx, typ, p)
+}
+
+func TestCandidateRetries(t *testing.T) {
+	errs := make(chan error, 16)
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:            []webrtc.ICEServer{},
+		CandidateRetryBackoff: 10 * time.Millisecond,
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+
+	conn := &flakyConn{Conn: signalingtest.NewConn(), failures: 3}
+
+	var wg sync.WaitGroup
+	if err := manager.HandleIntroduction(conn, "self", &wg, func(msg webrtc.DataChannelMessage) {}, *api.NewIntroduction("peer", "retries")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each candidate whose write failed is sent once the connection recovers
+	timeout := time.After(5 * time.Second)
+	for {
+		conn.lock.Lock()
+		failed := append([]string{}, conn.failed...)
+		failures := conn.failures
+		conn.lock.Unlock()
+
+		sent := map[string]bool{}
+		for i, message := range conn.Messages() {
+			if message.Opcode != api.OpcodeCandidate {
+				continue
+			}
+
+			var candidate api.Candidate
+			if err := conn.Decode(i, &candidate); err != nil {
+				t.Fatal(err)
+			}
+
+			sent[string(candidate.Payload)] = true
+		}
+
+		missing := failures > 0
+		for _, payload := range failed {
+			if !sent[payload] {
+				missing = true
+			}
+		}
+
+		if !missing {
+			break
+		}
+
+		select {
+		case err := <-errs:
+			t.Fatalf("candidate was not resent: %v", err)
+		case <-timeout:
+			t.Fatalf("candidates %v were not resent, %v writes still fail", failed, failures)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The remaining peer only notices that the other one left once its keepalives time out
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "resume", handlers.ClientManagerConfig{
+		SessionResumption: true,
+		KeepaliveInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reply is sent after the session was announced, so the messages sent after it are numbered
+	go func() {
+		w := receive(t, ctx, second)
+
+		second.Manager.Reply(w.Mac, w.Correlation, nil)
+	}()
+
+	if _, err := first.Manager.Request(ctx, second.Manager.Mac(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	sent := map[string]bool{}
+	delivered := map[string]int{}
+
+	// Messages are received all the time, so that the keepalives of the new connection are not held up
+	duplicates := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case msg := <-second.Messages:
+				var w dataApi.WrappedMessage
+				if err := json.Unmarshal(msg.Data, &w); err != nil {
+					continue
+				}
+
+				lock.Lock()
+				delivered[string(w.Payload)]++
+				if delivered[string(w.Payload)] > 1 {
+					select {
+					case duplicates <- string(w.Payload):
+					default:
+					}
+				}
+				lock.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Concurrent sends to the same peer, while the peer reconnects
+	const senders, count = 4, 100
+
+	var wg sync.WaitGroup
+	for g := 0; g < senders; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < count; i++ {
+				payload := fmt.Sprintf("%v-%v", g, i)
+
+				// Messages which could not be sent at all are not resent either
+				if err := first.Manager.SendMessageUnicast([]byte(payload), second.Manager.Mac()); err == nil {
+					lock.Lock()
+					sent[payload] = true
+					lock.Unlock()
+				}
+
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(g)
+	}
+
+	if err := second.Connection.Leave("resume"); err != nil {
+		t.Fatal(err)
+	}
+
+	for len(first.Manager.Peers()) > 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("peer which left was not evicted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := second.Connection.Join("resume"); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	// Every message which was sent is delivered exactly once, although some were lost with the old connection
+	missing := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+
+		missing := []string{}
+		for payload := range sent {
+			if delivered[payload] == 0 {
+				missing = append(missing, payload)
+			}
+		}
+
+		return missing
+	}
+
+	for len(missing()) > 0 {
+		select {
+		case payload := <-duplicates:
+			t.Fatalf("message %v was delivered twice", payload)
+		case <-ctx.Done():
+			t.Fatalf("messages %v were not delivered", missing())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Duplicates would arrive right after the missed messages
+	select {
+	case payload := <-duplicates:
+		t.Fatalf("message %v was delivered twice", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestICECredentials(t *testing.T) {
+	const (
+		ufrag = "interop"
+		pwd   = "interoperabilitytesting"
+	)
+
+	offers := make(chan api.Offer, 1)
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			var offer api.Offer
+			if err := json.Unmarshal(data, &offer); err == nil {
+				offers <- offer
+			}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers:          []webrtc.ICEServer{},
+		ICEUsernameFragment: ufrag,
+		ICEPassword:         pwd,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "credentials", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	var offer api.Offer
+	select {
+	case offer = <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	var description webrtc.SessionDescription
+	if err := json.Unmarshal(offer.Payload, &description); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"a=ice-ufrag:" + ufrag, "a=ice-pwd:" + pwd} {
+		if !strings.Contains(description.SDP, line) {
+			t.Errorf("expected the offer to contain %v, got %v", line, description.SDP)
+		}
+	}
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		retries int
+		offers  int
+	}{
+		{"retried", 1, 1},
+		{"failed", 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			offers := make(chan struct{}, 10)
+			addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+				if opcode == api.OpcodeOffer {
+					offers <- struct{}{}
+				}
+			})
+
+			// The first offer can't be set as local description
+			attempts := make(chan struct{}, 10)
+			var count int32
+			t.Cleanup(testhooks.SetMungeDescription(func(mac string, description webrtc.SessionDescription) webrtc.SessionDescription {
+				if mac != "peer" {
+					return description
+				}
+
+				attempts <- struct{}{}
+				if atomic.AddInt32(&count, 1) == 1 {
+					description.SDP = "invalid"
+				}
+
+				return description
+			}))
+
+			manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+				ICEServers:            []webrtc.ICEServer{},
+				HandshakeRetries:      test.retries,
+				HandshakeRetryBackoff: 10 * time.Millisecond,
+			})
+
+			networking.NewConnectionManager(manager).Connect(addr, "retries-"+test.name, func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			for i := 0; i <= test.retries; i++ {
+				select {
+				case <-attempts:
+				case <-ctx.Done():
+					t.Fatalf("expected %v attempts, got %v", test.retries+1, i)
+				}
+			}
+
+			for i := 0; i < test.offers; i++ {
+				select {
+				case <-offers:
+				case <-ctx.Done():
+					t.Fatalf("expected %v offers, got %v", test.offers, i)
+				}
+			}
+
+			// The failed handshake is aborted once its attempts are used up
+			for len(manager.PendingPeers()) != test.offers {
+				select {
+				case <-ctx.Done():
+					t.Fatalf("expected %v pending peers, got %v", test.offers, manager.PendingPeers())
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			select {
+			case <-offers:
+				t.Error("expected no further offers")
+			default:
+			}
+		})
+	}
+}
+
+func TestCandidateTypes(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		types []webrtc.ICECandidateType
+		typ   string
+	}{
+		{"host", []webrtc.ICECandidateType{webrtc.ICECandidateTypeHost}, "typ host"},
+		// Without TURN servers there is nothing to gather
+		{"relay", []webrtc.ICECandidateType{webrtc.ICECandidateTypeRelay}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			candidates := make(chan api.Candidate, 100)
+			offers := make(chan struct{}, 1)
+
+			addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+				switch opcode {
+				case api.OpcodeOffer:
+					offers <- struct{}{}
+				case api.OpcodeCandidate:
+					var candidate api.Candidate
+					if err := json.Unmarshal(data, &candidate); err == nil {
+						candidates <- candidate
+					}
+				}
+			})
+
+			// The default STUN servers are skipped, as no server reflexive candidates are wanted
+			manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+				CandidateTypes: test.types,
+			})
+
+			networking.NewConnectionManager(manager).Connect(addr, "types-"+test.name, func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+			select {
+			case <-offers:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no offer was sent")
+			}
+
+			timeout := time.After(2 * time.Second)
+			count := 0
+			for {
+				select {
+				case candidate := <-candidates:
+					for _, payload := range candidate.Payloads() {
+						if test.typ == "" || !strings.Contains(string(payload), test.typ) {
+							t.Fatalf("expected only candidates with %q, got %s", test.typ, payload)
+						}
+
+						count++
+					}
+				case <-timeout:
+					if test.typ != "" && count == 0 {
+						t.Fatal("no candidate was sent")
+					}
+
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestBroadcastExcept(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	complete := make(chan struct{}, 3)
+	config := handlers.ClientManagerConfig{
+		OnMeshComplete: func() {
+			complete <- struct{}{}
+		},
+	}
+
+	sender := signalingtest.NewPeer(addr, "except", config)
+	excluded := signalingtest.NewPeer(addr, "except", config)
+	included := signalingtest.NewPeer(addr, "except", config)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-complete:
+		case <-ctx.Done():
+			t.Fatal("peers were not connected to each other")
+		}
+	}
+
+	if err := sender.Manager.BroadcastExcept(excluded.Manager.Mac(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, included)
+	if w.Mac != sender.Manager.Mac() || string(w.Payload) != "hello" {
+		t.Errorf("unexpected message %v from %v", string(w.Payload), w.Mac)
+	}
+
+	select {
+	case <-excluded.Messages:
+		t.Error("excluded peer received the message")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "json", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type message struct {
+		Text  string `json:"text"`
+		Count int    `json:"count"`
+	}
+
+	sent := message{"hello", 1}
+	if err := first.Manager.SendJSONUnicast(second.Manager.Mac(), sent); err != nil {
+		t.Fatal(err)
+	}
+
+	var received message
+	if err := json.Unmarshal(receive(t, ctx, second).Payload, &received); err != nil {
+		t.Fatal(err)
+	}
+
+	if received != sent {
+		t.Errorf("expected %v, got %v", sent, received)
+	}
+
+	sent = message{"world", 2}
+	if err := second.Manager.BroadcastJSON(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(receive(t, ctx, first).Payload, &received); err != nil {
+		t.Fatal(err)
+	}
+
+	if received != sent {
+		t.Errorf("expected %v, got %v", sent, received)
+	}
+
+	if err := first.Manager.BroadcastJSON(make(chan int)); err == nil {
+		t.Error("expected an error for a value which can't be marshaled")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Replies are not numbered, so the messages sent after them are still delivered in order
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "request", handlers.ClientManagerConfig{
+		OrderedDelivery: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		reply []byte
+		err   error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		reply, err := first.Manager.Request(ctx, second.Manager.Mac(), []byte("ping"))
+
+		results <- result{reply, err}
+	}()
+
+	w := receive(t, ctx, second)
+
+	if err := second.Manager.Reply(w.Mac, w.Correlation, []byte(strings.ToUpper(string(w.Payload)))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := second.Manager.SendMessageUnicast([]byte("after"), w.Mac); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if string(r.reply) != "PING" {
+		t.Errorf("expected reply PING, got %v", string(r.reply))
+	}
+
+	if w := receive(t, ctx, first); string(w.Payload) != "after" {
+		t.Errorf("expected the message sent after the reply, got %v", string(w.Payload))
+	}
+
+	// Nobody replies this time
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer timeoutCancel()
+
+	if _, err := first.Manager.Request(timeoutCtx, second.Manager.Mac(), []byte("ping")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+
+	if w := receive(t, ctx, second); w.Correlation == "" {
+		t.Error("expected the request to have a correlation ID")
+	}
+}
+
+func TestJSONRouter(t *testing.T) {
+	type chat struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+
+	type move struct {
+		Type string `json:"type"`
+		X    int    `json:"x"`
+		Y    int    `json:"y"`
+	}
+
+	chats := []chat{}
+	moves := []move{}
+	unknown := []string{}
+
+	router := handlers.NewJSONRouter(func(mac string, payload []byte) {
+		unknown = append(unknown, string(payload))
+	})
+	router.OnJSON("chat", func(mac string, msg chat) {
+		if mac != "sender" {
+			t.Errorf("expected mac sender, got %v", mac)
+		}
+
+		chats = append(chats, msg)
+	})
+	router.OnJSON("move", func(mac string, msg move) {
+		moves = append(moves, msg)
+	})
+
+	for _, payload := range []string{
+		`{"type":"chat","text":"hello"}`,
+		`{"type":"move","x":1,"y":2}`,
+		`{"type":"unknown"}`,
+		`not json`,
+	} {
+		data, err := json.Marshal(dataApi.WrappedMessage{Mac: "sender", Payload: []byte(payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		router.HandleMessage(webrtc.DataChannelMessage{Data: data})
+	}
+
+	if !reflect.DeepEqual(chats, []chat{{"chat", "hello"}}) {
+		t.Errorf("unexpected chat messages %v", chats)
+	}
+
+	if !reflect.DeepEqual(moves, []move{{"move", 1, 2}}) {
+		t.Errorf("unexpected move messages %v", moves)
+	}
+
+	if !reflect.DeepEqual(unknown, []string{`{"type":"unknown"}`, `not json`}) {
+		t.Errorf("unexpected fallback messages %v", unknown)
+	}
+}
+
+func TestJSONRouterInvalidHandler(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a handler without a mac")
+		}
+	}()
+
+	handlers.NewJSONRouter(nil).OnJSON("chat", func(text string, count int, extra bool) {})
+}
+
+func TestConnectionManagerClose(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnected := make(chan string, 1)
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "close", handlers.ClientManagerConfig{
+		OnDisconnected: func(mac string) {
+			disconnected <- mac
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Connection.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if peers := first.Manager.Peers(); len(peers) != 0 {
+		t.Errorf("expected all peers to be closed, got %v", peers)
+	}
+
+	select {
+	case mac := <-disconnected:
+		if mac != second.Manager.Mac() {
+			t.Errorf("expected %v to be disconnected, got %v", second.Manager.Mac(), mac)
+		}
+	case <-ctx.Done():
+		t.Fatal("peer was not disconnected")
+	}
+
+	// The closed client exited, so it is no member of the community anymore
+	for i := 0; ; i++ {
+		_, acceptance := apply(t, addr, "close", fmt.Sprintf("observer-%v", i))
+
+		members := []string{}
+		for _, member := range acceptance.Members {
+			if !strings.HasPrefix(member, "observer-") {
+				members = append(members, member)
+			}
+		}
+
+		if reflect.DeepEqual(members, []string{second.Manager.Mac()}) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected only %v to remain in the community, got %v", second.Manager.Mac(), members)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Closing again is a no-op
+	if err := first.Connection.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectionInfo(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Without any STUN or TURN server, the peers can only connect directly
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "info", handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, peers := range [][2]*signalingtest.Peer{{first, second}, {second, first}} {
+		info, err := peers[0].Manager.ConnectionInfo(peers[1].Manager.Mac())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.LocalCandidateType != webrtc.ICECandidateTypeHost || info.RemoteCandidateType != webrtc.ICECandidateTypeHost {
+			t.Errorf("expected host candidates, got local %v and remote %v", info.LocalCandidateType, info.RemoteCandidateType)
+		}
+
+		if info.Relayed() {
+			t.Error("direct connection is reported as relayed")
+		}
+
+		if info.Mac != peers[1].Manager.Mac() || info.Handshaking {
+			t.Errorf("expected a completed handshake with %v, got %+v", peers[1].Manager.Mac(), info)
+		}
+
+		if info.ConnectionState != webrtc.PeerConnectionStateConnected || info.ICEConnectionState != webrtc.ICEConnectionStateConnected {
+			t.Errorf("expected connected states, got %v and %v", info.ConnectionState, info.ICEConnectionState)
+		}
+
+		if info.SelectedPair == nil || info.SelectedPair.Local.Typ != webrtc.ICECandidateTypeHost {
+			t.Errorf("expected a selected pair of host candidates, got %v", info.SelectedPair)
+		}
+
+		if len(info.ChannelLabels) != 1 {
+			t.Errorf("expected a single channel, got %v", info.ChannelLabels)
+		}
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := first.Manager.ConnectionInfo(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Counters.SentMessages != 1 {
+		t.Errorf("expected 1 sent message, got %+v", info.Counters)
+	}
+
+	if _, err := first.Manager.ConnectionInfo("unknown"); err == nil {
+		t.Error("expected an error for an unknown peer")
+	}
+}
+
+func TestSendDuringCloseRace(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "shutdown", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		// Sends in flight either complete or fail with ErrClosed, but never hit a closed channel
+		go func() {
+			defer wg.Done()
+
+			for {
+				if err := first.Manager.SendMessage([]byte("hello")); err != nil {
+					errs <- err
+
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+					errs <- err
+
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := first.Manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, handlers.ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	}
+
+	if err := first.Manager.BroadcastJSON("hello"); !errors.Is(err, handlers.ErrClosed) {
+		t.Errorf("expected ErrClosed after closing, got %v", err)
+	}
+}
+
+func TestStatsCollector(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "stats", handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := handlers.NewStatsCollector(first.Manager, 10*time.Millisecond)
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	for testutil.CollectAndCount(collector, "libentangle_peer_rtt_seconds", "libentangle_peer_sent_bytes") != 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("gauges of the connected peer were not scraped")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "libentangle_peer_sent_bytes" {
+			continue
+		}
+
+		metric := family.GetMetric()[0]
+		if mac := metric.GetLabel()[0].GetValue(); mac != second.Manager.Mac() {
+			t.Errorf("expected gauge labeled %v, got %v", second.Manager.Mac(), mac)
+		}
+
+		if metric.GetGauge().GetValue() == 0 {
+			t.Error("expected sent bytes of the connected peer")
+		}
+	}
+
+	if err := collector.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectedCandidatePairChange(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type selection struct {
+		mac  string
+		pair webrtc.ICECandidatePair
+	}
+
+	selections := make(chan selection, 10)
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "pairs", handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+		OnSelectedCandidatePairChange: func(mac string, pair webrtc.ICECandidatePair) {
+			selections <- selection{mac, pair}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both peers report the initially selected pair with the mac of the other one
+	reported := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-selections:
+			if s.pair.Local == nil || s.pair.Remote == nil {
+				t.Fatalf("expected a complete candidate pair, got %v", s.pair)
+			}
+
+			if s.pair.Local.Typ != webrtc.ICECandidateTypeHost {
+				t.Errorf("expected a local host candidate, got %v", s.pair.Local.Typ)
+			}
+
+			// The remote is only known as peer reflexive if its connectivity check arrives before its trickled candidate
+			if s.pair.Remote.Typ != webrtc.ICECandidateTypeHost && s.pair.Remote.Typ != webrtc.ICECandidateTypePrflx {
+				t.Errorf("expected a remote host or peer reflexive candidate, got %v", s.pair.Remote.Typ)
+			}
+
+			reported[s.mac] = true
+		case <-ctx.Done():
+			t.Fatal("selected candidate pair was not reported")
+		}
+	}
+
+	if expected := map[string]bool{first.Manager.Mac(): true, second.Manager.Mac(): true}; !reflect.DeepEqual(reported, expected) {
+		t.Errorf("expected the pairs to be reported for %v, got %v", expected, reported)
+	}
+}
+
+func TestQualityScore(t *testing.T) {
+	if score := (handlers.Quality{}).Score(); score != 100 {
+		t.Errorf("expected a perfect score without any penalties, got %v", score)
+	}
+
+	// Worse measurements never raise the score
+	previous := 100
+	for _, rtt := range []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond, time.Second} {
+		score := handlers.Quality{RTT: rtt}.Score()
+		if score > previous {
+			t.Errorf("score rose from %v to %v with a round trip time of %v", previous, score, rtt)
+		}
+
+		previous = score
+	}
+
+	if previous >= 100 {
+		t.Error("a round trip time of a second did not lower the score")
+	}
+
+	previous = 100
+	for _, loss := range []float64{0.01, 0.05, 0.2} {
+		score := handlers.Quality{PacketLoss: loss}.Score()
+		if score >= previous {
+			t.Errorf("score did not drop below %v with a packet loss of %v", previous, loss)
+		}
+
+		previous = score
+	}
+
+	direct := handlers.Quality{RTT: 80 * time.Millisecond}.Score()
+	relayed := handlers.Quality{RTT: 80 * time.Millisecond, Relayed: true}.Score()
+	if relayed >= direct {
+		t.Errorf("expected a relayed connection to score below a direct one, got %v and %v", relayed, direct)
+	}
+
+	if score := (handlers.Quality{RTT: 10 * time.Second, PacketLoss: 1, Relayed: true}).Score(); score != 0 {
+		t.Errorf("expected the score to bottom out at 0, got %v", score)
+	}
+}
+
+func TestPeerQuality(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "quality", handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A direct local connection is as good as it gets
+	score, err := first.Manager.PeerQuality(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if score != 100 {
+		t.Errorf("expected a score of 100 for a direct connection, got %v", score)
+	}
+
+	if _, err := first.Manager.PeerQuality("unknown"); err == nil {
+		t.Error("expected an error for an unknown peer")
+	}
+}
+
+func TestPeerCounters(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Keepalives are not counted
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "counters", handlers.ClientManagerConfig{
+		ICEServers:        []webrtc.ICEServer{},
+		KeepaliveInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		receive(t, ctx, second)
+	}
+
+	if err := second.Manager.SendMessageUnicast([]byte("hi"), first.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, ctx, first)
+
+	sent, err := first.Manager.PeerCounters(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := second.Manager.PeerCounters(first.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent.SentMessages != 3 || sent.ReceivedMessages != 1 {
+		t.Errorf("expected 3 sent and 1 received message, got %+v", sent)
+	}
+
+	if received.ReceivedMessages != 3 || received.SentMessages != 1 {
+		t.Errorf("expected 3 received and 1 sent message, got %+v", received)
+	}
+
+	if sent.SentBytes == 0 || sent.SentBytes != received.ReceivedBytes || sent.ReceivedBytes != received.SentBytes {
+		t.Errorf("expected the bytes to match, got %+v and %+v", sent, received)
+	}
+
+	if _, err := first.Manager.PeerCounters("unknown"); err == nil {
+		t.Error("expected an error for an unknown peer")
+	}
+}
+
+func TestCandidateFilter(t *testing.T) {
+	candidates := make(chan string, 100)
+	offers := make(chan struct{}, 1)
+
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		switch opcode {
+		case api.OpcodeOffer:
+			offers <- struct{}{}
+		case api.OpcodeCandidate:
+			var candidate api.Candidate
+			if err := json.Unmarshal(data, &candidate); err == nil {
+				candidates <- string(candidate.Payload)
+			}
+		}
+	})
+
+	// Only the first gathered candidate passes the filter
+	var lock sync.Mutex
+	filtered := map[string]bool{}
+	passed := ""
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+		CandidateFilter: func(candidate webrtc.ICECandidate) bool {
+			lock.Lock()
+			defer lock.Unlock()
+
+			if passed == "" {
+				passed = candidate.ToJSON().Candidate
+
+				return true
+			}
+
+			filtered[candidate.ToJSON().Candidate] = true
+
+			return false
+		},
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "filter", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	timeout := time.After(2 * time.Second)
+	sent := 0
+	for {
+		select {
+		case candidate := <-candidates:
+			sent++
+
+			lock.Lock()
+			if filtered[candidate] {
+				t.Errorf("filtered candidate %v was sent", candidate)
+			}
+			lock.Unlock()
+		case <-timeout:
+			if sent != 1 {
+				t.Errorf("expected only the candidate passing the filter to be sent, got %v candidates", sent)
+			}
+
+			return
+		}
+	}
+}
+
+func TestICEUDPMux(t *testing.T) {
+	offers := make(chan struct{}, 10)
+	addr := startIntroducingSignalingServer(t, []string{"first", "second"}, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			offers <- struct{}{}
+		}
+	})
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := webrtc.NewICEUDPMux(nil, udpConn)
+	defer mux.Close()
+
+	port := uint16(udpConn.LocalAddr().(*net.UDPAddr).Port)
+
+	candidates := make(chan webrtc.ICECandidate, 100)
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+		ICEUDPMux:  mux,
+		CandidateFilter: func(candidate webrtc.ICECandidate) bool {
+			candidates <- candidate
+
+			return true
+		},
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "mux", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-offers:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no offer was sent")
+		}
+	}
+
+	timeout := time.After(time.Second)
+	gathered := 0
+	for {
+		select {
+		case candidate := <-candidates:
+			if candidate.Protocol != webrtc.ICEProtocolUDP {
+				continue
+			}
+
+			gathered++
+
+			if candidate.Port != port {
+				t.Errorf("expected candidate on the port %v of the mux, got %v", port, candidate.Port)
+			}
+		case <-timeout:
+			// Each of the peer connections gathers at least one candidate
+			if gathered < 2 {
+				t.Errorf("expected candidates of both peer connections, got %v", gathered)
+			}
+
+			return
+		}
+	}
+}
+
+// Run with -race, candidates of several peers are written while the peers are inspected
+func TestCandidateWritesRace(t *testing.T) {
+	macs := []string{"first", "second", "third", "fourth", "fifth", "sixth"}
+
+	candidates := make(chan string, 1000)
+	addr := startIntroducingSignalingServer(t, macs, func(opcode string, data []byte) {
+		if opcode != api.OpcodeCandidate {
+			return
+		}
+
+		var candidate api.Candidate
+		if err := json.Unmarshal(data, &candidate); err != nil {
+			t.Errorf("could not decode candidate: %v", err)
+
+			return
+		}
+
+		candidates <- candidate.ReceiverMac
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			manager.Peers()
+			manager.PendingPeers()
+		}
+	}()
+
+	networking.NewConnectionManager(manager).Connect(addr, "race", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	received := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(macs) {
+		select {
+		case mac := <-candidates:
+			received[mac] = true
+		case <-timeout:
+			t.Fatalf("expected candidates for all peers, got them for %v", received)
+		}
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	const max = 2
+
+	offers := make(chan struct{}, 10)
+	addr := startIntroducingSignalingServer(t, []string{"first", "second", "third"}, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			offers <- struct{}{}
+		}
+	})
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {}, handlers.ClientManagerConfig{
+		MaxPeers: max,
+	})
+
+	networking.NewConnectionManager(manager).Connect(addr, "peers", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	timeout := time.After(2 * time.Second)
+	count := 0
+loop:
+	for {
+		select {
+		case <-offers:
+			count++
+		case <-timeout:
+			break loop
+		}
+	}
+
+	if count != max {
+		t.Fatalf("expected %v peers to be created, got %v", max, count)
+	}
+
+	var wg sync.WaitGroup
+	err := manager.HandleIntroduction(nil, "uuid", &wg, func(msg webrtc.DataChannelMessage) {}, *api.NewIntroduction("fourth", "peers"))
+
+	var tooMany *handlers.TooManyPeers
+	if !errors.As(err, &tooMany) {
+		t.Errorf("expected too many peers error, got %v", err)
+	}
+
+	// The peers introduced first keep their connections
+	for _, mac := range []string{"first", "second"} {
+		if _, err := manager.PeerConnection(mac); err != nil {
+			t.Errorf("connection to %v was not kept: %v", mac, err)
+		}
+	}
+
+	if _, err := manager.PeerConnection("third"); err == nil {
+		t.Error("connection to the third peer was created")
+	}
+}
+
+func TestDataChannel(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "channel", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel, err := first.Manager.DataChannel(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if channel.ReadyState() != webrtc.DataChannelStateOpen {
+		t.Errorf("expected an open channel, got state %v", channel.ReadyState())
+	}
+
+	if _, err := first.Manager.DataChannel("unknown"); err == nil {
+		t.Error("expected an error for an unknown peer")
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, detach := range []bool{false, true} {
+		detach := detach
+
+		t.Run(fmt.Sprintf("detach=%v", detach), func(t *testing.T) {
+			addr := startSignalingServer(t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			first, second, err := signalingtest.ConnectPeers(ctx, addr, "conn", handlers.ClientManagerConfig{
+				DetachDataChannels: detach,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writer, err := first.Manager.Conn(second.Manager.Mac())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := second.Manager.Conn(first.Manager.Mac())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := writer.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 1024)
+			n, err := reader.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(buf[:n]) != "hello" {
+				t.Errorf("expected hello, got %v", string(buf[:n]))
+			}
+		})
+	}
+}
+
+func TestConnPartialReads(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "partial", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := first.Manager.Conn(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := second.Manager.Conn(first.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []string{"hello world", "again"} {
+		if _, err := writer.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A message which doesn't fit into the buffer is returned by several reads, without mixing in the next one
+	chunks := []string{}
+	buf := make([]byte, 4)
+	for _, want := range []int{4, 4, 3, 4, 1} {
+		n, err := reader.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != want {
+			t.Errorf("expected to read %v bytes, got %v", want, n)
+		}
+
+		chunks = append(chunks, string(buf[:n]))
+	}
+
+	if expected := []string{"hell", "o wo", "rld", "agai", "n"}; !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("expected chunks %v, got %v", expected, chunks)
+	}
+}
+
+func BenchmarkConnThroughput(b *testing.B) {
+	for _, detach := range []bool{false, true} {
+		detach := detach
+
+		b.Run(fmt.Sprintf("detach=%v", detach), func(b *testing.B) {
+			server, err := signalingtest.NewServer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			first, second, err := signalingtest.ConnectPeers(ctx, server.Addr, "throughput", handlers.ClientManagerConfig{
+				ICEServers:         []webrtc.ICEServer{},
+				DetachDataChannels: detach,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			writer, err := first.Manager.Conn(second.Manager.Mac())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			reader, err := second.Manager.Conn(first.Manager.Mac())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			payload := make([]byte, 16*1024)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := writer.Write(payload); err != nil {
+						b.Error(err)
+
+						return
+					}
+				}
+			}()
+
+			buf := make([]byte, 64*1024)
+			for i := 0; i < b.N; i++ {
+				if _, err := reader.Read(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPendingPeers(t *testing.T) {
+	offers := make(chan struct{}, 1)
+	addr := startIntroducingSignalingServer(t, []string{"peer"}, func(opcode string, data []byte) {
+		if opcode == api.OpcodeOffer {
+			offers <- struct{}{}
+		}
+	})
+
+	// The introduced peer never answers, so its handshake stays pending
+	manager := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {})
+	networking.NewConnectionManager(manager).Connect(addr, "pending", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+	select {
+	case <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+
+	if pending := manager.PendingPeers(); !reflect.DeepEqual(pending, []string{"peer"}) {
+		t.Errorf("expected pending peers [peer], got %v", pending)
+	}
+
+	if peers := manager.Peers(); len(peers) != 0 {
+		t.Errorf("expected no connected peers, got %v", peers)
+	}
+}
+
+func TestWaitForPeerMac(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := signalingtest.NewPeer(addr, "wait", handlers.ClientManagerConfig{})
+	for first.Manager.Mac() == "" {
+		select {
+		case <-ctx.Done():
+			t.Fatal("first peer was not accepted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	second := signalingtest.NewPeer(addr, "wait", handlers.ClientManagerConfig{})
+	if err := second.Manager.WaitForPeerMac(ctx, first.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.Manager.IsConnected(first.Manager.Mac()) {
+		t.Error("peer is not connected after waiting for it")
+	}
+
+	// Returns immediately for a peer which is already connected
+	if err := second.Manager.WaitForPeerMac(ctx, first.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForPeerMacTimeout(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, _, err := signalingtest.ConnectPeers(ctx, addr, "wait-timeout", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other peers opening their channels don't resolve the wait
+	waitCtx, waitCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer waitCancel()
+
+	if err := first.Manager.WaitForPeerMac(waitCtx, "unknown"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestPendingPeersConnected(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "pending", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peers := first.Manager.Peers(); !reflect.DeepEqual(peers, []string{second.Manager.Mac()}) {
+		t.Errorf("expected connected peers [%v], got %v", second.Manager.Mac(), peers)
+	}
+
+	if pending := first.Manager.PendingPeers(); len(pending) != 0 {
+		t.Errorf("expected no pending peers, got %v", pending)
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "empty", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range [][]byte{{}, nil} {
+		if err := first.Manager.SendMessageUnicast(msg, second.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := receive(t, ctx, second); w.Payload == nil || len(w.Payload) != 0 {
+			t.Errorf("expected an empty, non-nil payload, got %#v", w.Payload)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dropped := make(chan error, 1)
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "size", handlers.ClientManagerConfig{
+		MaxMessageSize: 1024,
+		OnMessageDropped: func(mac string, err error) {
+			dropped <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.SendMessageUnicast(make([]byte, 4096), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-dropped:
+		var tooLarge *handlers.MessageTooLarge
+		if !errors.As(err, &tooLarge) {
+			t.Errorf("expected message too large error, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("oversized message was not dropped")
+	}
+
+	// Messages are delivered in order, so the oversized one would arrive first
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, second)
+	if string(w.Payload) != "hello" {
+		t.Errorf("expected hello, got message of %v bytes", len(w.Payload))
+	}
+}
+
+func TestUnknownSender(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dropped := make(chan error, 1)
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "unknown", handlers.ClientManagerConfig{
+		OnMessageDropped: func(mac string, err error) {
+			dropped <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A message still wrapped with the mac of a peer which was evicted in the meantime
+	msg, err := json.Marshal(dataApi.WrappedMessage{Mac: "evicted", Payload: []byte("stale")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel, err := first.Manager.DataChannel(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := channel.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-dropped:
+		var unknown *handlers.UnknownSender
+		if !errors.As(err, &unknown) || unknown.Mac != "evicted" {
+			t.Errorf("expected unknown sender error for evicted, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("message from unknown sender was not dropped")
+	}
+
+	// Messages are delivered in order, so the dropped one would arrive first
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(t, ctx, second)
+	if w.Mac != first.Manager.Mac() || string(w.Payload) != "hello" {
+		t.Errorf("unexpected message %v from %v", string(w.Payload), w.Mac)
+	}
+}
+
+func TestOnChannelWritable(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "writable", handlers.ClientManagerConfig{
+		BufferedAmountLowThreshold: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writable := make(chan struct{}, 1)
+	first.Manager.OnChannelWritable(second.Manager.Mac(), func() {
+		select {
+		case writable <- struct{}{}:
+		default:
+		}
+	})
+
+	channel, err := first.Manager.DataChannel(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 16*1024)
+	for i := 0; i < 64; i++ {
+		if err := first.Manager.SendMessageUnicast(payload, second.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if channel.BufferedAmount() <= 1024 {
+		t.Skip("buffer drained before it could be observed")
+	}
+
+	select {
+	case <-writable:
+	case <-ctx.Done():
+		t.Fatal("callback was not called after the buffer drained")
+	}
+
+	if amount := channel.BufferedAmount(); amount > 1024 {
+		t.Errorf("expected at most 1024 buffered bytes, got %v", amount)
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fake := clock.NewFake(time.Now())
+	dropped := make(chan error, 1)
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "ordered", handlers.ClientManagerConfig{
+		OrderedDelivery:   true,
+		ReorderWindow:     4,
+		ReorderGapTimeout: time.Second,
+		OnMessageDropped: func(mac string, err error) {
+			dropped <- err
+		},
+		Clock: fake,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel, err := first.Manager.DataChannel(second.Manager.Mac())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(orders ...uint64) {
+		for _, order := range orders {
+			msg, err := json.Marshal(dataApi.WrappedMessage{Mac: first.Manager.Mac(), Order: order, Payload: []byte(fmt.Sprint(order))})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := channel.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expect := func(orders ...uint64) {
+		for _, order := range orders {
+			if w := receive(t, ctx, second); string(w.Payload) != fmt.Sprint(order) {
+				t.Fatalf("expected message %v, got %v", order, string(w.Payload))
+			}
+		}
+	}
+
+	send(3, 1, 2)
+	expect(1, 2, 3)
+
+	// Message 4 is missing, so 5 is held back until the gap times out
+	send(5)
+	if err := fake.WaitForTimers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-second.Messages:
+		t.Fatalf("message %v was delivered before the gap timed out", string(msg.Data))
+	default:
+	}
+
+	fake.Advance(time.Second)
+	expect(5)
+
+	send(4)
+	select {
+	case err := <-dropped:
+		var outOfOrder *handlers.OutOfOrder
+		if !errors.As(err, &outOfOrder) || outOfOrder.Order != 4 {
+			t.Errorf("expected out of order error for message 4, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("late message was not dropped")
+	}
+
+	// Once the window is full, the missing message 6 is skipped
+	send(7, 8, 9, 10, 11)
+	expect(7, 8, 9, 10, 11)
+}
+
+func TestOrderedDeliveryUnordered(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ordered := false
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "unordered", handlers.ClientManagerConfig{
+		DataChannelInit: &webrtc.DataChannelInit{
+			Ordered: &ordered,
+		},
+		OrderedDelivery: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := first.Manager.SendMessageUnicast([]byte(fmt.Sprint(i)), second.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		w := receive(t, ctx, second)
+		if string(w.Payload) != fmt.Sprint(i) {
+			t.Fatalf("expected message %v, got %v", i, string(w.Payload))
+		}
+		if w.Order != uint64(i+1) {
+			t.Errorf("expected order %v, got %v", i+1, w.Order)
+		}
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnected := make(chan string, 2)
+	first := signalingtest.NewPeer(addr, "disconnect", handlers.ClientManagerConfig{
+		OnDisconnected: func(mac string) {
+			disconnected <- mac
+		},
+	})
+	for first.Manager.Mac() == "" {
+		select {
+		case <-ctx.Done():
+			t.Fatal("first peer was not accepted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	second := signalingtest.NewPeer(addr, "disconnect", handlers.ClientManagerConfig{})
+	third := signalingtest.NewPeer(addr, "disconnect", handlers.ClientManagerConfig{})
+
+	for _, peer := range []*signalingtest.Peer{second, third} {
+		if err := peer.Manager.WaitForPeerMac(ctx, first.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := first.Manager.WaitForPeerMac(ctx, peer.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := first.Manager.Disconnect(second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case mac := <-disconnected:
+		if mac != second.Manager.Mac() {
+			t.Errorf("expected %v to be disconnected, got %v", second.Manager.Mac(), mac)
+		}
+	case <-ctx.Done():
+		t.Fatal("disconnect event was not fired")
+	}
+
+	if peers := first.Manager.Peers(); !reflect.DeepEqual(peers, []string{third.Manager.Mac()}) {
+		t.Errorf("expected connected peers [%v], got %v", third.Manager.Mac(), peers)
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("still here"), third.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := receive(t, ctx, third); string(w.Payload) != "still here" {
+		t.Errorf("unexpected message %v", string(w.Payload))
+	}
+
+	if err := first.Manager.Disconnect(second.Manager.Mac()); err == nil {
+		t.Error("expected an error for a peer which is not connected")
+	}
+
+	select {
+	case mac := <-disconnected:
+		t.Errorf("unexpected disconnect of %v", mac)
+	default:
+	}
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	const (
+		max      = 2
+		senders  = 4
+		messages = 5
+	)
+
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	connected := make(chan struct{}, senders)
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {
+		connected <- struct{}{}
+	}, handlers.ClientManagerConfig{
+		ICEServers:            []webrtc.ICEServer{},
+		MaxConcurrentHandlers: max,
+	})
+
+	var running, peak int32
+	handled := make(chan struct{}, senders*messages)
+	networking.NewConnectionManager(manager).Connect(addr, "handlers", func(msg webrtc.DataChannelMessage) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			previous := atomic.LoadInt32(&peak)
+			if current <= previous || atomic.CompareAndSwapInt32(&peak, previous, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		atomic.AddInt32(&running, -1)
+		handled <- struct{}{}
+	}, logging.NewJSONLogger(0))
+
+	for manager.Mac() == "" {
+		select {
+		case <-ctx.Done():
+			t.Fatal("receiver was not accepted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	peers := []*signalingtest.Peer{}
+	for i := 0; i < senders; i++ {
+		peers = append(peers, signalingtest.NewPeer(addr, "handlers", handlers.ClientManagerConfig{
+			ICEServers: []webrtc.ICEServer{},
+		}))
+	}
+
+	for i := 0; i < senders; i++ {
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			t.Fatal("senders did not connect")
+		}
+	}
+
+	// All senders send at once
+	for _, peer := range peers {
+		if err := peer.Manager.WaitForPeerMac(ctx, manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < messages; i++ {
+			if err := peer.Manager.SendMessageUnicast([]byte("load"), manager.Mac()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < senders*messages; i++ {
+		select {
+		case <-handled:
+		case <-ctx.Done():
+			t.Fatalf("only %v of %v messages were handled", i, senders*messages)
+		}
+	}
+
+	if peak := atomic.LoadInt32(&peak); peak > max {
+		t.Errorf("expected at most %v handlers to run at once, got %v", max, peak)
+	}
+}
+
+func TestPauseReceive(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "pause", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.PauseReceive(second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"first", "second", "third"} {
+		if err := second.Manager.SendMessageUnicast([]byte(payload), first.Manager.Mac()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The messages are counted once they arrived, even though they are held back
+	for {
+		counters, err := first.Manager.PeerCounters(second.Manager.Mac())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if counters.ReceivedMessages == 3 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("messages did not arrive")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	select {
+	case msg := <-first.Messages:
+		t.Fatalf("expected no message while paused, got %v", string(msg.Data))
+	default:
+	}
+
+	if err := first.Manager.ResumeReceive(second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"first", "second", "third"} {
+		if w := receive(t, ctx, first); string(w.Payload) != expected {
+			t.Errorf("expected message %v, got %v", expected, string(w.Payload))
+		}
+	}
+
+	if err := first.Manager.PauseReceive("unknown"); err == nil {
+		t.Error("expected an error for an unknown peer")
+	}
+}
+
+func TestPeerContext(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	disconnected := make(chan string, 2)
+	first, second, err := signalingtest.ConnectPeers(ctx, addr, "context", handlers.ClientManagerConfig{
+		KeepaliveInterval: 50 * time.Millisecond,
+		OnDisconnected: func(mac string) {
+			disconnected <- mac
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := second.Manager.Mac()
+
+	if _, ok := first.Manager.PeerContext(mac); ok {
+		t.Error("expected no context before one was set")
+	}
+
+	first.Manager.SetPeerContext(mac, "user")
+
+	if v, ok := first.Manager.PeerContext(mac); !ok || v != "user" {
+		t.Errorf("expected context user, got %v", v)
+	}
+
+	// Peers which are not connected have no context
+	first.Manager.SetPeerContext("unknown", "user")
+	if _, ok := first.Manager.PeerContext("unknown"); ok {
+		t.Error("expected no context for an unknown peer")
+	}
+
+	// The remote hangs up, which the keepalives notice
+	if err := second.Manager.Disconnect(first.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote disconnects from us as well
+	for disconnectedMac := ""; disconnectedMac != mac; {
+		select {
+		case disconnectedMac = <-disconnected:
+		case <-ctx.Done():
+			t.Fatal("disconnect event was not fired")
+		}
+	}
+
+	if _, ok := first.Manager.PeerContext(mac); ok {
+		t.Error("expected the context to be removed after the peer disconnected")
+	}
+}
+
+func TestSharedAPI(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	shared := webrtc.NewAPI()
+
+	// Both pairs handshake at the same time through the same API
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, community := range []string{"shared-api-1", "shared-api-2"} {
+		wg.Add(1)
+
+		go func(community string) {
+			defer wg.Done()
+
+			first, second, err := signalingtest.ConnectPeers(ctx, addr, community, handlers.ClientManagerConfig{
+				API: shared,
+			})
+			if err != nil {
+				errs <- err
+
+				return
+			}
+
+			if err := first.Manager.SendMessageUnicast([]byte(community), second.Manager.Mac()); err != nil {
+				errs <- err
+
+				return
+			}
+
+			select {
+			case msg := <-second.Messages:
+				var w dataApi.WrappedMessage
+				if err := json.Unmarshal(msg.Data, &w); err != nil {
+					errs <- err
+				} else if string(w.Payload) != community {
+					errs <- fmt.Errorf("expected message %v, got %v", community, string(w.Payload))
+				}
+			case <-ctx.Done():
+				errs <- ctx.Err()
+			}
+		}(community)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRepeerFailed(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		lower bool
+	}{
+		{"lower mac fails", true},
+		{"higher mac fails", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			addr := startSignalingServer(t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			// With the default ICE timeouts, the remote doesn't notice that the connection failed during the test,
+			// so the connection has to be re-established by the peer whose end of it failed
+			config := handlers.ClientManagerConfig{
+				ICEServers:    []webrtc.ICEServer{},
+				RepeerFailed:  true,
+				RepeerBackoff: 10 * time.Millisecond,
+			}
+
+			first, second, err := signalingtest.ConnectPeers(ctx, addr, "repeer", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (first.Manager.Mac() < second.Manager.Mac()) != c.lower {
+				first, second = second, first
+			}
+
+			third := signalingtest.NewPeer(addr, "repeer", config)
+			for _, peer := range []*signalingtest.Peer{first, second} {
+				if err := third.Manager.WaitForPeerMac(ctx, peer.Manager.Mac()); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := peer.Manager.WaitForPeerMac(ctx, third.Manager.Mac()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			untouched := map[*signalingtest.Peer]*webrtc.PeerConnection{}
+			for _, peer := range []*signalingtest.Peer{first, second} {
+				peerConnection, err := third.Manager.PeerConnection(peer.Manager.Mac())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				untouched[peer] = peerConnection
+			}
+
+			// The first peer's end of the connection goes away without a goodbye
+			failed, err := first.Manager.PeerConnection(second.Manager.Mac())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stale, err := second.Manager.PeerConnection(first.Manager.Mac())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := failed.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for {
+				current, err := second.Manager.PeerConnection(first.Manager.Mac())
+				if err == nil && current != stale && first.Manager.IsConnected(second.Manager.Mac()) && second.Manager.IsConnected(first.Manager.Mac()) {
+					break
+				}
+
+				select {
+				case <-ctx.Done():
+					t.Fatal("connection was not re-established")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			if err := second.Manager.SendMessageUnicast([]byte("again"), first.Manager.Mac()); err != nil {
+				t.Fatal(err)
+			}
+
+			if w := receive(t, ctx, first); string(w.Payload) != "again" {
+				t.Errorf("expected message again, got %v", string(w.Payload))
+			}
+
+			for peer, peerConnection := range untouched {
+				if current, err := third.Manager.PeerConnection(peer.Manager.Mac()); err != nil || current != peerConnection {
+					t.Errorf("expected the connection to %v to be kept", peer.Manager.Mac())
+				}
+			}
+		})
+	}
+}
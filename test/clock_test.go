@@ -0,0 +1,63 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alphahorizonio/libentangle/pkg/clock"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Now()
+	fake := clock.NewFake(start)
+
+	after := fake.After(time.Second)
+	timer := fake.NewTimer(2 * time.Second)
+	stopped := fake.NewTimer(time.Second)
+
+	if !stopped.Stop() {
+		t.Error("expected a pending timer to be stopped")
+	}
+
+	fake.Advance(time.Second)
+
+	select {
+	case now := <-after:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("expected %v, got %v", start.Add(time.Second), now)
+		}
+	default:
+		t.Error("expected a due timer to fire")
+	}
+
+	select {
+	case <-timer.C():
+		t.Error("timer fired before its deadline")
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	// Resetting postpones the deadline relative to the current time
+	if !timer.Reset(2 * time.Second) {
+		t.Error("expected a pending timer to be reset")
+	}
+
+	fake.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Error("timer fired before its reset deadline")
+	default:
+	}
+
+	fake.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Error("expected the reset timer to fire")
+	}
+
+	if fake.Timers() != 0 {
+		t.Errorf("expected no pending timers, got %v", fake.Timers())
+	}
+}
@@ -71,7 +71,7 @@ func TestConnection(t *testing.T) {
 	go http.ListenAndServe(addr.String(), handler)
 
 	onOpen := make(chan struct{})
-	manager := handlers.NewClientManager(func() {
+	manager := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {
 		onOpen <- struct{}{}
 	})
 
@@ -145,11 +145,11 @@ func TestMessage(t *testing.T) {
 	onOpenClient := make(chan struct{})
 	finished := make(chan struct{})
 
-	manager := handlers.NewClientManager(func() {
+	manager := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {
 		onOpen <- struct{}{}
 	})
 
-	managerClient := handlers.NewClientManager(func() {
+	managerClient := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {
 		onOpenClient <- struct{}{}
 	})
 
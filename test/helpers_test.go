@@ -0,0 +1,83 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/signaling/signalingtest"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func startSignalingServer(t *testing.T) string {
+	server, err := signalingtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server.Addr
+}
+
+func startFakeSignalingServer(t *testing.T, handle func(conn *websocket.Conn)) string {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true, // CORS
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		handle(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Accepts a single client, introduces the given macs to it and reports every message it sends afterwards
+func startIntroducingSignalingServer(t *testing.T, macs []string, onMessage func(opcode string, data []byte)) string {
+	return startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("test")); err != nil {
+			return
+		}
+
+		var ready api.Ready
+		if err := wsjson.Read(context.Background(), conn, &ready); err != nil {
+			return
+		}
+
+		for _, mac := range macs {
+			if err := wsjson.Write(context.Background(), conn, api.NewIntroduction(mac, "test")); err != nil {
+				return
+			}
+		}
+
+		for {
+			_, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+
+			var v api.Message
+			if err := json.Unmarshal(data, &v); err != nil {
+				continue
+			}
+
+			onMessage(v.Opcode, data)
+		}
+	})
+}
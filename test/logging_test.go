@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alphahorizonio/libentangle/internal/logging"
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	pkgLogging "github.com/alphahorizonio/libentangle/pkg/logging"
+	"github.com/alphahorizonio/libentangle/pkg/signaling"
+	"github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Counts the trace messages instead of printing them
+type countingLogger struct {
+	*logging.JSONLogger
+
+	traces int32
+}
+
+func (l *countingLogger) Trace(event string, keyvals ...interface{}) {
+	atomic.AddInt32(&l.traces, 1)
+}
+
+func TestTraceDisabled(t *testing.T) {
+	l := &countingLogger{JSONLogger: logging.NewJSONLogger(pkgLogging.LevelDebug)}
+
+	mac := "mac"
+	allocs := testing.AllocsPerRun(100, func() {
+		pkgLogging.Trace(l, "event", func() map[string]interface{} {
+			return map[string]interface{}{
+				"mac": mac,
+			}
+		})
+	})
+
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+
+	if traces := atomic.LoadInt32(&l.traces); traces != 0 {
+		t.Errorf("expected no trace messages, got %v", traces)
+	}
+}
+
+func TestTraceEnabled(t *testing.T) {
+	l := &countingLogger{JSONLogger: logging.NewJSONLogger(pkgLogging.LevelTrace)}
+
+	pkgLogging.Trace(l, "event", func() map[string]interface{} {
+		return map[string]interface{}{}
+	})
+
+	if traces := atomic.LoadInt32(&l.traces); traces != 1 {
+		t.Errorf("expected one trace message, got %v", traces)
+	}
+}
+
+func TestSignalingClientTraceDisabled(t *testing.T) {
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("test")); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewIntroduction("peer", "test")); err != nil {
+			return
+		}
+
+		time.Sleep(time.Second)
+	})
+
+	l := &countingLogger{JSONLogger: logging.NewJSONLogger(pkgLogging.LevelDebug)}
+
+	introduced := make(chan struct{})
+	client := signaling.NewSignalingClient(
+		func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+			return nil
+		},
+		func(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, introduction api.Introduction) error {
+			close(introduced)
+
+			return nil
+		},
+		func(conn *websocket.Conn, wg *sync.WaitGroup, uuid string, offer api.Offer) error {
+			return nil
+		},
+		func(wg *sync.WaitGroup, answer api.Answer) error {
+			return nil
+		},
+		func(candidate api.Candidate) error {
+			return nil
+		},
+		func(resignation api.Resignation) error {
+			return nil
+		},
+		l,
+	)
+
+	go client.HandleConn(addr, "test", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case <-introduced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("introduction was not received")
+	}
+
+	if traces := atomic.LoadInt32(&l.traces); traces != 0 {
+		t.Errorf("expected no trace messages, got %v", traces)
+	}
+}
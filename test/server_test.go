@@ -0,0 +1,1682 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/clock"
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+	"github.com/alphahorizonio/libentangle/pkg/signaling/signalingtest"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func apply(t *testing.T, addr string, community string, mac string) (*websocket.Conn, api.Acceptance) {
+	conn, _, err := websocket.Dial(context.Background(), "ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+	})
+
+	if err := wsjson.Write(context.Background(), conn, api.NewApplication(community, mac)); err != nil {
+		t.Fatal(err)
+	}
+
+	var acceptance api.Acceptance
+	if err := wsjson.Read(context.Background(), conn, &acceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if acceptance.Opcode != api.OpcodeAcceptance {
+		t.Fatalf("expected acceptance, got %v", acceptance.Opcode)
+	}
+
+	return conn, acceptance
+}
+
+func TestAcceptanceContainsMembers(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	_, first := apply(t, addr, "roster", "first")
+	if len(first.Members) != 0 {
+		t.Errorf("expected no members for the first peer, got %v", first.Members)
+	}
+
+	apply(t, addr, "roster", "second")
+
+	_, third := apply(t, addr, "roster", "third")
+	if !reflect.DeepEqual(third.Members, []string{"first", "second"}) {
+		t.Errorf("expected members [first second], got %v", third.Members)
+	}
+}
+
+func TestStalledWriteTimesOut(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	conns := make(chan *websocket.Conn, 1)
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			return
+		}
+
+		conns <- conn
+
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	// The client never reads, so the server's writes eventually block
+	client, _, err := websocket.Dial(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(websocket.StatusNormalClosure, "")
+
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		WriteTimeout: timeout,
+	})
+
+	if err := manager.HandleApplication(*api.NewApplication("stalled", "receiver"), <-conns); err != nil {
+		t.Fatal(err)
+	}
+
+	// Random data so that compression does not shrink the messages
+	payload := make([]byte, 1024*1024)
+	rand.Read(payload)
+
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+
+		if err := manager.HandleOffer(*api.NewOffer(payload, "sender", "receiver")); err != nil {
+			if elapsed := time.Since(start); elapsed > 10*timeout {
+				t.Errorf("write took %v, expected it to time out after %v", elapsed, timeout)
+			}
+
+			return
+		}
+	}
+
+	t.Fatal("write to a stalled client did not time out")
+}
+
+// Forwards candidates to many receivers in parallel, which only scales if writes happen outside of the lock
+func BenchmarkParallelForwarding(b *testing.B) {
+	const receivers = 16
+
+	conns := make(chan *websocket.Conn, receivers)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			return
+		}
+
+		// Keep reading so that the close handshake of the client completes
+		ctx := conn.CloseRead(context.Background())
+
+		conns <- conn
+
+		<-ctx.Done()
+	}))
+	defer server.Close()
+
+	manager := handlers.NewCommunitiesManager()
+	for i := 0; i < receivers; i++ {
+		client, _, err := websocket.Dial(context.Background(), server.URL, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.Close(websocket.StatusNormalClosure, "")
+
+		go func() {
+			for {
+				if _, _, err := client.Read(context.Background()); err != nil {
+					return
+				}
+			}
+		}()
+
+		if err := manager.HandleApplication(*api.NewApplication("benchmark", fmt.Sprintf("receiver-%v", i)), <-conns); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	payload := make([]byte, 1024)
+
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			receiver := fmt.Sprintf("receiver-%v", atomic.AddUint64(&next, 1)%receivers)
+
+			if err := manager.HandleCandidate(*api.NewCandidate(payload, "sender", receiver)); err != nil {
+				b.Error(err)
+
+				return
+			}
+		}
+	})
+}
+
+func join(t *testing.T, manager *handlers.CommunitiesManager, community string, mac string) *signalingtest.Conn {
+	conn := signalingtest.NewConn()
+
+	if err := manager.HandleApplication(*api.NewApplication(community, mac), conn); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func expectOpcodes(t *testing.T, conn *signalingtest.Conn, opcodes ...string) {
+	got := []string{}
+	for _, message := range conn.Messages() {
+		got = append(got, message.Opcode)
+	}
+
+	if !reflect.DeepEqual(got, opcodes) {
+		t.Fatalf("expected messages %v, got %v", opcodes, got)
+	}
+}
+
+func TestHandleApplication(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	expectOpcodes(t, first, api.OpcodeAcceptance)
+
+	second := join(t, manager, "unit", "second")
+	expectOpcodes(t, second, api.OpcodeAcceptance)
+
+	var acceptance api.Acceptance
+	if err := second.Decode(0, &acceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(acceptance.Members, []string{"first"}) {
+		t.Errorf("expected members [first], got %v", acceptance.Members)
+	}
+
+	// The mac is already taken by another connection
+	duplicate := join(t, manager, "unit", "first")
+	expectOpcodes(t, duplicate, api.OpcodeRejection)
+}
+
+// Applies for a community protected by a secret and answers the challenge with the given proof
+func answerChallenge(t *testing.T, manager *handlers.CommunitiesManager, community string, mac string, prove func(nonce []byte) []byte) *signalingtest.Conn {
+	conn := join(t, manager, community, mac)
+	expectOpcodes(t, conn, api.OpcodeChallenge)
+
+	var challenge api.Challenge
+	if err := conn.Decode(0, &challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.HandleApplication(*api.NewProvenApplication(community, mac, prove(challenge.Nonce)), conn); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestKick(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	kicked := join(t, manager, "moderated", "kicked")
+	other := join(t, manager, "moderated", "other")
+
+	if err := manager.Kick("moderated", "kicked"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, other, api.OpcodeAcceptance, api.OpcodeResignation)
+
+	var resignation api.Resignation
+	if err := other.Decode(1, &resignation); err != nil {
+		t.Fatal(err)
+	}
+
+	if resignation.Mac != "kicked" {
+		t.Errorf("expected resignation of kicked, got %v", resignation.Mac)
+	}
+
+	if status := kicked.CloseStatus(); status != websocket.StatusPolicyViolation {
+		t.Errorf("expected connection to be closed with %v, got %v", websocket.StatusPolicyViolation, status)
+	}
+
+	if err := manager.Kick("moderated", "kicked"); err == nil {
+		t.Error("expected an error for a mac which is not a member")
+	}
+
+	// Without a ban, the kicked mac can join again
+	expectOpcodes(t, join(t, manager, "moderated", "kicked"), api.OpcodeAcceptance)
+}
+
+func TestBan(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	banned := join(t, manager, "moderated", "banned")
+	other := join(t, manager, "moderated", "other")
+
+	if err := manager.Ban("moderated", "banned"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, other, api.OpcodeAcceptance, api.OpcodeResignation)
+
+	if status := banned.CloseStatus(); status != websocket.StatusPolicyViolation {
+		t.Errorf("expected connection to be closed with %v, got %v", websocket.StatusPolicyViolation, status)
+	}
+
+	rejoined := join(t, manager, "moderated", "banned")
+	expectOpcodes(t, rejoined, api.OpcodeRejection)
+
+	var rejection api.Rejection
+	if err := rejoined.Decode(0, &rejection); err != nil {
+		t.Fatal(err)
+	}
+
+	if rejection.Reason != api.RejectionBanned {
+		t.Errorf("expected reason %v, got %v", api.RejectionBanned, rejection.Reason)
+	}
+
+	// The ban only applies to the community
+	elsewhere := join(t, manager, "elsewhere", "banned")
+	expectOpcodes(t, elsewhere, api.OpcodeAcceptance)
+
+	manager.Unban("moderated", "banned")
+	if err := manager.HandleApplication(*api.NewApplication("moderated", "banned"), elsewhere); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, elsewhere, api.OpcodeAcceptance, api.OpcodeAcceptance)
+}
+
+func TestApplicationKey(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	application := api.NewApplication("retries", "retried")
+	application.Key = "key"
+
+	first := signalingtest.NewConn()
+	if err := manager.HandleApplication(*application, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same attempt arrives twice on the same connection
+	if err := manager.HandleApplication(*application, first); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, first, api.OpcodeAcceptance)
+
+	// The client sends it again on a new connection before the first one was closed
+	second := signalingtest.NewConn()
+	if err := manager.HandleApplication(*application, second); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, second, api.OpcodeAcceptance)
+
+	other := join(t, manager, "retries", "other")
+	expectOpcodes(t, other, api.OpcodeAcceptance)
+
+	var acceptance api.Acceptance
+	if err := other.Decode(0, &acceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(acceptance.Members, []string{"retried"}) {
+		t.Errorf("expected members [retried], got %v", acceptance.Members)
+	}
+
+	// Another attempt with a new key is a second client using the same mac
+	application.Key = "other"
+
+	third := signalingtest.NewConn()
+	if err := manager.HandleApplication(*application, third); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, third, api.OpcodeRejection)
+}
+
+func TestExpiredOffer(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		Clock: fake,
+	})
+
+	join(t, manager, "expiry", "sender")
+	receiver := join(t, manager, "expiry", "receiver")
+
+	offer := api.NewOffer([]byte("offer"), "sender", "receiver")
+	offer.SetTTL(fake.Now(), 5*time.Second)
+
+	if err := manager.HandleOffer(*offer); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeOffer)
+
+	// The same offer is delivered late, after the sender gave up on it
+	fake.Advance(10 * time.Second)
+
+	var expired *handlers.MessageExpired
+	if err := manager.HandleOffer(*offer); !errors.As(err, &expired) {
+		t.Errorf("expected an expired message error, got %v", err)
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeOffer)
+
+	// Offers without a TTL never expire
+	if err := manager.HandleOffer(*api.NewOffer([]byte("offer"), "sender", "receiver")); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeOffer, api.OpcodeOffer)
+}
+
+func TestHandleRelay(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		MaxRelayRate: 2,
+		Clock:        fake,
+	})
+
+	join(t, manager, "relay", "sender")
+	receiver := join(t, manager, "relay", "receiver")
+	join(t, manager, "other", "outsider")
+
+	for i := 0; i < 2; i++ {
+		if err := manager.HandleRelay(*api.NewRelay([]byte("hello"), "sender", "receiver")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeRelay, api.OpcodeRelay)
+
+	var relay api.Relay
+	if err := receiver.Decode(1, &relay); err != nil {
+		t.Fatal(err)
+	}
+
+	if relay.SenderMac != "sender" || string(relay.Payload) != "hello" {
+		t.Errorf("unexpected relay %v of %v", string(relay.Payload), relay.SenderMac)
+	}
+
+	// Messages exceeding the rate are dropped until the next second
+	if err := manager.HandleRelay(*api.NewRelay([]byte("hello"), "sender", "receiver")); err == nil {
+		t.Error("expected an error for a message exceeding the rate")
+	}
+
+	fake.Advance(time.Second)
+	if err := manager.HandleRelay(*api.NewRelay([]byte("hello"), "sender", "receiver")); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeRelay, api.OpcodeRelay, api.OpcodeRelay)
+
+	if err := manager.HandleRelay(*api.NewRelay([]byte("hello"), "outsider", "receiver")); err == nil {
+		t.Error("expected an error for a relay between macs without a shared community")
+	}
+
+	var tooLarge *api.PayloadTooLarge
+	if err := api.NewRelay(make([]byte, api.MaxRelaySize+1), "sender", "receiver").Validate(); !errors.As(err, &tooLarge) {
+		t.Errorf("expected PayloadTooLarge for an oversized relay, got %v", err)
+	}
+}
+
+func TestHandleRepeer(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	sender := join(t, manager, "repeer", "sender")
+	receiver := join(t, manager, "repeer", "receiver")
+	outsider := join(t, manager, "other", "outsider")
+
+	// The community is looked up if the sender doesn't name one
+	if err := manager.HandleRepeer(*api.NewRepeer("sender", "receiver", ""), sender); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeIntroduction)
+
+	var introduction api.Introduction
+	if err := receiver.Decode(1, &introduction); err != nil {
+		t.Fatal(err)
+	}
+
+	if introduction.Mac != "sender" || introduction.Community != "repeer" || !introduction.Repeer {
+		t.Errorf("expected a repeated introduction of sender in repeer, got %v", introduction)
+	}
+
+	if err := manager.HandleRepeer(*api.NewRepeer("sender", "receiver", ""), outsider); err == nil {
+		t.Error("expected an error for a repeer on behalf of another mac")
+	}
+
+	if err := manager.HandleRepeer(*api.NewRepeer("outsider", "receiver", ""), outsider); err == nil {
+		t.Error("expected an error for a repeer between macs without a shared community")
+	}
+	expectOpcodes(t, receiver, api.OpcodeAcceptance, api.OpcodeIntroduction)
+}
+
+func TestHandlePresence(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		PresenceInterval: time.Second,
+		Clock:            fake,
+	})
+
+	first := join(t, manager, "presence", "first")
+	second := join(t, manager, "presence", "second")
+	third := join(t, manager, "presence", "third")
+	outsider := join(t, manager, "other", "outsider")
+
+	if err := manager.HandlePresence(*api.NewPresence("first", "presence", []byte("typing"))); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance)
+	expectOpcodes(t, second, api.OpcodeAcceptance, api.OpcodePresence)
+	expectOpcodes(t, third, api.OpcodeAcceptance, api.OpcodePresence)
+	expectOpcodes(t, outsider, api.OpcodeAcceptance)
+
+	var presence api.Presence
+	if err := second.Decode(1, &presence); err != nil {
+		t.Fatal(err)
+	}
+
+	if presence.Mac != "first" || string(presence.Payload) != "typing" {
+		t.Errorf("unexpected presence %v of %v", string(presence.Payload), presence.Mac)
+	}
+
+	// Updates sent too often are dropped
+	if err := manager.HandlePresence(*api.NewPresence("first", "presence", []byte("away"))); err == nil {
+		t.Error("expected an error for an update sent too often")
+	}
+	expectOpcodes(t, second, api.OpcodeAcceptance, api.OpcodePresence)
+
+	fake.Advance(time.Second)
+	if err := manager.HandlePresence(*api.NewPresence("first", "presence", []byte("away"))); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, second, api.OpcodeAcceptance, api.OpcodePresence, api.OpcodePresence)
+
+	if err := manager.HandlePresence(*api.NewPresence("outsider", "presence", []byte("typing"))); err == nil {
+		t.Error("expected an error for a presence to a community the mac is not part of")
+	}
+}
+
+func TestMaxCommunities(t *testing.T) {
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		MaxCommunities: 2,
+	})
+
+	expectOpcodes(t, join(t, manager, "first", "a"), api.OpcodeAcceptance)
+	expectOpcodes(t, join(t, manager, "second", "b"), api.OpcodeAcceptance)
+
+	refused := join(t, manager, "third", "c")
+	expectOpcodes(t, refused, api.OpcodeRejection)
+
+	var rejection api.Rejection
+	if err := refused.Decode(0, &rejection); err != nil {
+		t.Fatal(err)
+	}
+
+	if rejection.Reason != api.RejectionCommunityLimit {
+		t.Errorf("expected reason %v, got %v", api.RejectionCommunityLimit, rejection.Reason)
+	}
+
+	// Existing communities can still be joined
+	expectOpcodes(t, join(t, manager, "first", "d"), api.OpcodeAcceptance)
+
+	// Once a community is gone, another one can be created
+	if err := manager.HandleExited(*api.NewExited("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, join(t, manager, "third", "c"), api.OpcodeAcceptance)
+}
+
+func TestHandleApplicationChallenge(t *testing.T) {
+	secret := []byte("secret")
+
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		Secrets: map[string][]byte{"protected": secret},
+	})
+
+	valid := answerChallenge(t, manager, "protected", "valid", func(nonce []byte) []byte {
+		return api.Prove(secret, nonce, "protected", "valid")
+	})
+	expectOpcodes(t, valid, api.OpcodeChallenge, api.OpcodeAcceptance)
+
+	wrongSecret := answerChallenge(t, manager, "protected", "wrong-secret", func(nonce []byte) []byte {
+		return api.Prove([]byte("guess"), nonce, "protected", "wrong-secret")
+	})
+	expectOpcodes(t, wrongSecret, api.OpcodeChallenge, api.OpcodeRejection)
+
+	// A proof for another mac must not be accepted
+	wrongMac := answerChallenge(t, manager, "protected", "wrong-mac", func(nonce []byte) []byte {
+		return api.Prove(secret, nonce, "protected", "valid")
+	})
+	expectOpcodes(t, wrongMac, api.OpcodeChallenge, api.OpcodeRejection)
+
+	// Communities without a secret don't challenge
+	open := join(t, manager, "open", "open")
+	expectOpcodes(t, open, api.OpcodeAcceptance)
+}
+
+func TestHandleApplicationChallengeReplay(t *testing.T) {
+	secret := []byte("secret")
+
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		Secrets: map[string][]byte{"protected": secret},
+	})
+
+	var proof []byte
+	first := answerChallenge(t, manager, "protected", "replayed", func(nonce []byte) []byte {
+		proof = api.Prove(secret, nonce, "protected", "replayed")
+
+		return proof
+	})
+	expectOpcodes(t, first, api.OpcodeChallenge, api.OpcodeAcceptance)
+
+	if err := manager.HandleExited(*api.NewExited("replayed")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the proof on a new connection, without having been challenged there
+	replay := signalingtest.NewConn()
+	if err := manager.HandleApplication(*api.NewProvenApplication("protected", "replayed", proof), replay); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, replay, api.OpcodeRejection)
+
+	// Replaying the proof after a new challenge, which uses another nonce
+	second := answerChallenge(t, manager, "protected", "replayed", func(nonce []byte) []byte {
+		return proof
+	})
+	expectOpcodes(t, second, api.OpcodeChallenge, api.OpcodeRejection)
+}
+
+func TestHandleApplicationChallengeExpiry(t *testing.T) {
+	secret := []byte("secret")
+
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		Secrets:           map[string][]byte{"protected": secret},
+		DisconnectTimeout: time.Minute,
+		Clock:             fake,
+	})
+
+	collect := func(nonce []byte) []byte {
+		fake.Advance(30 * time.Second)
+		if err := manager.CollectGarbage(); err != nil {
+			t.Fatal(err)
+		}
+
+		return api.Prove(secret, nonce, "protected", "applicant")
+	}
+
+	// Answered within the timeout
+	prompt := answerChallenge(t, manager, "protected", "applicant", collect)
+	expectOpcodes(t, prompt, api.OpcodeChallenge, api.OpcodeAcceptance)
+
+	if err := manager.HandleExited(*api.NewExited("applicant")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Collected before it was answered
+	late := answerChallenge(t, manager, "protected", "applicant", func(nonce []byte) []byte {
+		collect(nonce)
+
+		return collect(nonce)
+	})
+	expectOpcodes(t, late, api.OpcodeChallenge, api.OpcodeRejection)
+}
+
+func TestDrain(t *testing.T) {
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		NotifyOnDrain: true,
+	})
+
+	first := join(t, manager, "unit", "first")
+	second := join(t, manager, "unit", "second")
+
+	// Introduces second to first, which starts a handshake
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- manager.Drain(ctx)
+	}()
+
+	// Wait until draining has started
+	var applicant *signalingtest.Conn
+	for i := 0; ; i++ {
+		applicant = join(t, manager, "unit", fmt.Sprintf("applicant-%v", i))
+		if messages := applicant.Messages(); len(messages) == 1 && messages[0].Opcode == api.OpcodeRejection {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var rejection api.Rejection
+	if err := applicant.Decode(0, &rejection); err != nil {
+		t.Fatal(err)
+	}
+
+	if rejection.Reason != api.RejectionDraining {
+		t.Errorf("expected rejection reason %v, got %v", api.RejectionDraining, rejection.Reason)
+	}
+
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned before the handshake was complete: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The existing peers can still complete their handshake
+	if err := manager.HandleOffer(*api.NewOffer([]byte("offer"), "first", "second")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.HandleAnswer(*api.NewAnswer([]byte("answer"), "second", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("drain did not return after the handshake was complete")
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeIntroduction, api.OpcodeAnswer, api.OpcodeDraining)
+	expectOpcodes(t, second, api.OpcodeAcceptance, api.OpcodeOffer, api.OpcodeDraining)
+}
+
+func TestDrainTimeout(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	join(t, manager, "unit", "first")
+	second := join(t, manager, "unit", "second")
+
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := manager.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestHandleApplicationReconnect(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	second := join(t, manager, "unit", "second")
+
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mac is in use as long as its connection is open
+	duplicate := join(t, manager, "unit", "first")
+	expectOpcodes(t, duplicate, api.OpcodeRejection)
+
+	manager.HandleClosed(first)
+
+	reconnected := join(t, manager, "unit", "first")
+	expectOpcodes(t, reconnected, api.OpcodeAcceptance)
+
+	var acceptance api.Acceptance
+	if err := reconnected.Decode(0, &acceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(acceptance.Members, []string{"second"}) {
+		t.Errorf("expected members [second], got %v", acceptance.Members)
+	}
+
+	// The peers are introduced again and messages reach the new connection
+	if err := manager.HandleReady(*api.NewReady("first", "unit"), reconnected); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, second, api.OpcodeAcceptance, api.OpcodeIntroduction)
+
+	if err := manager.HandleOffer(*api.NewOffer([]byte("offer"), "second", "first")); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, reconnected, api.OpcodeAcceptance, api.OpcodeOffer)
+}
+
+func TestReconnectWithSameMac(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	conn, _ := apply(t, addr, "reconnect", "first")
+	apply(t, addr, "reconnect", "second")
+
+	if err := conn.Close(websocket.StatusGoingAway, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server notices the closed connection asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, _, err := websocket.Dial(context.Background(), "ws://"+addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewApplication("reconnect", "first")); err != nil {
+			t.Fatal(err)
+		}
+
+		var acceptance api.Acceptance
+		if err := wsjson.Read(context.Background(), conn, &acceptance); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+
+		if acceptance.Opcode == api.OpcodeAcceptance {
+			if !reflect.DeepEqual(acceptance.Members, []string{"second"}) {
+				t.Errorf("expected members [second], got %v", acceptance.Members)
+			}
+
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("reconnect with the same mac was not accepted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuditHook(t *testing.T) {
+	events := make(chan handlers.AuditEvent, 10)
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		AuditHook: func(event handlers.AuditEvent) {
+			events <- event
+		},
+	})
+
+	start := time.Now()
+
+	join(t, manager, "audit", "first")
+	join(t, manager, "audit", "first")
+
+	if err := manager.HandleExited(*api.NewExited("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []handlers.AuditEvent{
+		{Type: handlers.AuditJoin, Community: "audit", Mac: "first"},
+		{Type: handlers.AuditReject, Community: "audit", Mac: "first"},
+		{Type: handlers.AuditExit, Community: "audit", Mac: "first"},
+	}
+
+	for _, want := range expected {
+		select {
+		case event := <-events:
+			if event.Time.Before(start) {
+				t.Errorf("expected a timestamp after %v, got %v", start, event.Time)
+			}
+
+			event.Time = time.Time{}
+			if event != want {
+				t.Errorf("expected event %v, got %v", want, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %v", want)
+		}
+	}
+}
+
+func TestAuditHookOverflow(t *testing.T) {
+	called := make(chan struct{}, 10)
+	events := make(chan handlers.AuditEvent)
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		AuditHook: func(event handlers.AuditEvent) {
+			called <- struct{}{}
+			events <- event
+		},
+		AuditBufferSize: 1,
+	})
+
+	receive := func() handlers.AuditEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("expected an event")
+		}
+
+		return handlers.AuditEvent{}
+	}
+
+	// The hook is blocked on the first event
+	join(t, manager, "audit", "first")
+	<-called
+
+	for manager.DroppedAuditEvents() == 0 {
+		join(t, manager, "audit", "second")
+	}
+
+	if event := receive(); event.Type != handlers.AuditJoin || event.Mac != "first" {
+		t.Errorf("expected the join of first, got %v", event)
+	}
+
+	if event := receive(); event.Type != handlers.AuditJoin || event.Mac != "second" {
+		t.Errorf("expected the join of second, got %v", event)
+	}
+
+	dropped := manager.DroppedAuditEvents()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := manager.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook is not called anymore after draining
+	join(t, manager, "audit", "third")
+
+	select {
+	case event := <-events:
+		t.Errorf("expected no event after draining, got %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if manager.DroppedAuditEvents() != dropped+1 {
+		t.Errorf("expected %v dropped events, got %v", dropped+1, manager.DroppedAuditEvents())
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		DisconnectTimeout: time.Minute,
+		Clock:             fake,
+	})
+
+	crashed := join(t, manager, "stale", "crashed")
+	if err := manager.HandleApplication(*api.NewApplication("shared", "crashed"), crashed); err != nil {
+		t.Fatal(err)
+	}
+	live := join(t, manager, "shared", "live")
+
+	manager.HandleClosed(crashed)
+
+	// The crashed member can still reconnect within the timeout
+	fake.Advance(30 * time.Second)
+	if err := manager.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, live, api.OpcodeAcceptance)
+
+	fake.Advance(time.Minute)
+	if err := manager.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, live, api.OpcodeAcceptance, api.OpcodeResignation)
+
+	// The stale community is gone, so a new member is alone in it
+	observer := join(t, manager, "stale", "observer")
+	expectOpcodes(t, observer, api.OpcodeAcceptance)
+
+	var acceptance api.Acceptance
+	if err := observer.Decode(0, &acceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(acceptance.Members) != 0 {
+		t.Errorf("expected an empty community, got members %v", acceptance.Members)
+	}
+
+	// The collected mac can join again
+	rejoined := join(t, manager, "shared", "crashed")
+	expectOpcodes(t, rejoined, api.OpcodeAcceptance)
+}
+
+func TestHandleClosedOwnedMacs(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		DisconnectTimeout: time.Minute,
+		Clock:             fake,
+	})
+
+	// A single connection applies with two macs
+	crashed := join(t, manager, "unit", "crashed")
+	if err := manager.HandleApplication(*api.NewApplication("alias", "alias"), crashed); err != nil {
+		t.Fatal(err)
+	}
+	live := join(t, manager, "unit", "live")
+
+	moved := join(t, manager, "unit", "moved")
+	manager.HandleClosed(moved)
+
+	// The mac moves to another connection, so the late close of its previous one leaves it alone
+	reconnected := signalingtest.NewConn()
+	if err := manager.HandleApplication(*api.NewApplication("unit", "moved"), reconnected); err != nil {
+		t.Fatal(err)
+	}
+	manager.HandleClosed(moved)
+
+	// Both macs of the abruptly closed connection are collected without an exit
+	manager.HandleClosed(crashed)
+
+	fake.Advance(2 * time.Minute)
+	if err := manager.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, live, api.OpcodeAcceptance, api.OpcodeResignation)
+
+	var resignation api.Resignation
+	if err := live.Decode(1, &resignation); err != nil {
+		t.Fatal(err)
+	}
+
+	if resignation.Mac != "crashed" {
+		t.Errorf("expected resignation of crashed, got %v", resignation.Mac)
+	}
+
+	if communities := manager.Communities(); !reflect.DeepEqual(communities, []string{"unit"}) {
+		t.Errorf("expected communities [unit], got %v", communities)
+	}
+
+	observer := join(t, manager, "unit", "observer")
+
+	var acceptance api.Acceptance
+	if err := observer.Decode(0, &acceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(acceptance.Members, []string{"live", "moved"}) {
+		t.Errorf("expected members [live moved], got %v", acceptance.Members)
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	second := join(t, manager, "unit", "second")
+
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeIntroduction)
+	expectOpcodes(t, second, api.OpcodeAcceptance)
+
+	var introduction api.Introduction
+	if err := first.Decode(1, &introduction); err != nil {
+		t.Fatal(err)
+	}
+
+	if introduction.Mac != "second" || introduction.Community != "unit" {
+		t.Errorf("expected introduction of second to unit, got %v to %v", introduction.Mac, introduction.Community)
+	}
+
+	// Peers are only introduced once
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeIntroduction)
+
+	if err := manager.HandleReady(*api.NewReady("third", "unit"), signalingtest.NewConn()); err == nil {
+		t.Error("ready of a mac outside of the community was accepted")
+	}
+}
+
+func TestHandleReadyOfForeignMac(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	second := join(t, manager, "unit", "second")
+	spoofer := join(t, manager, "unit", "spoofer")
+
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), spoofer); err == nil {
+		t.Error("ready of a mac which belongs to another connection was accepted")
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance)
+	expectOpcodes(t, second, api.OpcodeAcceptance)
+	expectOpcodes(t, spoofer, api.OpcodeAcceptance)
+
+	// The owner can still announce itself
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeIntroduction)
+}
+
+func TestHandleReadyRetriesFailedIntroduction(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	second := join(t, manager, "unit", "second")
+
+	first.WriteErr = errors.New("write failed")
+
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err == nil {
+		t.Fatal("failed introduction was not reported")
+	}
+
+	first.WriteErr = nil
+
+	if err := manager.HandleReady(*api.NewReady("second", "unit"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeIntroduction)
+}
+
+func TestHandleForwarding(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	join(t, manager, "unit", "second")
+
+	if err := manager.HandleOffer(*api.NewOffer([]byte("offer"), "second", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.HandleAnswer(*api.NewAnswer([]byte("answer"), "second", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.HandleCandidate(*api.NewCandidate([]byte("candidate"), "second", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeOffer, api.OpcodeAnswer, api.OpcodeCandidate)
+
+	var candidate api.Candidate
+	if err := first.Decode(3, &candidate); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(candidate.Payload) != "candidate" || candidate.SenderMac != "second" {
+		t.Errorf("unexpected candidate %v from %v", string(candidate.Payload), candidate.SenderMac)
+	}
+
+	if err := manager.HandleOffer(*api.NewOffer([]byte("offer"), "second", "unknown")); err == nil {
+		t.Error("offer to an unknown mac was accepted")
+	}
+}
+
+func TestHandleExited(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	first := join(t, manager, "unit", "first")
+	join(t, manager, "unit", "second")
+
+	if err := manager.HandleExited(*api.NewExited("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeResignation)
+
+	var resignation api.Resignation
+	if err := first.Decode(1, &resignation); err != nil {
+		t.Fatal(err)
+	}
+
+	if resignation.Mac != "second" {
+		t.Errorf("expected resignation of second, got %v", resignation.Mac)
+	}
+
+	if err := manager.HandleCandidate(*api.NewCandidate([]byte("candidate"), "first", "second")); err == nil {
+		t.Error("candidate to an exited mac was accepted")
+	}
+}
+
+func TestHandleExitedDeadMember(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	dead := join(t, manager, "unit", "dead")
+	first := join(t, manager, "unit", "first")
+	exiting := join(t, manager, "unit", "exiting")
+
+	if err := manager.HandleApplication(*api.NewApplication("other", "exiting"), exiting); err != nil {
+		t.Fatal(err)
+	}
+	second := join(t, manager, "other", "second")
+
+	dead.WriteErr = errors.New("Connection is dead")
+
+	if err := manager.HandleExited(*api.NewExited("exiting")); err == nil {
+		t.Error("failed resignation was not reported")
+	}
+
+	// The members after the dead one and of the other community are still notified
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeResignation)
+	expectOpcodes(t, second, api.OpcodeAcceptance, api.OpcodeResignation)
+
+	if err := manager.HandleCandidate(*api.NewCandidate([]byte("candidate"), "first", "exiting")); err == nil {
+		t.Error("candidate to an exited mac was accepted")
+	}
+}
+
+// Blocks the writes to it until it is released, as if the client stopped reading
+type stalledConn struct {
+	*signalingtest.Conn
+
+	stalled  chan struct{}
+	blocked  chan struct{}
+	released chan struct{}
+}
+
+func (c stalledConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	select {
+	case <-c.stalled:
+		c.blocked <- struct{}{}
+
+		<-c.released
+	default:
+	}
+
+	return c.Conn.Write(ctx, typ, p)
+}
+
+func TestStalledMemberDoesNotBlockHandlers(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	stalled := stalledConn{signalingtest.NewConn(), make(chan struct{}), make(chan struct{}, 1), make(chan struct{})}
+	if err := manager.HandleApplication(*api.NewApplication("unit", "stalled"), stalled); err != nil {
+		t.Fatal(err)
+	}
+	join(t, manager, "unit", "exiting")
+
+	close(stalled.stalled)
+	defer close(stalled.released)
+
+	// The resignation to the stalled member is written without holding up the other handlers
+	go manager.HandleExited(*api.NewExited("exiting"))
+
+	<-stalled.blocked
+
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.HandleApplication(*api.NewApplication("other", "applicant"), signalingtest.NewConn())
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("application was held up by the write to a stalled member")
+	}
+}
+
+// Records the mac of each connection written to in a log shared between connections
+type loggingConn struct {
+	*signalingtest.Conn
+
+	mac string
+	log *[]string
+}
+
+func (c loggingConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	*c.log = append(*c.log, c.mac)
+
+	return c.Conn.Write(ctx, typ, p)
+}
+
+func TestHandleReadyIntroductionOrder(t *testing.T) {
+	macs := []string{"delta", "alpha", "echo", "charlie", "bravo"}
+
+	for run := 0; run < 10; run++ {
+		manager := handlers.NewCommunitiesManager()
+
+		log := []string{}
+		conns := map[string]loggingConn{}
+		for _, mac := range macs {
+			conns[mac] = loggingConn{signalingtest.NewConn(), mac, &log}
+
+			if err := manager.HandleApplication(*api.NewApplication("unit", mac), conns[mac]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		log = []string{}
+		if err := manager.HandleReady(*api.NewReady("charlie", "unit"), conns["charlie"]); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(log, []string{"alpha", "bravo", "delta", "echo"}) {
+			t.Fatalf("expected introductions in order [alpha bravo delta echo], got %v", log)
+		}
+	}
+}
+
+func TestHandleReadyIntroductionSpacing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fake := clock.NewFake(time.Now())
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		IntroductionSpacing: time.Second,
+		Clock:               fake,
+	})
+
+	members := []*signalingtest.Conn{
+		join(t, manager, "spacing", "alpha"),
+		join(t, manager, "spacing", "bravo"),
+		join(t, manager, "spacing", "charlie"),
+	}
+	ready := join(t, manager, "spacing", "delta")
+
+	introductions := func() int {
+		count := 0
+		for _, member := range members {
+			for _, message := range member.Messages() {
+				if message.Opcode == api.OpcodeIntroduction {
+					count++
+				}
+			}
+		}
+
+		return count
+	}
+
+	if err := manager.HandleReady(*api.NewReady("delta", "spacing"), ready); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(members); i++ {
+		// The next introduction is only sent once the spacing passed
+		if err := fake.WaitForTimers(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if count := introductions(); count != i {
+			t.Fatalf("expected %v introductions, got %v", i, count)
+		}
+
+		fake.Advance(time.Second / 2)
+		if count := introductions(); count != i {
+			t.Fatalf("expected %v introductions before the spacing passed, got %v", i, count)
+		}
+
+		fake.Advance(time.Second / 2)
+	}
+
+	for introductions() != len(members) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected %v introductions, got %v", len(members), introductions())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	for _, member := range members {
+		expectOpcodes(t, member, api.OpcodeAcceptance, api.OpcodeIntroduction)
+	}
+}
+
+func TestMeshState(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	join(t, manager, "mesh", "alpha")
+	bravo := join(t, manager, "mesh", "bravo")
+	charlie := join(t, manager, "mesh", "charlie")
+
+	if pairs := manager.MeshState("mesh"); len(pairs) != 0 {
+		t.Fatalf("expected no pairs before any member is ready, got %v", pairs)
+	}
+
+	if err := manager.HandleReady(*api.NewReady("bravo", "mesh"), bravo); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.HandleReady(*api.NewReady("charlie", "mesh"), charlie); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []handlers.MeshPair{
+		{ReadyMac: "bravo", IntroducedMac: "alpha", Pending: true},
+		{ReadyMac: "bravo", IntroducedMac: "charlie", Pending: true},
+		{ReadyMac: "charlie", IntroducedMac: "alpha", Pending: true},
+	}
+	if pairs := manager.MeshState("mesh"); !reflect.DeepEqual(pairs, expected) {
+		t.Fatalf("expected pairs %v, got %v", expected, pairs)
+	}
+
+	// The handshake is complete once the answer was forwarded, regardless of which member sent it
+	if err := manager.HandleAnswer(*api.NewAnswer([]byte("answer"), "charlie", "bravo")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected[1].Pending = false
+	if pairs := manager.MeshState("mesh"); !reflect.DeepEqual(pairs, expected) {
+		t.Fatalf("expected pairs %v, got %v", expected, pairs)
+	}
+
+	if pairs := manager.MeshState("unknown"); len(pairs) != 0 {
+		t.Fatalf("expected no pairs for an unknown community, got %v", pairs)
+	}
+}
+
+func TestHandleReconnect(t *testing.T) {
+	setup := func(t *testing.T) (*clock.Fake, *handlers.CommunitiesManager, *signalingtest.Conn, string) {
+		fake := clock.NewFake(time.Now())
+		manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+			ReconnectTokenTTL: time.Minute,
+			Clock:             fake,
+		})
+
+		first := join(t, manager, "reconnect", "first")
+		second := join(t, manager, "reconnect", "second")
+
+		var acceptance api.Acceptance
+		if err := second.Decode(0, &acceptance); err != nil {
+			t.Fatal(err)
+		}
+		if acceptance.Token == "" {
+			t.Fatal("expected the acceptance to contain a reconnect token")
+		}
+
+		manager.HandleClosed(second)
+
+		return fake, manager, first, acceptance.Token
+	}
+
+	expectInvalidToken := func(t *testing.T, conn *signalingtest.Conn) {
+		expectOpcodes(t, conn, api.OpcodeRejection)
+
+		var rejection api.Rejection
+		if err := conn.Decode(0, &rejection); err != nil {
+			t.Fatal(err)
+		}
+		if rejection.Reason != api.RejectionInvalidToken {
+			t.Fatalf("expected rejection reason %v, got %v", api.RejectionInvalidToken, rejection.Reason)
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		_, manager, first, token := setup(t)
+
+		reconnected := signalingtest.NewConn()
+		if err := manager.HandleReconnect(*api.NewReconnect("second", token), reconnected); err != nil {
+			t.Fatal(err)
+		}
+		expectOpcodes(t, reconnected, api.OpcodeAcceptance)
+
+		var acceptance api.Acceptance
+		if err := reconnected.Decode(0, &acceptance); err != nil {
+			t.Fatal(err)
+		}
+		if acceptance.Community != "reconnect" || !reflect.DeepEqual(acceptance.Members, []string{"first"}) {
+			t.Fatalf("expected acceptance to community reconnect with members [first], got %v with %v", acceptance.Community, acceptance.Members)
+		}
+		if acceptance.Token == "" || acceptance.Token == token {
+			t.Fatalf("expected a new reconnect token, got %q", acceptance.Token)
+		}
+
+		// The new connection owns the mac, so it is introduced to the other members again
+		if err := manager.HandleReady(*api.NewReady("second", "reconnect"), reconnected); err != nil {
+			t.Fatal(err)
+		}
+		expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeIntroduction)
+
+		// Each token can only be used until a new one was issued
+		replayed := signalingtest.NewConn()
+		if err := manager.HandleReconnect(*api.NewReconnect("second", token), replayed); err != nil {
+			t.Fatal(err)
+		}
+		expectInvalidToken(t, replayed)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		fake, manager, _, token := setup(t)
+
+		fake.Advance(2 * time.Minute)
+
+		reconnected := signalingtest.NewConn()
+		if err := manager.HandleReconnect(*api.NewReconnect("second", token), reconnected); err != nil {
+			t.Fatal(err)
+		}
+		expectInvalidToken(t, reconnected)
+
+		if err := manager.HandleReady(*api.NewReady("second", "reconnect"), reconnected); err == nil {
+			t.Fatal("expected the rejected connection not to own the mac")
+		}
+	})
+
+	t.Run("forged", func(t *testing.T) {
+		_, manager, _, token := setup(t)
+
+		for _, reconnect := range []*api.Reconnect{
+			api.NewReconnect("second", "forged"),
+			api.NewReconnect("first", token),
+			api.NewReconnect("unknown", token),
+		} {
+			reconnected := signalingtest.NewConn()
+			if err := manager.HandleReconnect(*reconnect, reconnected); err != nil {
+				t.Fatal(err)
+			}
+			expectInvalidToken(t, reconnected)
+		}
+	})
+}
+
+// blockingConn holds up the write of a relayed message with the payload block until release is closed
+type blockingConn struct {
+	*signalingtest.Conn
+
+	block   string
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (c blockingConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	var relay api.Relay
+	if err := json.Unmarshal(p, &relay); err == nil && relay.Opcode == api.OpcodeRelay && string(relay.Payload) == c.block {
+		close(c.blocked)
+
+		<-c.release
+	}
+
+	return c.Conn.Write(ctx, typ, p)
+}
+
+func TestHandleRelayOrder(t *testing.T) {
+	manager := handlers.NewCommunitiesManager()
+
+	join(t, manager, "order", "first")
+	join(t, manager, "order", "second")
+
+	receiver := blockingConn{signalingtest.NewConn(), "slow", make(chan struct{}), make(chan struct{})}
+	if err := manager.HandleApplication(*api.NewApplication("order", "receiver"), receiver); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- manager.HandleRelay(*api.NewRelay([]byte("slow"), "first", "receiver"))
+	}()
+
+	select {
+	case <-receiver.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first relay was not written")
+	}
+
+	// The relay of another sender is handled while the first one is still being written
+	go func() {
+		errs <- manager.HandleRelay(*api.NewRelay([]byte("fast"), "second", "receiver"))
+	}()
+
+	<-time.After(100 * time.Millisecond)
+	close(receiver.release)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payloads := []string{}
+	for i, message := range receiver.Messages() {
+		if message.Opcode != api.OpcodeRelay {
+			continue
+		}
+
+		var relay api.Relay
+		if err := receiver.Decode(i, &relay); err != nil {
+			t.Fatal(err)
+		}
+
+		payloads = append(payloads, string(relay.Payload))
+	}
+
+	if !reflect.DeepEqual(payloads, []string{"slow", "fast"}) {
+		t.Fatalf("expected relays in order [slow fast], got %v", payloads)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	payload := []byte("payload")
+
+	for _, c := range []struct {
+		name    string
+		message interface{ Validate() error }
+		field   string
+	}{
+		{"valid application", api.NewApplication("community", "mac"), ""},
+		{"application without community", api.NewApplication("", "mac"), "community"},
+		{"application without mac", api.NewApplication("community", ""), "mac"},
+		{"valid ready", api.NewReady("mac", ""), ""},
+		{"ready without mac", api.NewReady("", "community"), "mac"},
+		{"valid offer", api.NewOffer(payload, "sender", "receiver"), ""},
+		{"offer without payload", api.NewOffer(nil, "sender", "receiver"), "payload"},
+		{"offer without sender", api.NewOffer(payload, "", "receiver"), "sender"},
+		{"offer without receiver", api.NewOffer(payload, "sender", ""), "receiver"},
+		{"valid answer", api.NewAnswer(payload, "sender", "receiver"), ""},
+		{"answer without payload", api.NewAnswer(nil, "sender", "receiver"), "payload"},
+		{"answer without sender", api.NewAnswer(payload, "", "receiver"), "sender"},
+		{"answer without receiver", api.NewAnswer(payload, "sender", ""), "receiver"},
+		{"valid candidate", api.NewCandidate(payload, "sender", "receiver"), ""},
+		{"candidate without payload", api.NewCandidate(nil, "sender", "receiver"), "payload"},
+		{"candidate without sender", api.NewCandidate(payload, "", "receiver"), "sender"},
+		{"candidate without receiver", api.NewCandidate(payload, "sender", ""), "receiver"},
+		{"valid candidate batch", &api.Candidate{Message: api.Message{Opcode: api.OpcodeCandidate}, Payload: payload, SenderMac: "sender", ReceiverMac: "receiver", Batch: [][]byte{payload}}, ""},
+		{"candidate batch with empty candidate", &api.Candidate{Message: api.Message{Opcode: api.OpcodeCandidate}, Payload: payload, SenderMac: "sender", ReceiverMac: "receiver", Batch: [][]byte{nil}}, "batch"},
+		{"valid exited", api.NewExited("mac"), ""},
+		{"exited without mac", api.NewScopedExited("", "community"), "mac"},
+		{"valid reconnect", api.NewReconnect("mac", "token"), ""},
+		{"reconnect without mac", api.NewReconnect("", "token"), "mac"},
+		{"reconnect without token", api.NewReconnect("mac", ""), "token"},
+		{"valid repeer", api.NewRepeer("sender", "receiver", ""), ""},
+		{"repeer without sender", api.NewRepeer("", "receiver", "community"), "sender"},
+		{"repeer without receiver", api.NewRepeer("sender", "", "community"), "receiver"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.message.Validate()
+			if c.field == "" {
+				if err != nil {
+					t.Fatalf("expected message to be valid, got %v", err)
+				}
+
+				return
+			}
+
+			var invalid *api.InvalidMessage
+			if !errors.As(err, &invalid) || invalid.Field != c.field {
+				t.Fatalf("expected missing %v to be rejected, got %v", c.field, err)
+			}
+		})
+	}
+}
+
+func TestInvalidMessageIsRejected(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	conn, _, err := websocket.Dial(context.Background(), "ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	if err := wsjson.Write(context.Background(), conn, api.NewApplication("validation", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := conn.Read(context.Background()); websocket.CloseStatus(err) != websocket.StatusProtocolError {
+		t.Fatalf("expected connection to be closed with %v, got %v", websocket.StatusProtocolError, err)
+	}
+
+	// The invalid application must not have created a member
+	_, acceptance := apply(t, addr, "validation", "valid")
+	if len(acceptance.Members) != 0 {
+		t.Errorf("expected no members, got %v", acceptance.Members)
+	}
+}
+
+func TestHandleApplicationAssignMacs(t *testing.T) {
+	manager := handlers.NewCommunitiesManagerWithConfig(handlers.CommunitiesManagerConfig{
+		AssignMacs: true,
+	})
+
+	// Both applicants claim the same mac
+	first := join(t, manager, "assigned", "spoofed")
+	second := join(t, manager, "assigned", "spoofed")
+	expectOpcodes(t, first, api.OpcodeAcceptance)
+	expectOpcodes(t, second, api.OpcodeAcceptance)
+
+	var firstAcceptance, secondAcceptance api.Acceptance
+	if err := first.Decode(0, &firstAcceptance); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Decode(0, &secondAcceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if firstAcceptance.Mac == "" || firstAcceptance.Mac == "spoofed" || firstAcceptance.Mac == secondAcceptance.Mac {
+		t.Fatalf("expected distinct assigned macs, got %v and %v", firstAcceptance.Mac, secondAcceptance.Mac)
+	}
+
+	if !reflect.DeepEqual(secondAcceptance.Members, []string{firstAcceptance.Mac}) {
+		t.Errorf("expected members [%v], got %v", firstAcceptance.Mac, secondAcceptance.Members)
+	}
+
+	// The connection keeps its mac for further communities
+	if err := manager.HandleApplication(*api.NewApplication("other", "another"), first); err != nil {
+		t.Fatal(err)
+	}
+	expectOpcodes(t, first, api.OpcodeAcceptance, api.OpcodeAcceptance)
+
+	var otherAcceptance api.Acceptance
+	if err := first.Decode(1, &otherAcceptance); err != nil {
+		t.Fatal(err)
+	}
+
+	if otherAcceptance.Mac != firstAcceptance.Mac {
+		t.Errorf("expected mac %v for the other community, got %v", firstAcceptance.Mac, otherAcceptance.Mac)
+	}
+}
@@ -0,0 +1,1334 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alphahorizonio/libentangle/internal/logging"
+	api "github.com/alphahorizonio/libentangle/pkg/api/websockets/v1"
+	"github.com/alphahorizonio/libentangle/pkg/handlers"
+	"github.com/alphahorizonio/libentangle/pkg/networking"
+	"github.com/alphahorizonio/libentangle/pkg/signaling"
+	"github.com/alphahorizonio/libentangle/pkg/signaling/signalingtest"
+	"github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func newTestSignalingClient(onAcceptance func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error) *signaling.SignalingClient {
+	return newTestSignalingClientWithConfig(onAcceptance, signaling.SignalingClientConfig{})
+}
+
+func newTestSignalingClientWithConfig(onAcceptance func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error, config signaling.SignalingClientConfig) *signaling.SignalingClient {
+	return signaling.NewSignalingClientWithConfig(
+		onAcceptance,
+		func(conn *websocket.Conn, uuid string, wg *sync.WaitGroup, introduction api.Introduction) error {
+			return nil
+		},
+		func(conn *websocket.Conn, wg *sync.WaitGroup, uuid string, offer api.Offer) error {
+			return nil
+		},
+		func(wg *sync.WaitGroup, answer api.Answer) error {
+			return nil
+		},
+		func(candidate api.Candidate) error {
+			return nil
+		},
+		func(resignation api.Resignation) error {
+			return nil
+		},
+		logging.NewJSONLogger(0),
+		config,
+	)
+}
+
+func TestSignalingClientSkipsInvalidMessages(t *testing.T) {
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		conn.Write(context.Background(), websocket.MessageText, []byte("garbage"))
+		conn.Write(context.Background(), websocket.MessageText, []byte(`{"opcode": "acceptance"`))
+		conn.Write(context.Background(), websocket.MessageText, []byte(`{"opcode": "introduction", "mac": 1}`))
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("test")); err != nil {
+			return
+		}
+
+		time.Sleep(time.Second)
+	})
+
+	accepted := make(chan struct{})
+
+	client := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		close(accepted)
+
+		return nil
+	})
+
+	go client.HandleConn(addr, "test", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("valid message after invalid ones was not processed")
+	}
+}
+
+func TestSignalingClientClosesWithRejectionReason(t *testing.T) {
+	status := make(chan websocket.StatusCode, 1)
+
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewRejection()); err != nil {
+			return
+		}
+
+		_, _, err := conn.Read(context.Background())
+		status <- websocket.CloseStatus(err)
+	})
+
+	client := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	})
+
+	err := client.HandleConn(addr, "test", func(msg webrtc.DataChannelMessage) {})
+
+	var rejected *signaling.ApplicationRejected
+	if !errors.As(err, &rejected) {
+		t.Errorf("expected rejection error, got %v", err)
+	}
+
+	select {
+	case code := <-status:
+		if code != websocket.StatusPolicyViolation {
+			t.Errorf("expected close status %v, got %v", websocket.StatusPolicyViolation, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestSignalingClientOnJoined(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	type joined struct {
+		community string
+		mac       string
+	}
+
+	macs := make(chan string, 1)
+	joins := make(chan joined, 1)
+
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		macs <- uuid
+
+		return nil
+	}, signaling.SignalingClientConfig{
+		OnJoined: func(community string, mac string) {
+			joins <- joined{community, mac}
+		},
+		OnRejected: func(reason string) {
+			t.Errorf("unexpected rejection with reason %q", reason)
+		},
+	})
+	defer client.Close()
+
+	go client.HandleConn(addr, "joined", func(msg webrtc.DataChannelMessage) {})
+
+	var mac string
+	select {
+	case mac = <-macs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not accepted")
+	}
+
+	select {
+	case j := <-joins:
+		if j.community != "joined" {
+			t.Errorf("expected community joined, got %v", j.community)
+		}
+
+		if j.mac != mac {
+			t.Errorf("expected mac %v, got %v", mac, j.mac)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnJoined was not called")
+	}
+}
+
+func TestSignalingClientSignals(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		handled bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opcodes := make(chan string, 10)
+			addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+				var application api.Application
+				if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+					return
+				}
+
+				if err := wsjson.Write(context.Background(), conn, api.NewAcceptance("signals")); err != nil {
+					return
+				}
+
+				for {
+					var message api.Message
+					if err := wsjson.Read(context.Background(), conn, &message); err != nil {
+						return
+					}
+
+					opcodes <- message.Opcode
+				}
+			})
+
+			accepted := make(chan struct{}, 1)
+			client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+				accepted <- struct{}{}
+
+				return nil
+			}, signaling.SignalingClientConfig{
+				HandleSignals: c.handled,
+			})
+			defer client.Close()
+
+			returned := make(chan error, 1)
+			go func() {
+				returned <- client.HandleConn(addr, "signals", func(msg webrtc.DataChannelMessage) {})
+			}()
+
+			select {
+			case <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("client was not accepted")
+			}
+
+			// Our own handler keeps the signal from terminating the test
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM)
+			defer signal.Stop(signals)
+
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+			<-signals
+
+			if !c.handled {
+				select {
+				case opcode := <-opcodes:
+					t.Fatalf("expected the client to ignore the signal, got %v", opcode)
+				case err := <-returned:
+					t.Fatalf("expected the client to ignore the signal, but HandleConn returned %v", err)
+				case <-time.After(500 * time.Millisecond):
+				}
+
+				return
+			}
+
+			select {
+			case opcode := <-opcodes:
+				if opcode != api.OpcodeExited {
+					t.Fatalf("expected the client to exit, got %v", opcode)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("client did not exit")
+			}
+
+			select {
+			case err := <-returned:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("HandleConn did not return")
+			}
+		})
+	}
+}
+
+func TestSignalingClientDone(t *testing.T) {
+	t.Run("signal", func(t *testing.T) {
+		addr := startSignalingServer(t)
+
+		manager := handlers.NewClientManager(func(mac string, channel *webrtc.DataChannel) {})
+		connection := networking.NewConnectionManagerWithConfig(manager, signaling.SignalingClientConfig{
+			HandleSignals: true,
+		})
+		connection.Connect(addr, "done", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+
+		for manager.Mac() == "" {
+			select {
+			case <-connection.Done():
+				t.Fatalf("connection was closed before it was accepted: %v", connection.Err())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		// The exit path returns instead of terminating the process
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connection.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection was not done after the signal")
+		}
+
+		if err := connection.Err(); err != nil {
+			t.Fatalf("expected a clean exit, got %v", err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+			var application api.Application
+			if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+				return
+			}
+
+			wsjson.Write(context.Background(), conn, api.NewRejectionWithReason(api.RejectionBanned))
+		})
+
+		client := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+			return nil
+		})
+
+		go client.HandleConn(addr, "done", func(msg webrtc.DataChannelMessage) {})
+
+		select {
+		case <-client.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("client was not done after the rejection")
+		}
+
+		var rejected *signaling.ApplicationRejected
+		if err := client.Err(); !errors.As(err, &rejected) || rejected.Reason != api.RejectionBanned {
+			t.Fatalf("expected a rejection because of a ban, got %v", err)
+		}
+	})
+}
+
+// Fails the write after the given amount of writes, after the data was sent
+type failingConn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	writes int
+	failAt int
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writes++
+	if c.writes == c.failAt {
+		return n, errors.New("write failed")
+	}
+
+	return n, nil
+}
+
+func TestSignalingClientRetriesApplication(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	var lock sync.Mutex
+	dials := 0
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			dials++
+			if dials == 1 {
+				// The first write is the handshake, the second one the application
+				return &failingConn{Conn: conn, failAt: 2}, nil
+			}
+
+			return conn, nil
+		},
+	}
+
+	accepted := make(chan string, 1)
+
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		accepted <- uuid
+
+		return nil
+	}, signaling.SignalingClientConfig{
+		HTTPClient:              &http.Client{Transport: transport},
+		ApplicationRetryBackoff: time.Millisecond,
+		// Failed writes only return once they time out
+		WriteTimeout: 100 * time.Millisecond,
+	})
+	defer client.Close()
+
+	go client.HandleConn(addr, "retries", func(msg webrtc.DataChannelMessage) {})
+
+	var mac string
+	select {
+	case mac = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not accepted after retrying its application")
+	}
+
+	lock.Lock()
+	if dials != 2 {
+		t.Errorf("expected 2 dials, got %v", dials)
+	}
+	lock.Unlock()
+
+	// The mac is only registered once, although the server received both applications
+	members := make(chan []string, 1)
+
+	other := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		members <- acceptance.Members
+
+		return nil
+	})
+	defer other.Close()
+
+	go other.HandleConn(addr, "retries", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case m := <-members:
+		if !reflect.DeepEqual(m, []string{mac}) {
+			t.Errorf("expected members %v, got %v", []string{mac}, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("other client was not accepted")
+	}
+}
+
+func TestSignalingClientOnRejected(t *testing.T) {
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewRejectionWithReason(api.RejectionBanned)); err != nil {
+			return
+		}
+
+		conn.Read(context.Background())
+	})
+
+	reasons := make(chan string, 1)
+
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	}, signaling.SignalingClientConfig{
+		OnJoined: func(community string, mac string) {
+			t.Error("OnJoined was called for a rejected application")
+		},
+		OnRejected: func(reason string) {
+			reasons <- reason
+		},
+	})
+
+	client.HandleConn(addr, "test", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case reason := <-reasons:
+		if reason != api.RejectionBanned {
+			t.Errorf("expected reason %v, got %v", api.RejectionBanned, reason)
+		}
+	default:
+		t.Fatal("OnRejected was not called")
+	}
+}
+
+// Challenges the first application and accepts the answer if it proves knowing the secret
+func startChallengingSignalingServer(t *testing.T, secret []byte) string {
+	nonce := []byte("nonce")
+
+	return startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewChallenge(application.Community, nonce)); err != nil {
+			return
+		}
+
+		var proven api.Application
+		if err := wsjson.Read(context.Background(), conn, &proven); err != nil {
+			return
+		}
+
+		if !api.VerifyProof(secret, nonce, proven.Community, proven.Mac, proven.Proof) {
+			wsjson.Write(context.Background(), conn, api.NewRejection())
+
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance(proven.Community)); err != nil {
+			return
+		}
+
+		time.Sleep(time.Second)
+	})
+}
+
+func TestSignalingClientAnswersChallenge(t *testing.T) {
+	secret := []byte("secret")
+	addr := startChallengingSignalingServer(t, secret)
+
+	accepted := make(chan struct{})
+
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		close(accepted)
+
+		return nil
+	}, signaling.SignalingClientConfig{
+		Secrets: map[string][]byte{"protected": secret},
+	})
+
+	go client.HandleConn(addr, "protected", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("challenge was not answered with a valid proof")
+	}
+}
+
+func TestSignalingClientWithoutSecret(t *testing.T) {
+	addr := startChallengingSignalingServer(t, []byte("secret"))
+
+	client := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	})
+
+	err := client.HandleConn(addr, "protected", func(msg webrtc.DataChannelMessage) {})
+
+	var required *signaling.SecretRequired
+	if !errors.As(err, &required) || required.Community != "protected" {
+		t.Errorf("expected secret required error, got %v", err)
+	}
+}
+
+// Counts the running goroutines carrying a pprof label, which they inherit from the goroutine which started them
+func labeledGoroutines(t *testing.T, label string) int {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for _, stack := range strings.Split(buf.String(), "\n\n") {
+		// The signal handling goroutine is started once by the first call to signal.Notify and runs forever
+		if !strings.Contains(stack, `"leak":"`+label+`"`) || strings.Contains(stack, "os/signal.loop") {
+			continue
+		}
+
+		var n int
+		if _, err := fmt.Sscanf(stack, "%d @", &n); err != nil {
+			t.Fatal(err)
+		}
+
+		count += n
+	}
+
+	return count
+}
+
+func TestSignalingClientStopsGoroutines(t *testing.T) {
+	addr := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewRejection()); err != nil {
+			return
+		}
+
+		conn.Read(context.Background())
+	})
+
+	client := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	})
+
+	pprof.Do(context.Background(), pprof.Labels("leak", t.Name()), func(ctx context.Context) {
+		if err := client.HandleConn(addr, "test", func(msg webrtc.DataChannelMessage) {}); err == nil {
+			t.Error("expected the rejection to be returned")
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for labeledGoroutines(t, t.Name()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines are still running after HandleConn returned", labeledGoroutines(t, t.Name()))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Returns an address nothing listens on
+func unreachableAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return addr
+}
+
+func TestSignalingClientReconnectAttempts(t *testing.T) {
+	addr := unreachableAddr(t)
+
+	attempts := []int{}
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	}, signaling.SignalingClientConfig{
+		OnReconnectAttempt: func(attempt int) (string, bool) {
+			attempts = append(attempts, attempt)
+
+			return addr, attempt < 3
+		},
+	})
+
+	if err := client.HandleConn(addr, "test", func(msg webrtc.DataChannelMessage) {}); err == nil {
+		t.Error("expected the dial error to be returned")
+	}
+
+	if !reflect.DeepEqual(attempts, []int{1, 2, 3}) {
+		t.Errorf("expected attempts [1 2 3], got %v", attempts)
+	}
+}
+
+func TestSignalingClientReconnectFailover(t *testing.T) {
+	fallback := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance(application.Community)); err != nil {
+			return
+		}
+
+		time.Sleep(time.Second)
+	})
+
+	accepted := make(chan struct{})
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		close(accepted)
+
+		return nil
+	}, signaling.SignalingClientConfig{
+		OnReconnectAttempt: func(attempt int) (string, bool) {
+			return fallback, attempt == 1
+		},
+	})
+
+	go client.HandleConn(unreachableAddr(t), "test", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not fail over to the other signaling server")
+	}
+}
+
+func TestSignalingClientFailover(t *testing.T) {
+	second := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		if err := wsjson.Write(context.Background(), conn, api.NewAcceptance(application.Community)); err != nil {
+			return
+		}
+
+		time.Sleep(time.Second)
+	})
+
+	accepted := make(chan string, 1)
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		accepted <- acceptance.Community
+
+		return nil
+	}, signaling.SignalingClientConfig{
+		Addrs: []string{second},
+	})
+
+	go client.HandleConn(unreachableAddr(t), "test", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case community := <-accepted:
+		if community != "test" {
+			t.Errorf("expected to apply for community test, got %v", community)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not fail over to the second signaling server")
+	}
+}
+
+func TestSignalingClientFailoverKeepsMac(t *testing.T) {
+	macs := make(chan string, 2)
+	apply := func(conn *websocket.Conn) bool {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return false
+		}
+		macs <- application.Mac
+
+		return true
+	}
+
+	// The first server fails right after the application
+	first := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		apply(conn)
+
+		conn.Close(websocket.StatusInternalError, "failure")
+	})
+	second := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		if apply(conn) {
+			time.Sleep(time.Second)
+		}
+	})
+
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	}, signaling.SignalingClientConfig{
+		Addrs: []string{second},
+	})
+
+	go client.HandleConn(first, "test", func(msg webrtc.DataChannelMessage) {})
+
+	received := []string{}
+	for len(received) < 2 {
+		select {
+		case mac := <-macs:
+			received = append(received, mac)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected applications to both servers, got %v", received)
+		}
+	}
+
+	if received[0] != received[1] {
+		t.Errorf("mac changed from %v to %v when failing over", received[0], received[1])
+	}
+}
+
+func TestSignalingClientFailoverReconnects(t *testing.T) {
+	// The first server assigns a mac and fails right after accepting it
+	first := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+
+		acceptance := api.NewAcceptance(application.Community)
+		acceptance.Mac = "assigned"
+		acceptance.Token = "token"
+		if err := wsjson.Write(context.Background(), conn, acceptance); err != nil {
+			return
+		}
+
+		conn.Close(websocket.StatusInternalError, "failure")
+	})
+
+	// The second server doesn't know the token, so the client has to apply again
+	reconnects := make(chan api.Reconnect, 1)
+	applications := make(chan api.Application, 1)
+	second := startFakeSignalingServer(t, func(conn *websocket.Conn) {
+		var reconnect api.Reconnect
+		if err := wsjson.Read(context.Background(), conn, &reconnect); err != nil {
+			return
+		}
+		reconnects <- reconnect
+
+		if err := wsjson.Write(context.Background(), conn, api.NewRejectionWithReason(api.RejectionInvalidToken)); err != nil {
+			return
+		}
+
+		var application api.Application
+		if err := wsjson.Read(context.Background(), conn, &application); err != nil {
+			return
+		}
+		applications <- application
+
+		time.Sleep(time.Second)
+	})
+
+	client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		return nil
+	}, signaling.SignalingClientConfig{
+		Addrs: []string{second},
+	})
+
+	go client.HandleConn(first, "test", func(msg webrtc.DataChannelMessage) {})
+
+	select {
+	case reconnect := <-reconnects:
+		if reconnect.Opcode != api.OpcodeReconnect || reconnect.Mac != "assigned" || reconnect.Token != "token" {
+			t.Errorf("expected a reconnect of assigned with its token, got %v", reconnect)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect to the second server")
+	}
+
+	select {
+	case application := <-applications:
+		if application.Opcode != api.OpcodeApplication || application.Mac != "assigned" || application.Community != "test" {
+			t.Errorf("expected an application of assigned for test, got %v", application)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not apply after its token was rejected")
+	}
+}
+
+func TestSignalingClientPresence(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	type update struct {
+		receiver int
+		presence api.Presence
+	}
+
+	updates := make(chan update, 10)
+	accepted := make(chan struct{}, 3)
+
+	clients := []*signaling.SignalingClient{}
+	for i := 0; i < 3; i++ {
+		receiver := i
+
+		client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+			accepted <- struct{}{}
+
+			return nil
+		}, signaling.SignalingClientConfig{
+			OnPresence: func(presence api.Presence) {
+				updates <- update{receiver, presence}
+			},
+		})
+		clients = append(clients, client)
+
+		go client.HandleConn(addr, "presence", func(msg webrtc.DataChannelMessage) {})
+
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client was not accepted")
+		}
+	}
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	if err := clients[0].SendPresence("presence", []byte("typing")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := map[int]bool{}
+	for len(received) < 2 {
+		select {
+		case u := <-updates:
+			if u.receiver == 0 {
+				t.Error("presence was relayed back to its sender")
+			}
+
+			if string(u.presence.Payload) != "typing" {
+				t.Errorf("expected presence typing, got %v", string(u.presence.Payload))
+			}
+
+			received[u.receiver] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("presence did not reach all other members, got it on %v", received)
+		}
+	}
+
+	if err := clients[0].SendPresence("presence", make([]byte, api.MaxPresenceSize+1)); err == nil {
+		t.Error("expected an error for an oversized presence")
+	}
+}
+
+func TestServer(t *testing.T) {
+	server, err := signaling.NewServer(signaling.ServerOptions{
+		MaxConnections: 2,
+		Logger:         logging.NewJSONLogger(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, second, err := signalingtest.ConnectPeers(ctx, listener.Addr().String(), "server", handlers.ClientManagerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Manager.SendMessageUnicast([]byte("hello"), second.Manager.Mac()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-second.Messages:
+	case <-ctx.Done():
+		t.Fatal("message was not received")
+	}
+
+	// Further connections exceed the limit
+	if _, _, err := websocket.Dial(ctx, "ws://"+listener.Addr().String(), nil); err == nil {
+		t.Error("expected the connection to be refused")
+	}
+
+	if metrics := server.Metrics(); metrics.Connections != 2 || metrics.Accepted != 2 || metrics.Refused != 1 || metrics.Communities != 1 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("expected server to be closed, got %v", err)
+	}
+
+	// The clients notice the closed connections asynchronously
+	for server.Metrics().Connections != 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("connections were not closed, got %+v", server.Metrics())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestSignalingClientRelay(t *testing.T) {
+	addr := startSignalingServer(t)
+
+	accepted := make(chan string, 2)
+	relays := make(chan api.Relay, 1)
+
+	// Signaling clients without a ClientManager never open a data channel
+	sender := newTestSignalingClient(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		accepted <- uuid
+
+		return nil
+	})
+	defer sender.Close()
+
+	receiver := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+		accepted <- uuid
+
+		return nil
+	}, signaling.SignalingClientConfig{
+		OnRelay: func(relay api.Relay) {
+			relays <- relay
+		},
+	})
+	defer receiver.Close()
+
+	macs := []string{}
+	for _, client := range []*signaling.SignalingClient{sender, receiver} {
+		go client.HandleConn(addr, "relay", func(msg webrtc.DataChannelMessage) {})
+
+		select {
+		case mac := <-accepted:
+			macs = append(macs, mac)
+		case <-time.After(5 * time.Second):
+			t.Fatal("client was not accepted")
+		}
+	}
+
+	if err := sender.SendRelay(macs[1], []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case relay := <-relays:
+		if relay.SenderMac != macs[0] || string(relay.Payload) != "hello" {
+			t.Errorf("unexpected relay %v of %v", string(relay.Payload), relay.SenderMac)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not reach the receiver")
+	}
+
+	if err := sender.SendRelay(macs[1], make([]byte, api.MaxRelaySize+1)); err == nil {
+		t.Error("expected an error for an oversized relay")
+	}
+}
+
+// Records the opcodes seen by a hook
+type opcodeRecorder struct {
+	lock sync.Mutex
+	seen map[string]bool
+}
+
+func (r *opcodeRecorder) record(message api.Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.seen == nil {
+		r.seen = map[string]bool{}
+	}
+
+	r.seen[message.Opcode] = true
+}
+
+func (r *opcodeRecorder) await(ctx context.Context, t *testing.T, name string, opcode string) {
+	for {
+		r.lock.Lock()
+		seen := r.seen[opcode]
+		r.lock.Unlock()
+
+		if seen {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%v did not see %v", name, opcode)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestSignalingTaps(t *testing.T) {
+	var serverInbound, serverOutbound, clientInbound, clientOutbound, managerOutbound opcodeRecorder
+
+	server, err := signaling.NewServer(signaling.ServerOptions{
+		Communities: handlers.CommunitiesManagerConfig{
+			OnOutbound: serverOutbound.record,
+		},
+		OnInbound: serverInbound.record,
+		Logger:    logging.NewJSONLogger(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer server.Shutdown(ctx)
+
+	opened := make(chan struct{}, 1)
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {
+		opened <- struct{}{}
+	}, handlers.ClientManagerConfig{
+		OnOutbound: managerOutbound.record,
+	})
+	connection := networking.NewConnectionManagerWithConfig(manager, signaling.SignalingClientConfig{
+		OnInbound:  clientInbound.record,
+		OnOutbound: clientOutbound.record,
+	})
+	connection.Connect(listener.Addr().String(), "taps", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+	defer connection.Close()
+
+	// The first member is introduced to the second one, so it sends the offer
+	for manager.Mac() == "" {
+		select {
+		case <-ctx.Done():
+			t.Fatal("first peer was not accepted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	signalingtest.NewPeer(listener.Addr().String(), "taps", handlers.ClientManagerConfig{})
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		t.Fatal("peers did not connect")
+	}
+
+	clientOutbound.await(ctx, t, "client outbound", api.OpcodeApplication)
+	managerOutbound.await(ctx, t, "manager outbound", api.OpcodeOffer)
+	clientInbound.await(ctx, t, "client inbound", api.OpcodeAnswer)
+
+	for _, opcode := range []string{api.OpcodeOffer, api.OpcodeAnswer} {
+		serverInbound.await(ctx, t, "server inbound", opcode)
+		serverOutbound.await(ctx, t, "server outbound", opcode)
+	}
+}
+
+func TestServerExitOnClose(t *testing.T) {
+	server, err := signaling.NewServer(signaling.ServerOptions{
+		Communities: handlers.CommunitiesManagerConfig{
+			ExitOnClose: true,
+		},
+		Logger: logging.NewJSONLogger(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer server.Shutdown(ctx)
+
+	// Keeps the TCP connection of the crashing client, so that it can be killed without a closing handshake
+	conns := make(chan net.Conn, 1)
+	crashing := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err == nil {
+					conns <- conn
+				}
+
+				return conn, err
+			},
+		},
+	}
+
+	apply := func(mac string, client *http.Client) *websocket.Conn {
+		conn, _, err := websocket.Dial(ctx, "ws://"+listener.Addr().String(), &websocket.DialOptions{HTTPClient: client})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := wsjson.Write(ctx, conn, api.NewApplication("crash", mac)); err != nil {
+			t.Fatal(err)
+		}
+
+		var acceptance api.Acceptance
+		if err := wsjson.Read(ctx, conn, &acceptance); err != nil {
+			t.Fatal(err)
+		}
+
+		return conn
+	}
+
+	apply("crashed", crashing)
+	observer := apply("observer", nil)
+	defer observer.Close(websocket.StatusNormalClosure, "")
+
+	(<-conns).Close()
+
+	var resignation api.Resignation
+	if err := wsjson.Read(ctx, observer, &resignation); err != nil {
+		t.Fatal(err)
+	}
+
+	if resignation.Opcode != api.OpcodeResignation || resignation.Mac != "crashed" {
+		t.Errorf("expected resignation of crashed, got %v of %v", resignation.Opcode, resignation.Mac)
+	}
+
+	// The crashed mac is forgotten, so it can apply again
+	rejoined := apply("crashed", nil)
+	rejoined.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestServerCompression(t *testing.T) {
+	for _, compression := range []bool{true, false} {
+		t.Run(fmt.Sprint(compression), func(t *testing.T) {
+			server, err := signaling.NewServer(signaling.ServerOptions{
+				Compression: compression,
+				Logger:      logging.NewJSONLogger(0),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go server.Serve(listener)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			defer server.Shutdown(ctx)
+
+			conn, res, err := websocket.Dial(ctx, "ws://"+listener.Addr().String(), &websocket.DialOptions{
+				CompressionMode: websocket.CompressionContextTakeover,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+
+			if negotiated := strings.Contains(res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"); negotiated != compression {
+				t.Errorf("expected compression to be negotiated %v, got %v", compression, negotiated)
+			}
+		})
+	}
+}
+
+func TestSignalingClientCompression(t *testing.T) {
+	for _, compression := range []bool{true, false} {
+		t.Run(fmt.Sprint(compression), func(t *testing.T) {
+			offered := make(chan string, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				offered <- r.Header.Get("Sec-WebSocket-Extensions")
+
+				conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{
+					InsecureSkipVerify: true, // CORS
+				})
+				if err != nil {
+					return
+				}
+
+				conn.Close(websocket.StatusNormalClosure, "")
+			}))
+			defer server.Close()
+
+			client := newTestSignalingClientWithConfig(func(conn *websocket.Conn, uuid string, acceptance api.Acceptance) error {
+				return nil
+			}, signaling.SignalingClientConfig{
+				Compression: compression,
+			})
+			defer client.Close()
+
+			go client.HandleConn(strings.TrimPrefix(server.URL, "http://"), "compression", func(msg webrtc.DataChannelMessage) {})
+
+			select {
+			case extensions := <-offered:
+				if negotiated := strings.Contains(extensions, "permessage-deflate"); negotiated != compression {
+					t.Errorf("expected compression to be offered %v, got %v", compression, negotiated)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("client did not connect")
+			}
+		})
+	}
+}
+
+func TestSignalingClientAssignedMac(t *testing.T) {
+	server, err := signaling.NewServer(signaling.ServerOptions{
+		Communities: handlers.CommunitiesManagerConfig{
+			AssignMacs: true,
+		},
+		Logger: logging.NewJSONLogger(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer server.Shutdown(ctx)
+
+	joined := make(chan string, 1)
+	opened := make(chan struct{}, 1)
+
+	manager := handlers.NewClientManagerWithConfig(func(mac string, channel *webrtc.DataChannel) {
+		opened <- struct{}{}
+	}, handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+	connection := networking.NewConnectionManagerWithConfig(manager, signaling.SignalingClientConfig{
+		OnJoined: func(community string, mac string) {
+			joined <- mac
+		},
+	})
+	connection.Connect(listener.Addr().String(), "assigned", func(msg webrtc.DataChannelMessage) {}, logging.NewJSONLogger(0))
+	defer connection.Close()
+
+	var mac string
+	select {
+	case mac = <-joined:
+	case <-ctx.Done():
+		t.Fatal("first peer was not accepted")
+	}
+
+	// The handshake only goes through if both peers use the macs the server knows them by
+	second := signalingtest.NewPeer(listener.Addr().String(), "assigned", handlers.ClientManagerConfig{
+		ICEServers: []webrtc.ICEServer{},
+	})
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		t.Fatal("peers did not connect")
+	}
+
+	if manager.Mac() != mac {
+		t.Errorf("expected the manager to use the joined mac %v, got %v", mac, manager.Mac())
+	}
+
+	expected := []handlers.MeshPair{{ReadyMac: second.Manager.Mac(), IntroducedMac: mac}}
+	if pairs := server.Manager.MeshState("assigned"); !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("expected pairs %v, got %v", expected, pairs)
+	}
+}